@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// Sandstorm's API version is its build number: the 187 in v0.187. These
+// are the versions in which fields of the manifest and bridge config,
+// which older versions ignore, first appeared. Paths are as for the
+// pkgdef command, without list indices; fields below one of these are
+// covered by it.
+var apiVersionFields = map[string]uint32{
+	"manifest.actions.nounPhrase":             104,
+	"manifest.metadata":                       104,
+	"manifest.metadata.author.upstreamAuthor": 120,
+	"manifest.metadata.icons.marketBig":       120,
+	"bridgeConfig.viewInfo":                   97,
+	"bridgeConfig.apiPath":                    105,
+	"bridgeConfig.viewInfo.appTitle":          120,
+	"bridgeConfig.viewInfo.grainIcon":         120,
+	"bridgeConfig.viewInfo.matchRequests":     179,
+	"bridgeConfig.viewInfo.matchOffers":       179,
+	"bridgeConfig.viewInfo.eventTypes":        187,
+	"bridgeConfig.saveIdentityCaps":           187,
+	"bridgeConfig.powerboxApis":               208,
+}
+
+// Return the problems with the range of Sandstorm API versions the
+// manifest declares, and with the fields of the manifest and the bridge
+// config `bridgeCfg` which need a newer version than the minimum.
+func checkApiVersions(manifest capnp_spk.Manifest, bridgeCfg capnp_spk.BridgeConfig) (problemList, error) {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return nil, err
+	}
+	manifestData, err := structToData(idx, capnp_spk.Manifest_TypeID, manifest.Struct)
+	if err != nil {
+		return nil, wrapErr("Reading the manifest", err)
+	}
+	cfg, err := structToData(idx, capnp_spk.BridgeConfig_TypeID, bridgeCfg.Struct)
+	if err != nil {
+		return nil, wrapErr("Reading the bridge config", err)
+	}
+	return checkApiVersionData(manifest.MinApiVersion(), manifest.MaxApiVersion(), manifestData, cfg), nil
+}
+
+// Like checkApiVersions, but for the manifest and bridge config as
+// returned by structToData. A maxApiVersion of 0 means there is no
+// maximum, and a minApiVersion of 0 that there is no minimum.
+func checkApiVersionData(min, max uint32, manifest, bridgeCfg *dataNode) problemList {
+	problems := problemList{}
+	minPath := []string{"manifest", "minApiVersion"}
+	if max != 0 && min > max {
+		problems.errorf(minPath, "is %d, which is higher than the maxApiVersion, %d", min, max)
+	}
+
+	uses := map[string]*apiVersionUse{}
+	findApiVersionUses(uses, []string{"manifest"}, manifest)
+	findApiVersionUses(uses, []string{"bridgeConfig"}, bridgeCfg)
+	sorted := make([]*apiVersionUse, 0, len(uses))
+	for _, use := range uses {
+		sorted = append(sorted, use)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.version != b.version {
+			return a.version > b.version
+		}
+		return strings.Join(a.path, ".") < strings.Join(b.path, ".")
+	})
+
+	if min == 0 {
+		if len(sorted) != 0 {
+			problems.warnf(minPath, "is not set, but %s needs API version %d; "+
+				"set minApiVersion = %d so that older versions of Sandstorm warn before installing the app",
+				strings.Join(sorted[0].path, "."), sorted[0].version, sorted[0].version)
+		}
+		return problems
+	}
+	for _, use := range sorted {
+		if use.version > min {
+			problems.warnf(use.path, "needs API version %d, but the minApiVersion is %d, "+
+				"and older versions of Sandstorm ignore it", use.version, min)
+		}
+	}
+	return problems
+}
+
+// The first place a field from apiVersionFields is set.
+type apiVersionUse struct {
+	path    []string
+	version uint32
+}
+
+// Add the fields from apiVersionFields which are set in `n`, at `path`,
+// to `uses`, by their key in apiVersionFields.
+func findApiVersionUses(uses map[string]*apiVersionUse, path []string, n *dataNode) {
+	if n == nil {
+		return
+	}
+	switch n.kind {
+	case dataMap:
+		for _, f := range n.fields {
+			fieldPath := subPath(path, f.key)
+			key := apiVersionKey(fieldPath)
+			if version, ok := apiVersionFields[key]; ok && !isEmptyData(f.value) {
+				if _, seen := uses[key]; !seen {
+					uses[key] = &apiVersionUse{path: fieldPath, version: version}
+				}
+			}
+			findApiVersionUses(uses, fieldPath, f.value)
+		}
+	case dataList:
+		for i, elem := range n.elems {
+			findApiVersionUses(uses, subPath(path, strconv.Itoa(i)), elem)
+		}
+	}
+}
+
+// Report whether `n` has nothing in it: null, or an empty struct or list.
+// Older versions of Sandstorm lose nothing by ignoring such a field.
+func isEmptyData(n *dataNode) bool {
+	switch n.kind {
+	case dataNull:
+		return true
+	case dataMap:
+		return len(n.fields) == 0
+	case dataList:
+		return len(n.elems) == 0
+	}
+	return false
+}
+
+// Return the key in apiVersionFields for the field at `path`: the path
+// without its list indices.
+func apiVersionKey(path []string) string {
+	key := []string{}
+	for _, comp := range path {
+		if !isDigit(comp[0]) {
+			key = append(key, comp)
+		}
+	}
+	return strings.Join(key, ".")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckApiVersionData(t *testing.T) {
+	const (
+		manifest = `{
+		  "appVersion": 1,
+		  "actions": [{"command": {"argv": ["/app"]}}, {"nounPhrase": "note"}],
+		  "metadata": {"icons": {"marketBig": {"svg": "<svg/>"}}}
+		}`
+		bridgeCfg = `{
+		  "viewInfo": {"permissions": [{"name": "edit"}], "matchRequests": []},
+		  "powerboxApis": [{"name": "api", "path": "/"}]
+		}`
+	)
+	for _, c := range []struct {
+		min, max            uint32
+		manifest, bridgeCfg string
+		want                []string
+	}{
+		{0, 0, `{"appVersion": 1}`, `{}`, nil},
+		{0, 0, `{"appVersion": 1, "metadata": {}}`, `{"viewInfo": {}}`, nil},
+		{200, 100, `{}`, `{}`, []string{
+			"manifest.minApiVersion: is 200, which is higher than the maxApiVersion, 100",
+		}},
+		{0, 0, manifest, `{}`, []string{
+			"warning: manifest.minApiVersion: is not set, but manifest.metadata.icons.marketBig needs " +
+				"API version 120; set minApiVersion = 120 so that older versions of Sandstorm warn " +
+				"before installing the app",
+		}},
+		{0, 0, manifest, bridgeCfg, []string{
+			"warning: manifest.minApiVersion: is not set, but bridgeConfig.powerboxApis needs " +
+				"API version 208; set minApiVersion = 208 so that older versions of Sandstorm warn " +
+				"before installing the app",
+		}},
+		{104, 0, manifest, bridgeCfg, []string{
+			"warning: bridgeConfig.powerboxApis: needs API version 208, but the minApiVersion is 104, " +
+				"and older versions of Sandstorm ignore it",
+			"warning: manifest.metadata.icons.marketBig: needs API version 120, but the minApiVersion " +
+				"is 104, and older versions of Sandstorm ignore it",
+		}},
+		{208, 0, manifest, bridgeCfg, nil},
+	} {
+		manifest, err := parseJSON("manifest.json", []byte(c.manifest))
+		if err != nil {
+			t.Fatalf("parsing %s: %v", c.manifest, err)
+		}
+		bridgeCfg, err := parseJSON("bridge.json", []byte(c.bridgeCfg))
+		if err != nil {
+			t.Fatalf("parsing %s: %v", c.bridgeCfg, err)
+		}
+		var got []string
+		for _, p := range checkApiVersionData(c.min, c.max, manifest, bridgeCfg) {
+			msg := strings.Join(p.path, ".") + ": " + p.msg
+			if p.warning {
+				msg = "warning: " + msg
+			}
+			got = append(got, msg)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("checking %d-%d, %s, %s:\n got: %q\nwant: %q",
+				c.min, c.max, c.manifest, c.bridgeCfg, got, c.want)
+		}
+	}
+}
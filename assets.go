@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	slashpath "path"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// This file handles the icons and screenshots given by the -icon and
+// -screenshot flags, which are checked against the sizes documented in
+// Sandstorm's package.capnp, scaled down where needed, and put in the
+// manifest's metadata.
+
+// Prefix of asset paths which refer to files in the docker image, rather
+// than the local filesystem.
+const imageAssetPrefix = "image:"
+
+// The size in pixels, and limit on the size in bytes, of the icon for
+// each context, as documented on Metadata.icons.
+var iconContexts = map[string]struct{ pixels, bytes int }{
+	"appGrid":   {128, 64 << 10},
+	"grain":     {24, 4 << 10},
+	"market":    {150, 64 << 10},
+	"marketBig": {300, 256 << 10},
+}
+
+// An icon, ready to be put in the manifest: either an SVG, or PNGs at
+// one or both resolutions.
+type iconAsset struct {
+	svg          string
+	dpi1x, dpi2x []byte
+}
+
+// A screenshot, ready to be put in the manifest. Exactly one of png and
+// jpeg is set.
+type screenshotAsset struct {
+	width, height uint32
+	png, jpeg     []byte
+}
+
+// The icons and screenshots to put in the manifest.
+type appAssets struct {
+	// Icons, by context (e.g. appGrid).
+	icons map[string]*iconAsset
+
+	screenshots []screenshotAsset
+}
+
+// Split the argument of an -icon flag, of the form [<context>=]<file>,
+// into its parts. The context defaults to appGrid, which Sandstorm also
+// uses in place of any other icons which are not given.
+func splitIconFlag(arg string) (context, path string, err error) {
+	context, path = "appGrid", arg
+	if i := strings.Index(arg, "="); i >= 0 {
+		context, path = arg[:i], arg[i+1:]
+	}
+	if _, ok := iconContexts[context]; !ok {
+		return "", "", fmt.Errorf("unknown icon context %q in %q; expected one of "+
+			"appGrid, grain, market or marketBig", context, arg)
+	}
+	return context, path, nil
+}
+
+// Report whether any of the icons (given as arguments to -icon) or
+// screenshots are to be read from the image.
+func usesImageAssets(icons, screenshots []string) bool {
+	paths := append([]string{}, screenshots...)
+	for _, arg := range icons {
+		_, path, _ := splitIconFlag(arg)
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(path, imageAssetPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the icons (given as arguments to -icon) and screenshots. Paths
+// starting with image: are read from `tree`, the image's filesystem.
+func loadAssets(icons, screenshots []string, tree Tree) (*appAssets, error) {
+	readAsset := func(path string) ([]byte, error) {
+		if !strings.HasPrefix(path, imageAssetPrefix) {
+			return ioutil.ReadFile(path)
+		}
+		if tree == nil {
+			return nil, fmt.Errorf("%s refers to the image, which is not available", path)
+		}
+		return tree.readFile(slashpath.Join("/", strings.TrimPrefix(path, imageAssetPrefix)))
+	}
+
+	assets := &appAssets{icons: map[string]*iconAsset{}}
+	for _, arg := range icons {
+		context, path, err := splitIconFlag(arg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := assets.icons[context]; ok {
+			return nil, fmt.Errorf("the %s icon is given more than once", context)
+		}
+		data, err := readAsset(path)
+		if err != nil {
+			return nil, err
+		}
+		icon, err := makeIcon(context, data)
+		if err != nil {
+			return nil, wrapErr(path, err)
+		}
+		assets.icons[context] = icon
+	}
+	for _, path := range screenshots {
+		data, err := readAsset(path)
+		if err != nil {
+			return nil, err
+		}
+		shot, err := makeScreenshot(path, data)
+		if err != nil {
+			return nil, wrapErr(path, err)
+		}
+		assets.screenshots = append(assets.screenshots, shot)
+	}
+	return assets, nil
+}
+
+// Report whether `data` looks like an SVG image.
+func isSVG(data []byte) bool {
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	return bytes.Contains(head, []byte("<svg"))
+}
+
+// Return the icon for `context` made from the image `data`. SVGs are used
+// as they are. Raster images must be square, and at least the size of the
+// icon; they are scaled down to that size, and to twice that size for
+// high-dpi displays, if they are big enough.
+func makeIcon(context string, data []byte) (*iconAsset, error) {
+	spec := iconContexts[context]
+	if isSVG(data) {
+		// Sandstorm allows for the compression of SVGs when they are
+		// served:
+		if limit := 4 * spec.bytes; len(data) > limit {
+			return nil, fmt.Errorf("the SVG is %d bytes, but the %s icon may be at most %d",
+				len(data), context, limit)
+		}
+		return &iconAsset{svg: string(data)}, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not an SVG, PNG or JPEG image: %v", err)
+	}
+	size := img.Bounds().Size()
+	if size.X != size.Y {
+		return nil, fmt.Errorf("the image is %dx%d, but icons must be square", size.X, size.Y)
+	}
+	if size.X < spec.pixels {
+		return nil, fmt.Errorf("the image is %dx%d, but the %s icon must be at least %dx%d",
+			size.X, size.Y, context, spec.pixels, spec.pixels)
+	}
+
+	// Use the PNG we were given if it is already the right size, rather
+	// than re-encoding it:
+	encode := func(pixels int) ([]byte, error) {
+		if size.X == pixels && format == "png" {
+			return data, nil
+		}
+		buf := &bytes.Buffer{}
+		enc := &png.Encoder{CompressionLevel: png.BestCompression}
+		err := enc.Encode(buf, scaleImage(img, pixels))
+		return buf.Bytes(), err
+	}
+	icon := &iconAsset{}
+	if icon.dpi1x, err = encode(spec.pixels); err != nil {
+		return nil, err
+	}
+	if len(icon.dpi1x) > spec.bytes {
+		return nil, fmt.Errorf("the %s icon is %d bytes as a PNG, but may be at most %d",
+			context, len(icon.dpi1x), spec.bytes)
+	}
+	if size.X >= 2*spec.pixels {
+		if icon.dpi2x, err = encode(2 * spec.pixels); err != nil {
+			return nil, err
+		}
+		// The limit is doubled for high-dpi images:
+		if len(icon.dpi2x) > 2*spec.bytes {
+			return nil, fmt.Errorf("the high-dpi %s icon is %d bytes as a PNG, but may be at most %d",
+				context, len(icon.dpi2x), 2*spec.bytes)
+		}
+	}
+	return icon, nil
+}
+
+// Return a screenshot made from the PNG or JPEG image `data`, read from
+// `path`. Screenshots named like shot@2x.png are taken to be high-dpi, so
+// that their size in device-independent pixels is half their actual size.
+func makeScreenshot(path string, data []byte) (screenshotAsset, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return screenshotAsset{}, fmt.Errorf("not a PNG or JPEG image: %v", err)
+	}
+	shot := screenshotAsset{width: uint32(config.Width), height: uint32(config.Height)}
+	base := slashpath.Base(path)
+	if strings.Contains(base, "@2x.") {
+		shot.width /= 2
+		shot.height /= 2
+	}
+	switch format {
+	case "png":
+		shot.png = data
+	case "jpeg":
+		shot.jpeg = data
+	default:
+		return screenshotAsset{}, fmt.Errorf("screenshots must be PNG or JPEG images, not %s", format)
+	}
+	return shot, nil
+}
+
+// Scale the square image `src` down to `pixels` x `pixels`, averaging
+// the source pixels which cover each destination pixel.
+func scaleImage(src image.Image, pixels int) *image.RGBA {
+	bounds := src.Bounds()
+	srcSize := bounds.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, pixels, pixels))
+	if srcSize == pixels {
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+	for y := 0; y < pixels; y++ {
+		y0, y1 := y*srcSize/pixels, (y+1)*srcSize/pixels
+		for x := 0; x < pixels; x++ {
+			x0, x1 := x*srcSize/pixels, (x+1)*srcSize/pixels
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// RGBA returns premultiplied values, so
+					// averaging them is correct for
+					// transparent pixels too.
+					cr, cg, cb, ca := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// Put the icons and screenshots in `assets` in the manifest's metadata,
+// replacing any given by the package definition.
+func (assets *appAssets) apply(manifest capnp_spk.Manifest) error {
+	if len(assets.icons) == 0 && len(assets.screenshots) == 0 {
+		return nil
+	}
+	metadata, err := manifest.Metadata()
+	if err != nil {
+		return wrapErr("Reading the metadata", err)
+	}
+	if !manifest.HasMetadata() {
+		if metadata, err = manifest.NewMetadata(); err != nil {
+			return wrapErr("Setting the metadata", err)
+		}
+	}
+
+	icons := metadata.Icons()
+	newIcon := map[string]func() (capnp_spk.Metadata_Icon, error){
+		"appGrid":   icons.NewAppGrid,
+		"grain":     icons.NewGrain,
+		"market":    icons.NewMarket,
+		"marketBig": icons.NewMarketBig,
+	}
+	for context, asset := range assets.icons {
+		icon, err := newIcon[context]()
+		if err == nil {
+			err = asset.set(icon)
+		}
+		if err != nil {
+			return wrapErr("Setting the "+context+" icon", err)
+		}
+	}
+
+	if len(assets.screenshots) == 0 {
+		return nil
+	}
+	list, err := metadata.NewScreenshots(int32(len(assets.screenshots)))
+	if err != nil {
+		return wrapErr("Setting the screenshots", err)
+	}
+	for i, shot := range assets.screenshots {
+		s := list.At(i)
+		s.SetWidth(shot.width)
+		s.SetHeight(shot.height)
+		if shot.png != nil {
+			err = s.SetPng(shot.png)
+		} else {
+			err = s.SetJpeg(shot.jpeg)
+		}
+		if err != nil {
+			return wrapErr("Setting the screenshots", err)
+		}
+	}
+	return nil
+}
+
+// Store the icon in `icon`.
+func (asset *iconAsset) set(icon capnp_spk.Metadata_Icon) error {
+	if asset.svg != "" {
+		return icon.SetSvg(asset.svg)
+	}
+	icon.SetPng()
+	png := icon.Png()
+	if err := png.SetDpi1x(asset.dpi1x); err != nil {
+		return err
+	}
+	if asset.dpi2x != nil {
+		return png.SetDpi2x(asset.dpi2x)
+	}
+	return nil
+}
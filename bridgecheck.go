@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// This file checks the bridge config for mistakes which Sandstorm would
+// not catch until the app is running (if at all), such as roles which
+// don't match the permissions, or API paths the bridge can't use.
+
+// Matches valid names of permissions and event types.
+var bridgeNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// A problem found in the package definition, at the field `path`.
+type pkgDefProblem struct {
+	path    []string
+	msg     string
+	warning bool
+}
+
+// Collects the problems found by checkBridgeConfig.
+type problemList []pkgDefProblem
+
+func (l *problemList) errorf(path []string, format string, args ...interface{}) {
+	*l = append(*l, pkgDefProblem{path: path, msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *problemList) warnf(path []string, format string, args ...interface{}) {
+	*l = append(*l, pkgDefProblem{path: path, msg: fmt.Sprintf(format, args...), warning: true})
+}
+
+// Return the problems with the bridge config `bridgeCfg`, which goes with
+// `manifest`. Paths are relative to the PackageDefinition, as for the
+// pkgdef command.
+func checkBridgeConfig(manifest capnp_spk.Manifest, bridgeCfg capnp_spk.BridgeConfig) (problemList, error) {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := structToData(idx, capnp_spk.BridgeConfig_TypeID, bridgeCfg.Struct)
+	if err != nil {
+		return nil, wrapErr("Reading the bridge config", err)
+	}
+	usesBridge := false
+	if len(cfg.fields) != 0 {
+		usesBridge, err = runsBridge(manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return checkBridgeData(cfg, usesBridge), nil
+}
+
+// Return the problems with the bridge config `cfg`, as returned by
+// structToData. `usesBridge` says whether the app runs behind
+// sandstorm-http-bridge.
+func checkBridgeData(cfg *dataNode, usesBridge bool) problemList {
+	problems := problemList{}
+	base := []string{"bridgeConfig"}
+
+	// The permissions and roles:
+	viewInfo := fieldNode(cfg, "viewInfo")
+	viewInfoPath := subPath(base, "viewInfo")
+	permissions := listElems(viewInfo, "permissions")
+	names := map[string]int{}
+	for i, perm := range permissions {
+		path := subPath(viewInfoPath, "permissions", strconv.Itoa(i))
+		name := scalarText(fieldNode(perm, "name"))
+		switch {
+		case name == "":
+			problems.errorf(subPath(path, "name"), "permissions must have a name")
+		case !bridgeNameRegexp.MatchString(name):
+			problems.errorf(subPath(path, "name"),
+				"permission names must be letters and digits, starting with a letter: %q", name)
+		default:
+			if other, ok := names[name]; ok {
+				problems.errorf(subPath(path, "name"),
+					"permission %q is also defined by permissions.%d", name, other)
+			} else {
+				names[name] = i
+			}
+		}
+		if localizedText(fieldNode(perm, "title")) == "" {
+			problems.warnf(subPath(path, "title"),
+				"permissions should have a title, which is shown when sharing the grain")
+		}
+	}
+	titles := map[string]int{}
+	defaultRole := -1
+	for i, role := range listElems(viewInfo, "roles") {
+		path := subPath(viewInfoPath, "roles", strconv.Itoa(i))
+		title := localizedText(fieldNode(role, "title"))
+		if title == "" {
+			problems.errorf(subPath(path, "title"), "roles must have a title")
+		} else if other, ok := titles[title]; ok {
+			problems.errorf(subPath(path, "title"), "role %q is also defined by roles.%d", title, other)
+		} else {
+			titles[title] = i
+		}
+		if bits := listElems(role, "permissions"); len(bits) != len(permissions) {
+			problems.errorf(subPath(path, "permissions"),
+				"has %d entries, but there are %d permissions; there must be one for each",
+				len(bits), len(permissions))
+		}
+		if scalarText(fieldNode(role, "default")) == "true" {
+			if defaultRole >= 0 {
+				problems.errorf(subPath(path, "default"),
+					"only one role may be the default, but roles.%d is too", defaultRole)
+			} else {
+				defaultRole = i
+			}
+		}
+	}
+	if len(listElems(viewInfo, "deniedPermissions")) != 0 {
+		problems.warnf(subPath(viewInfoPath, "deniedPermissions"),
+			"is meant for views shared with less than full access, and should not be set "+
+				"for the app's main view")
+	}
+	saveIdentityCaps := scalarText(fieldNode(cfg, "saveIdentityCaps")) == "true"
+	eventNames := map[string]int{}
+	for i, eventType := range listElems(viewInfo, "eventTypes") {
+		path := subPath(viewInfoPath, "eventTypes", strconv.Itoa(i))
+		name := scalarText(fieldNode(eventType, "name"))
+		if !bridgeNameRegexp.MatchString(name) {
+			problems.errorf(subPath(path, "name"),
+				"event type names must be letters and digits, starting with a letter: %q", name)
+		} else if other, ok := eventNames[name]; ok {
+			problems.errorf(subPath(path, "name"),
+				"event type %q is also defined by eventTypes.%d", name, other)
+		} else {
+			eventNames[name] = i
+		}
+		required := fieldNode(eventType, "requiredPermission")
+		if index := scalarText(fieldNode(required, "permissionIndex")); index != "" {
+			if n, err := strconv.Atoi(index); err != nil || n >= len(permissions) {
+				problems.errorf(subPath(path, "requiredPermission", "permissionIndex"),
+					"is %s, but there are only %d permissions", index, len(permissions))
+			}
+		}
+		if fieldNode(required, "explicitList") != nil && !saveIdentityCaps {
+			// The users are named by their Identity capabilities,
+			// which the bridge only hands out if it saves them.
+			problems.warnf(subPath(path, "requiredPermission", "explicitList"),
+				"events of this type can only be shown to the users they name, which needs "+
+					"saveIdentityCaps to be set")
+		}
+	}
+	for _, field := range []string{"matchRequests", "matchOffers"} {
+		for i, desc := range listElems(viewInfo, field) {
+			checkPowerboxDescriptor(&problems, subPath(viewInfoPath, field, strconv.Itoa(i)), desc)
+		}
+	}
+
+	// The API settings:
+	if apiPath := scalarText(fieldNode(cfg, "apiPath")); apiPath != "" && !strings.HasSuffix(apiPath, "/") {
+		problems.errorf(subPath(base, "apiPath"), "must end with \"/\": %q", apiPath)
+	}
+	apiNames := map[string]int{}
+	for i, api := range listElems(cfg, "powerboxApis") {
+		path := subPath(base, "powerboxApis", strconv.Itoa(i))
+		name := scalarText(fieldNode(api, "name"))
+		if name == "" {
+			problems.errorf(subPath(path, "name"), "powerbox APIs must have a name")
+		} else if other, ok := apiNames[name]; ok {
+			problems.errorf(subPath(path, "name"),
+				"powerbox API %q is also defined by powerboxApis.%d", name, other)
+		} else {
+			apiNames[name] = i
+		}
+		if apiPath := scalarText(fieldNode(api, "path")); !strings.HasSuffix(apiPath, "/") {
+			problems.errorf(subPath(path, "path"), "must end with \"/\": %q", apiPath)
+		}
+		if bits := listElems(api, "permissions"); len(bits) > len(permissions) {
+			problems.errorf(subPath(path, "permissions"),
+				"has %d entries, but there are only %d permissions", len(bits), len(permissions))
+		}
+		if localizedText(fieldNode(fieldNode(api, "displayInfo"), "title")) == "" {
+			problems.errorf(subPath(path, "displayInfo", "title"),
+				"powerbox APIs must have a title, which is shown in the powerbox")
+		}
+	}
+
+	// None of this does anything unless the app runs behind the bridge:
+	if len(cfg.fields) != 0 && !usesBridge {
+		problems.warnf(base, "is only used by sandstorm-http-bridge, but none of the "+
+			"manifest's commands run /sandstorm-http-bridge")
+	}
+	return problems
+}
+
+// Check the powerbox descriptor `desc`, at `path`.
+func checkPowerboxDescriptor(problems *problemList, path []string, desc *dataNode) {
+	tags := listElems(desc, "tags")
+	if len(tags) == 0 {
+		problems.errorf(subPath(path, "tags"), "powerbox descriptors must have at least one tag")
+	}
+	for i, tag := range tags {
+		if id := scalarText(fieldNode(tag, "id")); id == "" || id == "0" {
+			problems.errorf(subPath(path, "tags", strconv.Itoa(i), "id"),
+				"tags must have an id: the type id of the interface they describe")
+		}
+	}
+}
+
+// Report whether any of the manifest's commands run sandstorm-http-bridge.
+func runsBridge(manifest capnp_spk.Manifest) (bool, error) {
+	commands, err := manifestCommands(manifest)
+	if err != nil {
+		return false, err
+	}
+	for _, command := range commands {
+		argv, err := commandArgv(command)
+		if err != nil {
+			return false, wrapErr("Reading the command's argv", err)
+		}
+		if bridgePort(argv) != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Return `path` followed by `comps`, without changing `path`.
+func subPath(path []string, comps ...string) []string {
+	return append(append([]string{}, path...), comps...)
+}
+
+// Return the value of the field `key` of `n`, a struct as returned by
+// structToData, or nil if it is not set. `n` may be nil.
+func fieldNode(n *dataNode, key string) *dataNode {
+	if n == nil || n.kind != dataMap {
+		return nil
+	}
+	if f, ok := n.field(key); ok {
+		return f.value
+	}
+	return nil
+}
+
+// Return the elements of the list in the field `key` of `n`.
+func listElems(n *dataNode, key string) []*dataNode {
+	if l := fieldNode(n, key); l != nil {
+		return l.elems
+	}
+	return nil
+}
+
+// Return the text of `n`, a scalar, or "" if it is not set.
+func scalarText(n *dataNode) string {
+	if n == nil || n.kind != dataScalar {
+		return ""
+	}
+	return n.text
+}
+
+// Return the default text of `n`, a LocalizedText.
+func localizedText(n *dataNode) string {
+	if n != nil && n.kind == dataMap {
+		return scalarText(fieldNode(n, "defaultText"))
+	}
+	return scalarText(n)
+}
+
+// Print the warnings in `problems` to `warnings`, and return an error
+// listing the rest, if there are any. The location of each problem in the package
+// definition `filename` (with the constant `name`, for schema files) is
+// included where it can be found; if `tree` is non-nil, the package
+// definition is read from there.
+func reportProblems(problems problemList, filename, name string, tree Tree, warnings io.Writer) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	locate := pkgDefLocator(filename, name, tree)
+	errs := []string{}
+	for _, p := range problems {
+		msg := strings.Join(p.path, ".") + ": " + p.msg
+		if pos, ok := locate(p.path); ok {
+			msg = pos.String() + ": " + msg
+		}
+		if p.warning {
+			fwarnf(warnings, "%s", msg)
+		} else {
+			errs = append(errs, msg)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", errs[0])
+	default:
+		return fmt.Errorf("%d problems:\n    %s", len(errs), strings.Join(errs, "\n    "))
+	}
+}
+
+// Return a function which finds the position of the field at a path in
+// the package definition, as for reportProblems. If the field is not
+// set in the package definition, e.g. because it comes from an image
+// label, the position of the closest enclosing value which is set is
+// returned instead.
+func pkgDefLocator(filename, name string, tree Tree) func(path []string) (srcPos, bool) {
+	none := func([]string) (srcPos, bool) { return srcPos{}, false }
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return none
+	}
+	if tree != nil {
+		e.readFile = tree.readFile
+		e.allowAbsolute = true
+	}
+	if pkgDefFormat(filename) == "capnp" {
+		return func(path []string) (srcPos, bool) {
+			target, err := e.findValue(filename, name, path)
+			if err != nil || target.v == nil {
+				return srcPos{}, false
+			}
+			return target.v.pos, true
+		}
+	}
+	src, err := e.readFile(filename)
+	if err != nil {
+		return none
+	}
+	root, err := parseDataFile(filename, src)
+	if err != nil {
+		return none
+	}
+	return func(path []string) (srcPos, bool) {
+		for i := len(path); i >= 0; i-- {
+			if n, err := getDataField(e.schema, root, path[:i]); err == nil {
+				return n.pos, n.pos.filename != ""
+			}
+		}
+		return srcPos{}, false
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckBridgeData(t *testing.T) {
+	for _, c := range []struct {
+		cfg        string
+		usesBridge bool
+		want       []string
+	}{
+		{`{}`, false, nil},
+		{`{"viewInfo": {
+		    "permissions": [{"name": "editor", "title": "edit"}, {"name": "viewer", "title": "view"}],
+		    "roles": [{"title": "editor", "permissions": [true, true], "default": true}]
+		  },
+		  "apiPath": "/api/"}`,
+			true, nil},
+		{`{"apiPath": "/api/"}`, false, []string{
+			"warning: bridgeConfig: is only used by sandstorm-http-bridge, but none of the " +
+				"manifest's commands run /sandstorm-http-bridge",
+		}},
+
+		// Permissions:
+		{`{"viewInfo": {"permissions": [
+		    {"title": "a"},
+		    {"name": "can edit", "title": "b"},
+		    {"name": "read,write", "title": "c"},
+		    {"name": "2fa", "title": "d"},
+		    {"name": "edit", "title": "e"},
+		    {"name": "edit"}
+		  ]}}`,
+			true, []string{
+				"bridgeConfig.viewInfo.permissions.0.name: permissions must have a name",
+				`bridgeConfig.viewInfo.permissions.1.name: permission names must be letters and digits, starting with a letter: "can edit"`,
+				`bridgeConfig.viewInfo.permissions.2.name: permission names must be letters and digits, starting with a letter: "read,write"`,
+				`bridgeConfig.viewInfo.permissions.3.name: permission names must be letters and digits, starting with a letter: "2fa"`,
+				`bridgeConfig.viewInfo.permissions.5.name: permission "edit" is also defined by permissions.4`,
+				"warning: bridgeConfig.viewInfo.permissions.5.title: permissions should have a title, " +
+					"which is shown when sharing the grain",
+			}},
+
+		// Roles:
+		{`{"viewInfo": {
+		    "permissions": [{"name": "edit", "title": "edit"}],
+		    "roles": [
+		      {"title": {"defaultText": "editor"}, "permissions": [true], "default": true},
+		      {"title": "editor", "permissions": [], "default": true},
+		      {"permissions": [false]}
+		    ]
+		  }}`,
+			true, []string{
+				`bridgeConfig.viewInfo.roles.1.title: role "editor" is also defined by roles.0`,
+				"bridgeConfig.viewInfo.roles.1.permissions: has 0 entries, but there are 1 permissions; " +
+					"there must be one for each",
+				"bridgeConfig.viewInfo.roles.1.default: only one role may be the default, but roles.0 is too",
+				"bridgeConfig.viewInfo.roles.2.title: roles must have a title",
+			}},
+		{`{"viewInfo": {"deniedPermissions": [false]}}`, true, []string{
+			"warning: bridgeConfig.viewInfo.deniedPermissions: is meant for views shared with less " +
+				"than full access, and should not be set for the app's main view",
+		}},
+
+		// Event types:
+		{`{"viewInfo": {
+		    "permissions": [{"name": "edit", "title": "edit"}],
+		    "eventTypes": [
+		      {"name": "comment", "requiredPermission": {"everyone": null}},
+		      {"name": "comment", "requiredPermission": {"permissionIndex": 0}},
+		      {"name": "new-doc", "requiredPermission": {"permissionIndex": 1}},
+		      {"name": "mention", "requiredPermission": {"explicitList": null}}
+		    ]
+		  }}`,
+			true, []string{
+				`bridgeConfig.viewInfo.eventTypes.1.name: event type "comment" is also defined by eventTypes.0`,
+				`bridgeConfig.viewInfo.eventTypes.2.name: event type names must be letters and digits, starting with a letter: "new-doc"`,
+				"bridgeConfig.viewInfo.eventTypes.2.requiredPermission.permissionIndex: is 1, but there are only 1 permissions",
+				"warning: bridgeConfig.viewInfo.eventTypes.3.requiredPermission.explicitList: events of this type " +
+					"can only be shown to the users they name, which needs saveIdentityCaps to be set",
+			}},
+		{`{"viewInfo": {"eventTypes": [{"name": "mention", "requiredPermission": {"explicitList": null}}]},
+		  "saveIdentityCaps": true}`,
+			true, nil},
+
+		// Powerbox descriptors:
+		{`{"viewInfo": {
+		    "matchRequests": [{"tags": []}],
+		    "matchOffers": [{"tags": [{"id": "0"}, {"id": "12345"}, {"value": null}]}]
+		  }}`,
+			true, []string{
+				"bridgeConfig.viewInfo.matchRequests.0.tags: powerbox descriptors must have at least one tag",
+				"bridgeConfig.viewInfo.matchOffers.0.tags.0.id: tags must have an id: the type id of the interface they describe",
+				"bridgeConfig.viewInfo.matchOffers.0.tags.2.id: tags must have an id: the type id of the interface they describe",
+			}},
+
+		// APIs:
+		{`{"apiPath": "/api",
+		  "viewInfo": {"permissions": [{"name": "edit", "title": "edit"}]},
+		  "powerboxApis": [
+		    {"name": "rss", "path": "/rss/", "displayInfo": {"title": "RSS"}, "permissions": [true]},
+		    {"name": "rss", "path": "/feed", "displayInfo": {"title": "Feed"}},
+		    {"path": "/", "permissions": [true, false]}
+		  ]}`,
+			true, []string{
+				`bridgeConfig.apiPath: must end with "/": "/api"`,
+				`bridgeConfig.powerboxApis.1.name: powerbox API "rss" is also defined by powerboxApis.0`,
+				`bridgeConfig.powerboxApis.1.path: must end with "/": "/feed"`,
+				"bridgeConfig.powerboxApis.2.name: powerbox APIs must have a name",
+				"bridgeConfig.powerboxApis.2.permissions: has 2 entries, but there are only 1 permissions",
+				"bridgeConfig.powerboxApis.2.displayInfo.title: powerbox APIs must have a title, which is shown in the powerbox",
+			}},
+	} {
+		cfg, err := parseJSON("test.json", []byte(c.cfg))
+		if err != nil {
+			t.Fatalf("parsing %s: %v", c.cfg, err)
+		}
+		var got []string
+		for _, p := range checkBridgeData(cfg, c.usesBridge) {
+			msg := strings.Join(p.path, ".") + ": " + p.msg
+			if p.warning {
+				msg = "warning: " + msg
+			}
+			got = append(got, msg)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("checking %s:\n got: %q\nwant: %q", c.cfg, got, c.want)
+		}
+	}
+}
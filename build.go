@@ -1,20 +1,64 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
 type buildFlags struct {
 	// The flags proper:
 	pkgDef, outFilename, altAppKey string
+	force                          bool
+
+	// Merge the image config's environment and working directory into
+	// the manifest's commands.
+	inheritImageConfig bool
+
+	// Fill in empty manifest fields from the image's OCI labels.
+	useImageLabels bool
+
+	// Override the versions in the package definition.
+	appVersion, marketingVersion string
+	versionFromGit               bool
+
+	// Directory containing PO files with translations of the manifest.
+	poDir string
+
+	// Icons (of the form [<context>=]<file>) and screenshots to put in
+	// the manifest; see assets.go.
+	icons, screenshots stringListFlag
+
+	// The build profile to use, from the project config; see
+	// project.go.
+	profile string
+
+	// Settings from the profile. These are not flags.
+	keyring, titleSuffix, versionSuffix string
+
+	// An earlier release of the app, against which to check the new
+	// package; see previous.go.
+	previous string
+
+	// The number of versions to keep in the change log.
+	changeLogVersions int
 
 	// The two logical parts of pkgDef:
 	pkgDefFile, pkgDefVar string
+
+	// Directory in which to put the spk, if its name is inferred from
+	// the package metadata. This is not a flag; it is set by build -all.
+	outDir string
+
+	// The name of the variant being built, if any, which is included
+	// in the inferred name of the spk. This is not a flag either.
+	variant string
 }
 
 func (f *buildFlags) Register() {
@@ -24,7 +68,10 @@ func (f *buildFlags) Register() {
 		"The location from which to read the package definition, of the form\n"+
 			"<def-file>:<name>. <def-file> is the name of the file to look in,\n"+
 			"and <name> is the name of the constant defining the package\n"+
-			"definition.",
+			"definition. If <def-file> is a .json, .yaml or .yml file, the\n"+
+			":<name> part is not needed. By default, if there is no\n"+
+			"sandstorm-pkgdef.capnp, a sandstorm-pkgdef.yaml, .yml or .json\n"+
+			"is used instead.",
 	)
 	flag.StringVar(&f.outFilename,
 		"out", "",
@@ -36,46 +83,351 @@ func (f *buildFlags) Register() {
 			"defined in the package definition. This can be useful if e.g.\n"+
 			"you do not have access to the key with which the final app is\n"+
 			"published.")
+	flag.BoolVar(&f.force,
+		"force", false,
+		"Re-pack the spk even if none of its inputs have changed since\n"+
+			"the last build.")
+	flag.BoolVar(&f.inheritImageConfig,
+		"inherit-image-config", false,
+		"Add the environment variables (ENV) from the image's config to\n"+
+			"each command in the manifest, unless the package definition sets\n"+
+			"them, and run the commands in the image's working directory\n"+
+			"(WORKDIR). Also warns about image settings which Sandstorm\n"+
+			"ignores, such as USER, VOLUME and EXPOSE.")
+	flag.BoolVar(&f.useImageLabels,
+		"use-image-labels", false,
+		"Fill in the app's title, marketing version, website, source code\n"+
+			"URL, license and contact email from the image's OCI labels\n"+
+			"(org.opencontainers.image.*), where the package definition\n"+
+			"leaves them empty.")
+	flag.StringVar(&f.appVersion,
+		"app-version", "",
+		"Use this appVersion instead of the one in the package definition.")
+	flag.StringVar(&f.marketingVersion,
+		"marketing-version", "",
+		"Use this appMarketingVersion instead of the one in the package\n"+
+			"definition. The name of the spk follows it, unless -out is given.")
+	flag.BoolVar(&f.versionFromGit,
+		"version-from-git", false,
+		"Derive the versions from the git repository containing the\n"+
+			"package definition, unless they are given explicitly: the\n"+
+			"appVersion is the number of commits, and the marketing version\n"+
+			"is the output of git describe --tags (without the \"v\" in tags\n"+
+			"like v1.2.3).")
+	flag.StringVar(&f.poDir,
+		"po-dir", "",
+		"Add the translations from the gettext PO files (<locale>.po) in\n"+
+			"this directory to the texts in the manifest and bridge config.\n"+
+			"See docker-spk l10n.")
+	flag.StringVar(&f.profile,
+		"profile", "",
+		"Use this profile from the project config (docker-spk.yaml, next\n"+
+			"to the package definition), which may change the app id, the\n"+
+			"title and marketing version, the name of the spk and the\n"+
+			"keyring. Flags given explicitly take precedence.")
+	flag.StringVar(&f.previous,
+		"previous", "",
+		"Check the new package against this spk, the app's previous\n"+
+			"release: fail unless it is for the same app and the new\n"+
+			"appVersion is higher, and warn if the marketing version goes\n"+
+			"down.")
+	flag.IntVar(&f.changeLogVersions,
+		"changelog-versions", defaultChangeLogVersions,
+		"The number of versions to keep in the change log taken from\n"+
+			"CHANGELOG.md, counting from the app's marketing version.\n"+
+			"0 keeps the whole change log.")
+	flag.Var(&f.icons,
+		"icon",
+		"Use this image as the app's icon, in the form [<context>=]<file>,\n"+
+			"where <context> is appGrid (the default), grain, market or\n"+
+			"marketBig. The file may be an SVG, or a square PNG or JPEG at\n"+
+			"least as big as the icon, which is scaled down as needed. Paths\n"+
+			"starting with image: are read from the image. May be repeated,\n"+
+			"once per context.")
+	flag.Var(&f.screenshots,
+		"screenshot",
+		"Use this PNG or JPEG image as a screenshot of the app, for the\n"+
+			"app market. May be repeated; if given, these replace any\n"+
+			"screenshots in the package definition. Images named like\n"+
+			"name@2x.png are taken to be high-dpi. Paths starting with\n"+
+			"image: are read from the image.")
 }
 
 func (f *buildFlags) Parse() {
 	flag.Parse()
+	if !f.splitPkgDef() {
+		usageErr("-pkg-def's argument must be of the form <def-file>:<name>")
+	}
+	if f.appVersion != "" {
+		if _, err := parseAppVersion(f.appVersion); err != nil {
+			usageErr(err.Error())
+		}
+	}
+	if f.changeLogVersions < 0 {
+		usageErr("-changelog-versions must not be negative")
+	}
+	for _, icon := range f.icons {
+		if _, _, err := splitIconFlag(icon); err != nil {
+			usageErr(err.Error())
+		}
+	}
+}
+
+// Set pkgDefFile and pkgDefVar based on pkgDef. Returns false if pkgDef
+// is not of the correct form.
+func (f *buildFlags) splitPkgDef() bool {
 	pkgDefParts := strings.SplitN(f.pkgDef, ":", 2)
 	if len(pkgDefParts) != 2 {
-		usageErr("-pkg-def's argument must be of the form <def-file>:<name>")
+		if pkgDefFormat(f.pkgDef) == "capnp" {
+			return false
+		}
+		pkgDefParts = append(pkgDefParts, "")
 	}
 	f.pkgDefFile = pkgDefParts[0]
 	f.pkgDefVar = pkgDefParts[1]
+	return true
 }
 
-func buildCmd() {
-	bFlags := &buildFlags{}
-	bFlags.Register()
-	bFlags.Parse()
+// Flags for the build subcommand.
+type buildCmdFlags struct {
+	// flags shared with the pack command:
+	buildFlags
+
+	// other flags:
+	quiet bool
+
+	// Options passed through to docker build:
+	dockerfile, target              string
+	buildArgs, secrets, ssh, labels stringListFlag
+	noCache, pull                   bool
+
+	// Variants of the app to build; if empty, just build the one
+	// specified by the other flags.
+	variants variantListFlag
+
+	// If non-empty, build every app found under this directory,
+	// running up to `jobs` builds at a time.
+	all  string
+	jobs int
+
+	// If true, rebuild whenever the sources change.
+	watch bool
 
-	cmd := exec.Command("docker", "build", "-q", ".")
-	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
-	chkfatal("Creating pipe for docker build", err)
-	chkfatal("Starting docker build", cmd.Start())
-	r := bufio.NewScanner(out)
-
-	image := ""
-	for r.Scan() {
-		line := r.Text()
-		fmt.Println(line)
-		image = line
-	}
-	chkfatal("Parsing output from docker build", err)
-	chkfatal("Problem invoking docker build", cmd.Wait())
+	// The build context directory; this is a positional argument,
+	// rather than a flag.
+	contextDir string
+}
+
+func (f *buildCmdFlags) Register() {
+	f.buildFlags.Register()
+	flag.BoolVar(&f.quiet,
+		"quiet", false,
+		"Suppress the output of docker build, except for errors.")
+	flag.StringVar(&f.dockerfile,
+		"f", "",
+		"Name of the Dockerfile (passed to docker build's --file).")
+	flag.StringVar(&f.target,
+		"target", "",
+		"Build stage to build (passed to docker build's --target).")
+	flag.Var(&f.buildArgs,
+		"build-arg",
+		"Set a build-time variable, of the form <name>=<value> (passed to\n"+
+			"docker build's --build-arg). May be specified more than once.")
+	flag.Var(&f.secrets,
+		"secret",
+		"Secret to expose to the build (passed to docker build's --secret).\n"+
+			"May be specified more than once.")
+	flag.Var(&f.ssh,
+		"ssh",
+		"SSH agent socket or keys to expose to the build (passed to docker\n"+
+			"build's --ssh). May be specified more than once.")
+	flag.Var(&f.labels,
+		"label",
+		"Set metadata for the image, of the form <name>=<value> (passed to\n"+
+			"docker build's --label). May be specified more than once.")
+	flag.BoolVar(&f.noCache,
+		"no-cache", false,
+		"Do not use the cache when building the image.")
+	flag.BoolVar(&f.pull,
+		"pull", false,
+		"Always attempt to pull newer versions of base images.")
+	flag.Var(&f.variants,
+		"variant",
+		"Build a variant of the app, of the form <name>[,<key>=<value>...].\n"+
+			"Valid keys are target, pkg-def, appkey, out and profile, which\n"+
+			"override the flags of the same name for this variant. May be\n"+
+			"specified more than once, in which case each variant is built in\n"+
+			"turn, sharing docker's build cache. Variants must not share an\n"+
+			"output file; by default, the variant's name is part of it.")
+	flag.StringVar(&f.all,
+		"all", "",
+		"Build every app under the given directory, i.e. each directory\n"+
+			"containing both a Dockerfile and a sandstorm-pkgdef.capnp (or\n"+
+			".yaml, .yml or .json).\n"+
+			"The spks are written to the apps' directories.")
+	flag.IntVar(&f.jobs,
+		"jobs", 2,
+		"Maximum number of apps to build at once with -all.")
+	flag.BoolVar(&f.watch,
+		"watch", false,
+		"After building, watch the build context, Dockerfile and package\n"+
+			"definition for changes, and rebuild when they change.")
+}
+
+func (f *buildCmdFlags) Parse() {
+	f.buildFlags.Parse()
+	if f.watch && (f.all != "" || len(f.variants) != 0) {
+		usageErr("-watch may not be combined with -all or -variant.")
+	}
+	if f.all != "" {
+		switch {
+		case flag.NArg() != 0:
+			usageErr("A build context directory may not be specified with -all.")
+		case f.outFilename != "":
+			usageErr("-out may not be specified with -all.")
+		case len(f.variants) != 0:
+			usageErr("-variant may not be specified with -all.")
+		case f.jobs < 1:
+			usageErr("-jobs must be at least 1.")
+		}
+		return
+	}
+	switch flag.NArg() {
+	case 0:
+		f.contextDir = "."
+	case 1:
+		f.contextDir = flag.Arg(0)
+	default:
+		usageErr("Too many arguments; expected at most one build context directory.")
+	}
+	f.resolvePkgDefFile()
+}
+
+// The package definition lives alongside the Dockerfile, so look for it
+// in the build context, rather than the working directory.
+func (f *buildCmdFlags) resolvePkgDefFile() {
+	if !filepath.IsAbs(f.pkgDefFile) {
+		f.pkgDefFile = filepath.Join(f.contextDir, f.pkgDefFile)
+	}
+}
+
+// Return the arguments to pass to docker build, other than --iidfile.
+func (f *buildCmdFlags) dockerArgs() []string {
+	args := []string{}
+	if f.quiet {
+		args = append(args, "-q")
+	}
+	if f.dockerfile != "" {
+		args = append(args, "--file", f.dockerfile)
+	}
+	if f.target != "" {
+		args = append(args, "--target", f.target)
+	}
+	for _, v := range f.buildArgs {
+		args = append(args, "--build-arg", v)
+	}
+	for _, v := range f.secrets {
+		args = append(args, "--secret", v)
+	}
+	for _, v := range f.ssh {
+		args = append(args, "--ssh", v)
+	}
+	for _, v := range f.labels {
+		args = append(args, "--label", v)
+	}
+	if f.noCache {
+		args = append(args, "--no-cache")
+	}
+	if f.pull {
+		args = append(args, "--pull")
+	}
+	return append(args, f.contextDir)
+}
+
+// Run docker build, and return the id of the resulting image. The output
+// of docker build is written to stdout and stderr.
+func dockerBuild(bFlags *buildCmdFlags, stdout, stderr io.Writer) (string, error) {
+	// Rather than trying to pick the image id out of docker build's
+	// output, which varies between versions and builders, we ask docker
+	// to write it to a file:
+	iidFile, err := ioutil.TempFile("", "docker-spk-iid")
+	if err != nil {
+		return "", err
+	}
+	iidPath := iidFile.Name()
+	iidFile.Close()
+	defer os.Remove(iidPath)
+
+	args := append([]string{"build", "--iidfile", iidPath}, bFlags.dockerArgs()...)
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = stderr
+	if bFlags.quiet {
+		// With -q, the only thing docker build prints to stdout is
+		// the image id, which we get from the iidfile anyway.
+		cmd.Stdout = ioutil.Discard
+	} else {
+		cmd.Stdout = stdout
+	}
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(iidPath)
+	if err != nil {
+		return "", err
+	}
+	image := strings.TrimSpace(string(data))
 	if image == "" {
-		fmt.Fprintln(os.Stderr,
-			"Could not determine image id built by docker build.")
-		os.Exit(1)
+		return "", errors.New("docker build did not report an image id")
 	}
+	return image, nil
+}
 
-	doPack(&packFlags{
-		buildFlags: *bFlags,
+// Build the docker image specified by bFlags, and pack it into an spk.
+// The output of docker build is written to stdout and stderr, and any
+// warnings to `warnings`.
+func buildAndPack(bFlags *buildCmdFlags, stdout, stderr, warnings io.Writer) (*packResult, error) {
+	image, err := dockerBuild(bFlags, stdout, stderr)
+	if err != nil {
+		return nil, wrapErr("Problem invoking docker build", err)
+	}
+	return doPack(&packFlags{
+		buildFlags: bFlags.buildFlags,
 		image:      image,
+		warnings:   warnings,
 	})
 }
+
+func buildCmd() {
+	bFlags := &buildCmdFlags{}
+	bFlags.Register()
+	bFlags.Parse()
+
+	if bFlags.all != "" {
+		buildAll(bFlags)
+		return
+	}
+	if bFlags.watch {
+		watchAndBuild(bFlags)
+		return
+	}
+	if len(bFlags.variants) == 0 {
+		res, err := buildAndPack(bFlags, os.Stdout, os.Stderr, os.Stderr)
+		chkfatal("Building the app", err)
+		res.report()
+		return
+	}
+	variantFlags, err := bFlags.variants.resolve(bFlags)
+	chkfatal("Checking the variants", err)
+	outFiles := make([]string, len(bFlags.variants))
+	for i, v := range bFlags.variants {
+		fmt.Fprintf(os.Stderr, "Building variant %q\n", v.name)
+		res, err := buildAndPack(variantFlags[i], os.Stdout, os.Stderr, os.Stderr)
+		chkfatal("Building variant "+v.name, err)
+		res.report()
+		outFiles[i] = res.outFilename
+	}
+	for i, v := range bFlags.variants {
+		fmt.Printf("%s: %s\n", v.name, outFiles[i])
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// The outcome of building one of the apps found by build -all.
+type buildAllResult struct {
+	dir string
+	res *packResult
+	err error
+
+	// The output of docker build, and the warnings from packing the
+	// app, which are shown after all of the builds are done.
+	log, warnings bytes.Buffer
+}
+
+// Return the directories under root which contain an app, i.e. both a
+// Dockerfile and a package definition (sandstorm-pkgdef.capnp, or one
+// of its JSON or YAML equivalents). Hidden directories (such as
+// .git) are skipped.
+func findApps(root string) ([]string, error) {
+	dirs := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if path != root && len(name) > 1 && name[0] == '.' {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "Dockerfile")); err != nil || !hasPkgDef(path) {
+			return nil
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	sort.Strings(dirs)
+	return dirs, err
+}
+
+// Build each app found under bFlags.all, and print a summary of the results.
+func buildAll(bFlags *buildCmdFlags) {
+	dirs, err := findApps(bFlags.all)
+	chkfatal("Searching for apps", err)
+	if len(dirs) == 0 {
+		fmt.Fprintf(os.Stderr, "No apps found under %s.\n", bFlags.all)
+		os.Exit(1)
+	}
+
+	results := make([]*buildAllResult, len(dirs))
+	sem := make(chan struct{}, bFlags.jobs)
+	wg := &sync.WaitGroup{}
+	for i, dir := range dirs {
+		result := &buildAllResult{dir: dir}
+		results[i] = result
+
+		appFlags := *bFlags
+		appFlags.contextDir = dir
+		appFlags.outDir = dir
+		appFlags.resolvePkgDefFile()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fmt.Fprintf(os.Stderr, "Building %s\n", result.dir)
+			result.res, result.err = buildAndPack(&appFlags, &result.log, &result.log, &result.warnings)
+		}()
+	}
+	wg.Wait()
+
+	failed := false
+	for _, result := range results {
+		if result.err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "\n==> Output from building %s:\n", result.dir)
+			os.Stderr.Write(result.log.Bytes())
+		}
+		if result.warnings.Len() != 0 {
+			fmt.Fprintf(os.Stderr, "\n==> Warnings from building %s:\n", result.dir)
+			os.Stderr.Write(result.warnings.Bytes())
+		}
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTORY\tAPP\tVERSION\tOUTPUT\tSTATUS")
+	for _, result := range results {
+		app, version, output, status := "-", "-", "-", "built"
+		if result.err != nil {
+			status = "FAILED: " + result.err.Error()
+		} else {
+			app = result.res.metadata.name
+			version = result.res.metadata.version
+			output = result.res.outFilename
+			if result.res.upToDate {
+				status = "up to date"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.dir, app, version, output, status)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// A record of the inputs that went into an spk. If none of these change
+// between runs, packing again would just produce the same package, so
+// we can skip it. This is saved as JSON next to the output file; see
+// buildStatePath.
+type buildState struct {
+	// The id of the docker image the archive was built from.
+	ImageId string
+
+	// Hash of the evaluated package definition, i.e. the contents of
+	// sandstorm-manifest and sandstorm-http-bridge-config.
+	PkgDef string
+
+	// Hash of the sandstorm schema the package definition was
+	// evaluated against; see schemaHash.
+	Schema string
+
+	// The app id of the key the package was signed with.
+	AppKey string
+
+	// Whether the commands inherited settings from the image's config.
+	InheritImageConfig bool
+}
+
+// Return the path of the file in which we store the build state for the
+// spk at outFilename.
+func buildStatePath(outFilename string) string {
+	return outFilename + ".build-state"
+}
+
+// Return the hex-encoded sha256 hash of the concatenation of the arguments.
+// Each argument is prefixed with its length, so that the boundaries between
+// them are unambiguous.
+func hashParts(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		var lenBuf [8]byte
+		binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(p)))
+		h.Write(lenBuf[:])
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return a hash identifying the version of the sandstorm schema, i.e.
+// the schema nodes registered by the Go bindings, which sandstormSchema
+// loads.
+func schemaHash() (string, error) {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return "", err
+	}
+	return idx.hash, nil
+}
+
+// Return the id of the image named `image` in the running docker daemon.
+func dockerImageId(image string) (string, error) {
+	out, err := exec.Command(
+		"docker", "image", "inspect", "--format", "{{.Id}}", image,
+	).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// Return an id for the image stored in the file `filename` (as output by
+// "docker save"). This is the sha256 hash of the file's contents.
+func imageFileId(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Load the build state saved for the spk at outFilename. If there is no
+// saved state, or the spk itself is missing, returns nil.
+func loadBuildState(outFilename string) *buildState {
+	if _, err := os.Stat(outFilename); err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(buildStatePath(outFilename))
+	if err != nil {
+		return nil
+	}
+	ret := &buildState{}
+	if json.Unmarshal(data, ret) != nil {
+		return nil
+	}
+	return ret
+}
+
+// Remove the build state saved for the spk at outFilename, if any.
+func removeBuildState(outFilename string) error {
+	err := os.Remove(buildStatePath(outFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Save the build state for the spk at outFilename.
+func (s *buildState) save(outFilename string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(buildStatePath(outFilename), append(data, '\n'), 0644)
+}
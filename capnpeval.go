@@ -0,0 +1,848 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// Prefix of imports which refer to Sandstorm's own schema files, e.g.
+// import "/sandstorm/package.capnp". These are resolved against the
+// schema compiled into our Go bindings, rather than the file system.
+const sandstormImportPrefix = "/sandstorm/"
+
+// A capnpEvaluator evaluates constants defined in schema files, such as
+// the package definition in sandstorm-pkgdef.capnp. See capnpparse.go for
+// the supported subset of the language.
+type capnpEvaluator struct {
+	// Function used to read schema files and embedded files.
+	readFile func(path string) ([]byte, error)
+
+	// Whether imports and embeds may use absolute paths, which are
+	// passed to readFile as is. This is only allowed when reading from
+	// a docker image, where the paths can't refer to the host.
+	allowAbsolute bool
+
+	// Directories searched for other absolute paths, in order, as with
+	// capnp's -I flag. See setImportPath.
+	importPath []string
+
+	schema *schemaIndex
+
+	// Files we have parsed so far, by path.
+	files map[string]*capnpFile
+
+	// Declarations we are in the middle of resolving, used to detect
+	// cycles.
+	active map[*capnpDecl]bool
+}
+
+// What a name refers to. Exactly one of the groups of fields is set.
+type capnpSymbol struct {
+	// A file we have parsed, or a declaration in one.
+	file *capnpFile
+	decl *capnpDecl
+
+	// One of Sandstorm's schema files, or a node within it: the base
+	// name of the file, and the node's qualified name within it ("" for
+	// the file itself).
+	schemaFile, schemaName string
+
+	// A built in type.
+	builtin *capnpType
+}
+
+// Return an evaluator which reads files from the local file system.
+func newCapnpEvaluator() (*capnpEvaluator, error) {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return nil, err
+	}
+	return &capnpEvaluator{
+		readFile: ioutil.ReadFile,
+		schema:   idx,
+		files:    map[string]*capnpFile{},
+		active:   map[*capnpDecl]bool{},
+	}, nil
+}
+
+// Read the package definition from the constant `name` in the schema
+// file `filename`. If filename is a JSON or YAML file, name is ignored;
+// see pkgdefdata.go.
+func readPackageDefinition(filename, name string) (capnp_spk.PackageDefinition, error) {
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return capnp_spk.PackageDefinition{}, err
+	}
+	s, err := e.evalPackageDefinition(findPkgDefFile(filename), name)
+	return capnp_spk.PackageDefinition{Struct: s}, err
+}
+
+// Evaluate the package definition in `filename`, as described for
+// readPackageDefinition.
+func (e *capnpEvaluator) evalPackageDefinition(filename, name string) (capnp.Struct, error) {
+	if err := e.setImportPath(filename); err != nil {
+		return capnp.Struct{}, err
+	}
+	if pkgDefFormat(filename) != "capnp" {
+		return e.evalDataFile(filename, capnp_spk.PackageDefinition_TypeID)
+	}
+	return e.evalRootStruct(filename, name, capnp_spk.PackageDefinition_TypeID)
+}
+
+// Evaluate the constant `name` in the schema file `filename`, which must
+// be a struct of type `typeId`. The result is stored as the root of a new
+// message.
+func (e *capnpEvaluator) evalRootStruct(filename, name string, typeId uint64) (capnp.Struct, error) {
+	file, err := e.loadFile(filename)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	decl, ok := file.decls[name]
+	if !ok || decl.kind != declConst {
+		return capnp.Struct{}, errorAt(srcPos{filename: filename, line: 1, col: 1},
+			"no constant named %q", name)
+	}
+	typ, err := e.resolveType(file, decl.typ)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	want := &capnpType{which: schema.Type_Which_structType, id: typeId}
+	if !typ.equal(want) {
+		return capnp.Struct{}, errorAt(decl.pos, "%s has type %s, but should be %s",
+			name, e.schema.typeName(typ), e.schema.typeName(want))
+	}
+	return e.evalRootValue(decl.value, file, typeId)
+}
+
+// Evaluate `v`, which appears in `file`, as a struct of type `typeId`.
+// The result is stored as the root of a new message.
+func (e *capnpEvaluator) evalRootValue(v *valueExpr, file *capnpFile, typeId uint64) (capnp.Struct, error) {
+	info, err := e.schema.structInfo(typeId)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	root, err := capnp.NewRootStruct(seg, info.size)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	if err := e.fillStruct(root, info, v, file); err != nil {
+		return capnp.Struct{}, err
+	}
+	return root, msg.SetRoot(root.ToPtr())
+}
+
+// Load and parse the schema file at `path`, if we have not already done
+// so.
+func (e *capnpEvaluator) loadFile(path string) (*capnpFile, error) {
+	path = filepath.Clean(path)
+	if file, ok := e.files[path]; ok {
+		return file, nil
+	}
+	data, err := e.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parseCapnp(path, string(data))
+	if err != nil {
+		return nil, err
+	}
+	e.files[path] = file
+	return file, nil
+}
+
+// Set the import path for the package definition in `filename`, unless
+// we are reading from a docker image.
+func (e *capnpEvaluator) setImportPath(filename string) error {
+	if e.allowAbsolute {
+		return nil
+	}
+	importPath, err := importPathFor(filepath.Dir(filename))
+	e.importPath = importPath
+	return err
+}
+
+// Resolve the path of a file imported or embedded from `from`. Relative
+// paths are relative to the directory containing `from`; absolute paths
+// are looked up in the import path.
+func (e *capnpEvaluator) resolvePath(from *capnpFile, path string, pos srcPos) (string, error) {
+	if strings.HasPrefix(path, "/") {
+		if e.allowAbsolute {
+			return filepath.Clean(path), nil
+		}
+		for _, dir := range e.importPath {
+			resolved := filepath.Join(dir, path)
+			if _, err := os.Stat(resolved); err == nil {
+				return resolved, nil
+			}
+		}
+		if len(e.importPath) == 0 {
+			return "", errorAt(pos, "absolute path %q not found; use -I to add "+
+				"directories to the import path", path)
+		}
+		return "", errorAt(pos, "absolute path %q not found in the import path (%s)",
+			path, strings.Join(e.importPath, ", "))
+	}
+	return filepath.Join(filepath.Dir(from.filename), path), nil
+}
+
+// Resolve an import of `path` from the file `from`.
+func (e *capnpEvaluator) resolveImport(from *capnpFile, path string, pos srcPos) (capnpSymbol, error) {
+	if strings.HasPrefix(path, sandstormImportPrefix) {
+		name := path[len(sandstormImportPrefix):]
+		if _, ok := CapnpFileMap[name]; ok {
+			return capnpSymbol{schemaFile: name}, nil
+		}
+	}
+	resolved, err := e.resolvePath(from, path, pos)
+	if err != nil {
+		return capnpSymbol{}, err
+	}
+	file, err := e.loadFile(resolved)
+	if err != nil {
+		return capnpSymbol{}, errorAt(pos, "importing %q: %v", path, err)
+	}
+	return capnpSymbol{file: file}, nil
+}
+
+// Resolve the name `n`, which appears in `file`.
+func (e *capnpEvaluator) resolveName(file *capnpFile, n *nameExpr) (capnpSymbol, error) {
+	var sym capnpSymbol
+	parts := n.parts
+	switch {
+	case n.importPath != "":
+		var err error
+		if sym, err = e.resolveImport(file, n.importPath, n.pos); err != nil {
+			return sym, err
+		}
+	case n.absolute:
+		sym = capnpSymbol{file: file}
+	default:
+		if decl, ok := file.decls[parts[0]]; ok {
+			sym = capnpSymbol{decl: decl}
+		} else if bt, ok := builtinTypes[parts[0]]; ok && len(parts) == 1 {
+			return capnpSymbol{builtin: bt}, nil
+		} else {
+			return sym, errorAt(n.pos, "unknown name %q", parts[0])
+		}
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		var err error
+		if sym, err = e.member(sym, part, n.pos); err != nil {
+			return sym, err
+		}
+	}
+	return e.followUsing(sym, n.pos)
+}
+
+// If `sym` is a using declaration, return the symbol it refers to.
+// Otherwise, return sym.
+func (e *capnpEvaluator) followUsing(sym capnpSymbol, pos srcPos) (capnpSymbol, error) {
+	if sym.decl == nil || sym.decl.kind != declUsing {
+		return sym, nil
+	}
+	decl := sym.decl
+	if e.active[decl] {
+		return sym, errorAt(pos, "cyclic definition of %q", decl.name)
+	}
+	e.active[decl] = true
+	defer delete(e.active, decl)
+	return e.resolveName(decl.file, decl.typ)
+}
+
+// Return the symbol for the member named `name` of `sym`.
+func (e *capnpEvaluator) member(sym capnpSymbol, name string, pos srcPos) (capnpSymbol, error) {
+	sym, err := e.followUsing(sym, pos)
+	if err != nil {
+		return sym, err
+	}
+	switch {
+	case sym.file != nil:
+		decl, ok := sym.file.decls[name]
+		if !ok {
+			return sym, errorAt(pos, "%s has no declaration named %q", sym.file.filename, name)
+		}
+		return capnpSymbol{decl: decl}, nil
+	case sym.schemaFile != "":
+		qualified := name
+		if sym.schemaName != "" {
+			qualified = sym.schemaName + "." + name
+		}
+		if !e.schema.hasScope(sym.schemaFile, qualified) {
+			return sym, errorAt(pos, "%s has no declaration named %q", sym.schemaFile, qualified)
+		}
+		return capnpSymbol{schemaFile: sym.schemaFile, schemaName: qualified}, nil
+	default:
+		return sym, errorAt(pos, "%q has no members", name)
+	}
+}
+
+// Resolve the type named by `n`, which appears in `file`.
+func (e *capnpEvaluator) resolveType(file *capnpFile, n *nameExpr) (*capnpType, error) {
+	if n.importPath == "" && !n.absolute && len(n.parts) == 1 && n.parts[0] == "List" {
+		if _, shadowed := file.decls["List"]; !shadowed {
+			if len(n.params) != 1 {
+				return nil, errorAt(n.pos, "List takes exactly one type parameter")
+			}
+			elem, err := e.resolveType(file, n.params[0])
+			if err != nil {
+				return nil, err
+			}
+			return &capnpType{which: schema.Type_Which_list, elem: elem}, nil
+		}
+	}
+	if len(n.params) != 0 {
+		return nil, errorAt(n.pos, "%s does not take type parameters", n)
+	}
+	sym, err := e.resolveName(file, n)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sym.builtin != nil:
+		return sym.builtin, nil
+	case sym.schemaFile != "":
+		id, ok := e.schema.lookup(sym.schemaFile, sym.schemaName)
+		if ok {
+			if _, ok := e.schema.structs[id]; ok {
+				return &capnpType{which: schema.Type_Which_structType, id: id}, nil
+			}
+			if _, ok := e.schema.enums[id]; ok {
+				return &capnpType{which: schema.Type_Which_enum, id: id}, nil
+			}
+		}
+	}
+	return nil, errorAt(n.pos, "%s is not a type", n)
+}
+
+// If `v` refers to a constant, return that constant's value and the file
+// it appears in, after checking that the constant has type `t`. If that
+// value is itself a reference, it is followed in turn. If v is not a
+// reference, return v and file unchanged.
+//
+// The caller must call e.done() on the returned declarations when it has
+// finished evaluating the value; until then they are considered active,
+// so that cyclic definitions can be detected.
+func (e *capnpEvaluator) deref(t *capnpType, v *valueExpr, file *capnpFile) (*valueExpr, *capnpFile, []*capnpDecl, error) {
+	var decls []*capnpDecl
+	for v.kind == valName && !isKeyword(v.name) {
+		if t.which == schema.Type_Which_enum && !v.name.absolute &&
+			v.name.importPath == "" && len(v.name.parts) == 1 {
+			// An enumerant.
+			break
+		}
+		sym, err := e.resolveName(file, v.name)
+		if err != nil {
+			return nil, nil, decls, err
+		}
+		if sym.decl == nil || sym.decl.kind != declConst {
+			return nil, nil, decls, errorAt(v.pos, "%s is not a constant", v.name)
+		}
+		decl := sym.decl
+		if e.active[decl] {
+			return nil, nil, decls, errorAt(v.pos, "cyclic definition of %q", decl.name)
+		}
+		declType, err := e.resolveType(decl.file, decl.typ)
+		if err != nil {
+			return nil, nil, decls, err
+		}
+		if !declType.equal(t) {
+			return nil, nil, decls, errorAt(v.pos, "%s has type %s, but %s is needed here",
+				v.name, e.schema.typeName(declType), e.schema.typeName(t))
+		}
+		e.active[decl] = true
+		decls = append(decls, decl)
+		v, file = decl.value, decl.file
+	}
+	return v, file, decls, nil
+}
+
+// Mark declarations returned by deref as no longer being evaluated.
+func (e *capnpEvaluator) done(decls []*capnpDecl) {
+	for _, decl := range decls {
+		delete(e.active, decl)
+	}
+}
+
+// Report whether the name is one of the keywords which may be used as a
+// value.
+func isKeyword(n *nameExpr) bool {
+	if n.importPath != "" || n.absolute || len(n.parts) != 1 {
+		return false
+	}
+	switch n.parts[0] {
+	case "void", "true", "false", "inf", "nan":
+		return true
+	}
+	return false
+}
+
+// Fill in the fields of `dst`, which is a struct (or group) described by
+// `info`, from the struct literal `v`.
+func (e *capnpEvaluator) fillStruct(dst capnp.Struct, info *structInfo, v *valueExpr, file *capnpFile) error {
+	t := &capnpType{which: schema.Type_Which_structType, id: info.id}
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return err
+	}
+	if v.kind != valStruct {
+		return errorAt(v.pos, "expected a struct value of type %s", e.schema.typeName(t))
+	}
+	seen := map[string]bool{}
+	unionField := ""
+	for _, fe := range v.fields {
+		field, ok := info.field(fe.name)
+		if !ok {
+			return errorAt(fe.pos, "%s has no field named %q",
+				e.schema.typeName(t), fe.name)
+		}
+		if seen[fe.name] {
+			return errorAt(fe.pos, "field %q is set more than once", fe.name)
+		}
+		seen[fe.name] = true
+		if field.inUnion() {
+			if unionField != "" {
+				return errorAt(fe.pos,
+					"%q and %q are members of the same union; only one may be set",
+					unionField, fe.name)
+			}
+			unionField = fe.name
+			dst.SetUint16(capnp.DataOffset(info.discriminantOffset*2), field.discriminant)
+		}
+		if err := e.setField(dst, field, fe.value, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set the field `field` of `dst` to the value `v`.
+func (e *capnpEvaluator) setField(dst capnp.Struct, field *fieldInfo, v *valueExpr, file *capnpFile) error {
+	if field.group != 0 {
+		info, err := e.schema.structInfo(field.group)
+		if err != nil {
+			return err
+		}
+		return e.fillStruct(dst, info, v, file)
+	}
+	t := field.typ
+	switch t.which {
+	case schema.Type_Which_void:
+		return e.evalVoid(v, file)
+	case schema.Type_Which_text:
+		s, err := e.evalBytes(t, v, file)
+		if err != nil {
+			return err
+		}
+		if field.defaultPtr.IsValid() {
+			// SetText would store "" as a null pointer, which
+			// reads as the default.
+			return dst.SetNewText(uint16(field.offset), string(s))
+		}
+		return dst.SetText(uint16(field.offset), string(s))
+	case schema.Type_Which_data:
+		s, err := e.evalBytes(t, v, file)
+		if err != nil {
+			return err
+		}
+		return dst.SetData(uint16(field.offset), s)
+	case schema.Type_Which_structType:
+		info, err := e.schema.structInfo(t.id)
+		if err != nil {
+			return err
+		}
+		s, err := capnp.NewStruct(dst.Segment(), info.size)
+		if err != nil {
+			return err
+		}
+		if err := e.fillStruct(s, info, v, file); err != nil {
+			return err
+		}
+		return dst.SetPtr(uint16(field.offset), s.ToPtr())
+	case schema.Type_Which_list:
+		l, err := e.evalList(dst.Segment(), t, v, file)
+		if err != nil {
+			return err
+		}
+		return dst.SetPtr(uint16(field.offset), l)
+	case schema.Type_Which_interface, schema.Type_Which_anyPointer:
+		return errorAt(v.pos, "fields of type %s are not supported", e.schema.typeName(t))
+	}
+
+	bits, err := e.evalScalar(t, v, file)
+	if err != nil {
+		return err
+	}
+	// Values in the data section are stored XORed with their defaults:
+	bits ^= field.defaultBits
+	switch t.bitSize() {
+	case 1:
+		dst.SetBit(capnp.BitOffset(field.offset), bits != 0)
+	case 8:
+		dst.SetUint8(capnp.DataOffset(field.offset), uint8(bits))
+	case 16:
+		dst.SetUint16(capnp.DataOffset(field.offset*2), uint16(bits))
+	case 32:
+		dst.SetUint32(capnp.DataOffset(field.offset*4), uint32(bits))
+	case 64:
+		dst.SetUint64(capnp.DataOffset(field.offset*8), bits)
+	}
+	return nil
+}
+
+// Check that `v` is a valid value of type Void.
+func (e *capnpEvaluator) evalVoid(v *valueExpr, file *capnpFile) error {
+	t := builtinTypes["Void"]
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return err
+	}
+	if v.kind != valName || !isKeyword(v.name) || v.name.parts[0] != "void" {
+		return errorAt(v.pos, "expected void")
+	}
+	return nil
+}
+
+// Evaluate a value of type Text or Data.
+func (e *capnpEvaluator) evalBytes(t *capnpType, v *valueExpr, file *capnpFile) ([]byte, error) {
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case v.kind == valString:
+		return []byte(v.text), nil
+	case v.kind == valData && t.which == schema.Type_Which_data:
+		return []byte(v.text), nil
+	case v.kind == valEmbed:
+		path, err := e.resolvePath(file, v.text, v.pos)
+		if err != nil {
+			return nil, err
+		}
+		data, err := e.readFile(path)
+		if err != nil {
+			return nil, errorAt(v.pos, "embedding %q: %v", v.text, err)
+		}
+		return data, nil
+	default:
+		return nil, errorAt(v.pos, "expected a value of type %s", e.schema.typeName(t))
+	}
+}
+
+// Evaluate a value of a type stored in the data section (other than
+// Void), and return its bits, zero-extended to 64 bits.
+func (e *capnpEvaluator) evalScalar(t *capnpType, v *valueExpr, file *capnpFile) (uint64, error) {
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return 0, err
+	}
+	typeName := e.schema.typeName(t)
+	switch {
+	case t.which == schema.Type_Which_bool:
+		if v.kind == valName && isKeyword(v.name) {
+			switch v.name.parts[0] {
+			case "true":
+				return 1, nil
+			case "false":
+				return 0, nil
+			}
+		}
+	case t.which == schema.Type_Which_enum:
+		if v.kind == valName && len(v.name.parts) == 1 && !v.name.absolute {
+			info, err := e.schema.enumInfo(t.id)
+			if err != nil {
+				return 0, err
+			}
+			for i, name := range info.names {
+				if name == v.name.parts[0] {
+					return uint64(i), nil
+				}
+			}
+			return 0, errorAt(v.pos, "%s has no enumerant named %q", typeName, v.name.parts[0])
+		}
+	case t.isFloat():
+		var f float64
+		switch {
+		case v.kind == valNumber:
+			if n, err := parseCapnpUint(v.text); err == nil {
+				f = float64(n)
+			} else if !capnpFloatRegexp.MatchString(v.text) {
+				return 0, errorAt(v.pos, "invalid number %q", v.text)
+			} else if f, err = strconv.ParseFloat(v.text, 64); err != nil {
+				return 0, errorAt(v.pos, "invalid number %q", v.text)
+			}
+		case v.kind == valName && isKeyword(v.name) && v.name.parts[0] == "inf":
+			f = math.Inf(1)
+		case v.kind == valName && isKeyword(v.name) && v.name.parts[0] == "nan":
+			f = math.NaN()
+		default:
+			return 0, errorAt(v.pos, "expected a value of type %s", typeName)
+		}
+		if v.negative {
+			f = -f
+		}
+		if t.which == schema.Type_Which_float32 {
+			return uint64(math.Float32bits(float32(f))), nil
+		}
+		return math.Float64bits(f), nil
+	default:
+		// An integer type.
+		if v.kind != valNumber {
+			break
+		}
+		mag, err := parseCapnpUint(v.text)
+		if err != nil {
+			return 0, errorAt(v.pos, "invalid integer %q", v.text)
+		}
+		size := t.bitSize()
+		if t.isSigned() {
+			limit := uint64(1) << (size - 1)
+			if (!v.negative && mag >= limit) || (v.negative && mag > limit) {
+				return 0, errorAt(v.pos, "%s is out of range for %s", v.text, typeName)
+			}
+			n := int64(mag)
+			if v.negative {
+				n = -n
+			}
+			return uint64(n) & (math.MaxUint64 >> (64 - size)), nil
+		}
+		if v.negative {
+			return 0, errorAt(v.pos, "%s may not be negative", typeName)
+		}
+		if size < 64 && mag >= uint64(1)<<size {
+			return 0, errorAt(v.pos, "%s is out of range for %s", v.text, typeName)
+		}
+		return mag, nil
+	}
+	return 0, errorAt(v.pos, "expected a value of type %s", typeName)
+}
+
+// Matches the decimal floating point literals of the schema language.
+var capnpFloatRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// Parse the integer literal `text`, which may be decimal, hexadecimal
+// (0x...) or octal (0...), as in the schema language. Go's other forms,
+// such as 0b101 or 1_000, are rejected.
+func parseCapnpUint(text string) (uint64, error) {
+	switch {
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		return strconv.ParseUint(text[2:], 16, 64)
+	case len(text) > 1 && text[0] == '0':
+		return strconv.ParseUint(text[1:], 8, 64)
+	default:
+		return strconv.ParseUint(text, 10, 64)
+	}
+}
+
+// Evaluate a value of the list type `t`, allocating it in `seg`.
+func (e *capnpEvaluator) evalList(seg *capnp.Segment, t *capnpType, v *valueExpr, file *capnpFile) (capnp.Ptr, error) {
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return capnp.Ptr{}, err
+	}
+	if v.kind != valList {
+		return capnp.Ptr{}, errorAt(v.pos, "expected a value of type %s", e.schema.typeName(t))
+	}
+	n := int32(len(v.elems))
+	elemType := t.elem
+	switch elemType.which {
+	case schema.Type_Which_structType:
+		info, err := e.schema.structInfo(elemType.id)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		l, err := capnp.NewCompositeList(seg, info.size, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, elem := range v.elems {
+			if err := e.fillStruct(l.Struct(i), info, elem, file); err != nil {
+				return capnp.Ptr{}, err
+			}
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_text:
+		l, err := capnp.NewTextList(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, elem := range v.elems {
+			s, err := e.evalBytes(elemType, elem, file)
+			if err != nil {
+				return capnp.Ptr{}, err
+			}
+			if err := l.Set(i, string(s)); err != nil {
+				return capnp.Ptr{}, err
+			}
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_data:
+		l, err := capnp.NewDataList(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, elem := range v.elems {
+			s, err := e.evalBytes(elemType, elem, file)
+			if err != nil {
+				return capnp.Ptr{}, err
+			}
+			if err := l.Set(i, s); err != nil {
+				return capnp.Ptr{}, err
+			}
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_list:
+		l, err := capnp.NewPointerList(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, elem := range v.elems {
+			p, err := e.evalList(seg, elemType, elem, file)
+			if err != nil {
+				return capnp.Ptr{}, err
+			}
+			if err := l.SetPtr(i, p); err != nil {
+				return capnp.Ptr{}, err
+			}
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_void,
+		schema.Type_Which_interface,
+		schema.Type_Which_anyPointer:
+		return capnp.Ptr{}, errorAt(v.pos, "lists of type %s are not supported",
+			e.schema.typeName(t))
+	}
+
+	bits := make([]uint64, len(v.elems))
+	for i, elem := range v.elems {
+		if bits[i], err = e.evalScalar(elemType, elem, file); err != nil {
+			return capnp.Ptr{}, err
+		}
+	}
+	return newScalarList(seg, elemType, bits)
+}
+
+// Allocate a list of values of the type `t`, which must be stored in the
+// data section, from the bits of its elements.
+func newScalarList(seg *capnp.Segment, t *capnpType, bits []uint64) (capnp.Ptr, error) {
+	n := int32(len(bits))
+	switch t.which {
+	case schema.Type_Which_bool:
+		l, err := capnp.NewBitList(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, b != 0)
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_int8:
+		l, err := capnp.NewInt8List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, int8(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_uint8:
+		l, err := capnp.NewUInt8List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, uint8(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_int16:
+		l, err := capnp.NewInt16List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, int16(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_uint16, schema.Type_Which_enum:
+		l, err := capnp.NewUInt16List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, uint16(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_int32:
+		l, err := capnp.NewInt32List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, int32(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_uint32:
+		l, err := capnp.NewUInt32List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, uint32(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_float32:
+		l, err := capnp.NewFloat32List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, math.Float32frombits(uint32(b)))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_int64:
+		l, err := capnp.NewInt64List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, int64(b))
+		}
+		return l.ToPtr(), nil
+	case schema.Type_Which_uint64:
+		l, err := capnp.NewUInt64List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, b)
+		}
+		return l.ToPtr(), nil
+	default:
+		l, err := capnp.NewFloat64List(seg, n)
+		if err != nil {
+			return capnp.Ptr{}, err
+		}
+		for i, b := range bits {
+			l.Set(i, math.Float64frombits(b))
+		}
+		return l.ToPtr(), nil
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// Ids of the types in testSchema.
+const (
+	testStructId = 0xa000000000000001
+	testInnerId  = 0xa000000000000002
+	testGroupId  = 0xa000000000000003
+	testColorId  = 0xa000000000000004
+)
+
+// Return a schema index with types that exercise the parts of the
+// encoding the Sandstorm schema doesn't, as though they were declared in
+// package.capnp:
+//
+//	struct Test {
+//	  num @0 :Int32 = 7;
+//	  flag @1 :Bool = true;
+//	  color @2 :Color;
+//	  union {
+//	    none @3 :Void;
+//	    text @4 :Text;
+//	    inner @5 :Inner;
+//	  }
+//	  grp :group {
+//	    a @6 :UInt16;
+//	    b @7 :Text;
+//	  }
+//	  names @8 :List(Text);
+//	  colors @9 :List(Color);
+//	  label @10 :Text = "default";
+//	}
+//	struct Inner { n @0 :UInt8; }
+//	enum Color { red @0; green @1; blue @2; }
+func testSchema(t *testing.T) *schemaIndex {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := capnp.NewStruct(seg, capnp.ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := defaults.SetNewText(0, "default"); err != nil {
+		t.Fatal(err)
+	}
+	labelDefault, err := defaults.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noDiscriminant := uint16(schema.Field_noDiscriminant)
+	slot := func(name string, which schema.Type_Which, offset uint32) *fieldInfo {
+		return &fieldInfo{
+			name:         name,
+			discriminant: noDiscriminant,
+			typ:          &capnpType{which: which},
+			offset:       offset,
+		}
+	}
+	num := slot("num", schema.Type_Which_int32, 0)
+	num.defaultBits = 7
+	flag := slot("flag", schema.Type_Which_bool, 32)
+	flag.defaultBits = 1
+	color := slot("color", schema.Type_Which_enum, 3)
+	color.typ.id = testColorId
+	none := slot("none", schema.Type_Which_void, 0)
+	none.discriminant = 0
+	text := slot("text", schema.Type_Which_text, 0)
+	text.discriminant = 1
+	inner := slot("inner", schema.Type_Which_structType, 1)
+	inner.discriminant = 2
+	inner.typ.id = testInnerId
+	names := slot("names", schema.Type_Which_list, 3)
+	names.typ.elem = &capnpType{which: schema.Type_Which_text}
+	colors := slot("colors", schema.Type_Which_list, 4)
+	colors.typ.elem = &capnpType{which: schema.Type_Which_enum, id: testColorId}
+	label := slot("label", schema.Type_Which_text, 5)
+	label.defaultPtr = labelDefault
+
+	return &schemaIndex{
+		structs: map[uint64]*structInfo{
+			testStructId: {
+				id:                 testStructId,
+				size:               capnp.ObjectSize{DataSize: 16, PointerCount: 6},
+				discriminantOffset: 4,
+				fields: []*fieldInfo{
+					num, flag, color, none, text, inner,
+					{name: "grp", discriminant: noDiscriminant, group: testGroupId},
+					names, colors, label,
+				},
+			},
+			testGroupId: {
+				id:   testGroupId,
+				size: capnp.ObjectSize{DataSize: 16, PointerCount: 6},
+				fields: []*fieldInfo{
+					slot("a", schema.Type_Which_uint16, 5),
+					slot("b", schema.Type_Which_text, 2),
+				},
+			},
+			testInnerId: {
+				id:     testInnerId,
+				size:   capnp.ObjectSize{DataSize: 8},
+				fields: []*fieldInfo{slot("n", schema.Type_Which_uint8, 0)},
+			},
+		},
+		enums: map[uint64]*enumInfo{
+			testColorId: {names: []string{"red", "green", "blue"}},
+		},
+		names: map[uint64]string{
+			testStructId: "Test",
+			testInnerId:  "Inner",
+			testGroupId:  "Test.grp",
+			testColorId:  "Color",
+		},
+		byName: map[string]map[string]uint64{
+			"package.capnp": {
+				"Test":     testStructId,
+				"Test.grp": testGroupId,
+				"Inner":    testInnerId,
+				"Color":    testColorId,
+			},
+		},
+	}
+}
+
+// Return an evaluator using testSchema, which reads files from `files`.
+func testEvaluator(t *testing.T, files map[string]string) *capnpEvaluator {
+	return &capnpEvaluator{
+		readFile: func(path string) ([]byte, error) {
+			data, ok := files[path]
+			if !ok {
+				return nil, fmt.Errorf("open %s: %v", path, os.ErrNotExist)
+			}
+			return []byte(data), nil
+		},
+		schema: testSchema(t),
+		files:  map[string]*capnpFile{},
+		active: map[*capnpDecl]bool{},
+	}
+}
+
+// The header of the main file in evaluator tests.
+const testHeader = `@0xbd8cfd59c13fc42f;
+using Spk = import "/sandstorm/package.capnp";
+`
+
+// Evaluate the constant `value` of type Spk.Test in main.capnp, which
+// consists of testHeader followed by `src`.
+func evalTest(t *testing.T, src string, files map[string]string) (capnp.Struct, error) {
+	all := map[string]string{"main.capnp": testHeader + src}
+	for k, v := range files {
+		all[k] = v
+	}
+	return testEvaluator(t, all).evalRootStruct("main.capnp", "value", testStructId)
+}
+
+// Return the text stored in pointer `i` of `s`.
+func ptrText(t *testing.T, s capnp.Struct, i uint16) string {
+	p, err := s.Ptr(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Text()
+}
+
+func TestEvalDataSection(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		num  uint32
+		flag bool
+	}{
+		// Values are stored XORed with their defaults, so unset
+		// fields and fields set to their defaults are all zeros:
+		{`()`, 0, false},
+		{`(num = 7, flag = true)`, 0, false},
+		{`(num = 5)`, 5 ^ 7, false},
+		{`(num = -1)`, 0xffffffff ^ 7, false},
+		{`(num = 0x7fffffff)`, 0x7fffffff ^ 7, false},
+		{`(num = 0X1F)`, 0x1f ^ 7, false},
+		{`(num = 017)`, 017 ^ 7, false},
+		{`(num = 0)`, 0 ^ 7, false},
+		{`(flag = false)`, 0, true},
+	} {
+		s, err := evalTest(t, "const value :Spk.Test = "+c.src+";", nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if num, flag := s.Uint32(0), s.Bit(32); num != c.num || flag != c.flag {
+			t.Errorf("%s: got num bits %#x, flag bit %v; want %#x, %v",
+				c.src, num, flag, c.num, c.flag)
+		}
+	}
+}
+
+func TestEvalStruct(t *testing.T) {
+	src := `const value :Spk.Test = (
+  color = blue,
+  inner = (n = 200),
+  grp = (a = 0xbeef, b = "in a group"),
+  names = ["x", "y"],
+  colors = [green, red],
+);
+`
+	s, err := evalTest(t, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Uint16(6); got != 2 {
+		t.Errorf("color: got %d, want 2", got)
+	}
+	if got := s.Uint16(8); got != 2 {
+		t.Errorf("union discriminant: got %d, want 2 (inner)", got)
+	}
+	p, err := s.Ptr(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Struct().Uint8(0); got != 200 {
+		t.Errorf("inner.n: got %d, want 200", got)
+	}
+	if got := s.Uint16(10); got != 0xbeef {
+		t.Errorf("grp.a: got %#x, want 0xbeef", got)
+	}
+	if got := ptrText(t, s, 2); got != "in a group" {
+		t.Errorf("grp.b: got %q", got)
+	}
+	p, err = s.Ptr(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := capnp.TextList{List: p.List()}
+	if names.Len() != 2 {
+		t.Fatalf("names: got %d elements, want 2", names.Len())
+	}
+	for i, want := range []string{"x", "y"} {
+		if got, _ := names.At(i); got != want {
+			t.Errorf("names[%d]: got %q, want %q", i, got, want)
+		}
+	}
+	p, err = s.Ptr(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colors := capnp.UInt16List{List: p.List()}
+	if colors.Len() != 2 || colors.At(0) != 1 || colors.At(1) != 0 {
+		t.Errorf("colors: got %d elements, want [1 0]", colors.Len())
+	}
+}
+
+func TestEvalUnion(t *testing.T) {
+	for _, c := range []struct {
+		src          string
+		discriminant uint16
+	}{
+		{`()`, 0},
+		{`(none = void)`, 0},
+		{`(text = "hi")`, 1},
+		{`(inner = ())`, 2},
+	} {
+		s, err := evalTest(t, "const value :Spk.Test = "+c.src+";", nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if got := s.Uint16(8); got != c.discriminant {
+			t.Errorf("%s: got discriminant %d, want %d", c.src, got, c.discriminant)
+		}
+	}
+}
+
+func TestEvalPointerDefault(t *testing.T) {
+	// An empty string must not be stored as a null pointer, which would
+	// read as the default:
+	s, err := evalTest(t, `const value :Spk.Test = (label = "");`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := s.Ptr(5); !p.IsValid() || p.Text() != "" {
+		t.Errorf("label: got %q (valid: %v), want a non-null empty string", p.Text(), p.IsValid())
+	}
+	s, err = evalTest(t, `const value :Spk.Test = ();`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HasPtr(5) {
+		t.Errorf("label: set, but it should be left null to read as the default")
+	}
+}
+
+func TestEvalReferences(t *testing.T) {
+	files := map[string]string{
+		"inner.txt": "embedded text",
+		"lib/common.capnp": `@0xbd8cfd59c13fc430;
+using Spk = import "/sandstorm/package.capnp";
+const inner :Spk.Inner = (n = 3);
+const text :Text = embed "../inner.txt";
+`,
+	}
+	grpB := func(s capnp.Struct) string { return ptrText(t, s, 2) }
+	for _, c := range []struct {
+		src  string
+		get  func(s capnp.Struct) string
+		want string
+	}{
+		{
+			`const value :Spk.Test = (grp = (b = embed "inner.txt"));`,
+			grpB, "embedded text",
+		},
+		{
+			`using Lib = import "lib/common.capnp";
+const value :Spk.Test = (grp = (b = Lib.text));`,
+			grpB, "embedded text",
+		},
+		{
+			`using import "lib/common.capnp".inner;
+const value :Spk.Test = (inner = .inner);`,
+			func(s capnp.Struct) string {
+				p, _ := s.Ptr(1)
+				return fmt.Sprint(p.Struct().Uint8(0))
+			},
+			"3",
+		},
+		{
+			`using T = Spk.Test;
+const b :Text = "via a constant";
+const value :T = (grp = (b = .b));`,
+			grpB, "via a constant",
+		},
+		{
+			`using C = import "/sandstorm/package.capnp".Color;
+const c :C = green;
+const value :Spk.Test = (color = .c);`,
+			func(s capnp.Struct) string { return fmt.Sprint(s.Uint16(6)) },
+			"1",
+		},
+	} {
+		s, err := evalTest(t, c.src, files)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+		} else if got := c.get(s); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.src, got, c.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	files := map[string]string{
+		"cycle.capnp": `@0xbd8cfd59c13fc431;
+using import "main.capnp".value;
+`,
+	}
+	for _, c := range []struct {
+		src, err string
+	}{
+		// Line numbers are in main.capnp, which starts with the two
+		// lines of testHeader.
+		{`const value :Spk.Test = (bogus = 1);`,
+			`main.capnp:3:26: Test has no field named "bogus"`},
+		{`const value :Spk.Test = (num = 1, num = 2);`,
+			`main.capnp:3:35: field "num" is set more than once`},
+		{`const value :Spk.Test = (text = "a", inner = ());`,
+			`main.capnp:3:38: "text" and "inner" are members of the same union; only one may be set`},
+		{`const value :Spk.Test = (num = 0x80000000);`,
+			`main.capnp:3:32: 0x80000000 is out of range for Int32`},
+		// Go's number syntax, which the schema language doesn't have:
+		{`const value :Spk.Test = (num = 1_000);`,
+			`main.capnp:3:32: invalid integer "1_000"`},
+		{`const value :Spk.Test = (num = 0b101);`,
+			`main.capnp:3:32: invalid integer "0b101"`},
+		{`const value :Spk.Test = (num = 0o17);`,
+			`main.capnp:3:32: invalid integer "0o17"`},
+		{`const value :Spk.Test = (num = 0x_1f);`,
+			`main.capnp:3:32: invalid integer "0x_1f"`},
+		{`const value :Spk.Test = (num = 09);`,
+			`main.capnp:3:32: invalid integer "09"`},
+		{`const value :Spk.Test = (inner = (n = -1));`,
+			`main.capnp:3:39: UInt8 may not be negative`},
+		{`const value :Spk.Test = (color = purple);`,
+			`main.capnp:3:34: Color has no enumerant named "purple"`},
+		{`const value :Spk.Test = (flag = 1);`,
+			`main.capnp:3:33: expected a value of type Bool`},
+		{`const value :Spk.Test = (grp = (b = embed "missing.txt"));`,
+			`main.capnp:3:37: embedding "missing.txt": open missing.txt: file does not exist`},
+		{`const value :Spk.Test = (grp = (b = embed "/etc/passwd"));`,
+			`main.capnp:3:37: absolute path "/etc/passwd" not found; use -I to add directories to the import path`},
+		{`const value :Spk.Nope = ();`,
+			`main.capnp:3:14: package.capnp has no declaration named "Nope"`},
+		{`const value :Spk.Inner = ();`,
+			`main.capnp:3:1: value has type Inner, but should be Test`},
+		{`const n :Int32 = 1;
+const value :Spk.Test = (grp = (b = .n));`,
+			`main.capnp:4:37: .n has type Int32, but Text is needed here`},
+		{`const value :Spk.Test = (inner = .value);`,
+			`main.capnp:3:34: .value has type Test, but Inner is needed here`},
+
+		// Cycles:
+		{`const a :Spk.Test = .b;
+const b :Spk.Test = .a;
+const value :Spk.Test = .a;`,
+			`main.capnp:4:21: cyclic definition of "a"`},
+		{`const value :Spk.Test = .value;`,
+			`main.capnp:3:25: cyclic definition of "value"`},
+		{`using A = B;
+using B = A;
+const value :A = ();`,
+			`main.capnp:4:11: cyclic definition of "A"`},
+		{`using C = import "cycle.capnp";
+const value :Spk.Test = C.value;`,
+			`main.capnp:4:25: cyclic definition of "value"`},
+	} {
+		_, err := evalTest(t, c.src, files)
+		if err == nil {
+			t.Errorf("%s: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("%s:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
+
+func TestEvalHelloFlask(t *testing.T) {
+	s, err := readPackageDefinition(
+		filepath.Join("examples", "hello-Flask", "sandstorm-pkgdef.capnp"), "pkgdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what, got, want string) {
+		if got != want {
+			t.Errorf("%s: got %q, want %q", what, got, want)
+		}
+	}
+	id, err := s.Id()
+	noErr(t, err)
+	check("id", id, "8anwd8gxasmhav7uu869eamag7rqhxczd86a6fcz5nktuk02mkth")
+
+	manifest, err := s.Manifest()
+	noErr(t, err)
+	title, err := manifest.AppTitle()
+	noErr(t, err)
+	text, err := title.DefaultText()
+	noErr(t, err)
+	check("appTitle", text, "Hello World App With Flask and 'docker-spk'")
+	marketing, err := manifest.AppMarketingVersion()
+	noErr(t, err)
+	text, err = marketing.DefaultText()
+	noErr(t, err)
+	check("appMarketingVersion", text, "0.0.0")
+
+	actions, err := manifest.Actions()
+	noErr(t, err)
+	if actions.Len() != 1 {
+		t.Fatalf("got %d actions, want 1", actions.Len())
+	}
+	action := actions.At(0)
+	if action.Input().Which() != capnp_spk.Manifest_Action_input_Which_none {
+		t.Errorf("action input: got %v, want none", action.Input().Which())
+	}
+	noun, err := action.NounPhrase()
+	noErr(t, err)
+	text, err = noun.DefaultText()
+	noErr(t, err)
+	check("nounPhrase", text, "instance")
+
+	for what, get := range map[string]func() (capnp_spk.Manifest_Command, error){
+		"action command":  action.Command,
+		"continueCommand": manifest.ContinueCommand,
+	} {
+		cmd, err := get()
+		noErr(t, err)
+		argv, err := cmd.Argv()
+		noErr(t, err)
+		args := []string{}
+		for i := 0; i < argv.Len(); i++ {
+			arg, err := argv.At(i)
+			noErr(t, err)
+			args = append(args, arg)
+		}
+		check(what+" argv", strings.Join(args, " "),
+			"/sandstorm-http-bridge 8000 -- /app/.venv/bin/gunicorn hello_flask:app")
+		environ, err := cmd.Environ()
+		noErr(t, err)
+		env := []string{}
+		for i := 0; i < environ.Len(); i++ {
+			key, err := environ.At(i).Key()
+			noErr(t, err)
+			value, err := environ.At(i).Value()
+			noErr(t, err)
+			env = append(env, key+"="+value)
+		}
+		check(what+" environ", strings.Join(env, " "),
+			"PATH=/usr/local/bin:/usr/bin:/bin HOME=/var")
+	}
+
+	metadata, err := manifest.Metadata()
+	noErr(t, err)
+	website, err := metadata.Website()
+	noErr(t, err)
+	check("website", website, "http://example.com")
+	license := metadata.License()
+	if license.Which() != capnp_spk.Metadata_license_Which_openSource ||
+		license.OpenSource() != capnp_spk.OpenSourceLicense_apache2 {
+		t.Errorf("license: got %v %v, want openSource apache2",
+			license.Which(), license.OpenSource())
+	}
+	email, err := metadata.Author().ContactEmail()
+	noErr(t, err)
+	check("contactEmail", email, "youremail@example.com")
+	short, err := metadata.ShortDescription()
+	noErr(t, err)
+	text, err = short.DefaultText()
+	noErr(t, err)
+	check("shortDescription", text, "one-to-three words")
+}
+
+func noErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file contains a lexer for the subset of the Cap'n Proto schema
+// language which is used in package definitions; see capnpparse.go for
+// the parser.
+
+// A position in a source file, for error messages.
+type srcPos struct {
+	filename  string
+	line, col int
+
+	// The byte offset of the position in the file. Only set for schema
+	// files, which the pkgdef command edits in place.
+	offset int
+}
+
+func (p srcPos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.filename, p.line, p.col)
+}
+
+// An error at a particular position in a source file.
+type srcError struct {
+	pos srcPos
+	msg string
+}
+
+func (e *srcError) Error() string {
+	return e.pos.String() + ": " + e.msg
+}
+
+// Return a *srcError at `pos`, with a message formatted as by fmt.Sprintf.
+func errorAt(pos srcPos, format string, args ...interface{}) error {
+	return &srcError{pos: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokIdent            // foo
+	tokNumber           // 12, 0x1f, 1.5e3
+	tokString           // "foo"
+	tokData             // 0x"0a 1b"
+	tokPunct            // ( ) [ ] { } = : ; , . @ $ - and other symbols
+)
+
+type token struct {
+	kind tokenKind
+	pos  srcPos
+
+	// For identifiers, numbers and punctuation, the source text. For
+	// strings and data literals, the decoded value.
+	text string
+
+	// The offset just past the end of the token.
+	end int
+}
+
+// Return a human readable description of the token, for error messages.
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokData:
+		return "data literal"
+	default:
+		return "'" + t.text + "'"
+	}
+}
+
+// Split the contents of a schema file into tokens.
+func lexCapnp(filename, src string) ([]token, error) {
+	l := &lexer{src: src, pos: srcPos{filename: filename, line: 1, col: 1}}
+	toks := []token{}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, tok)
+		if tok.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+type lexer struct {
+	src    string
+	offset int
+	pos    srcPos
+}
+
+// Return the next byte of input, without consuming it. Returns 0 at the
+// end of the input.
+func (l *lexer) peek() byte {
+	if l.offset >= len(l.src) {
+		return 0
+	}
+	return l.src[l.offset]
+}
+
+// Consume a byte of input.
+func (l *lexer) advance() {
+	if l.src[l.offset] == '\n' {
+		l.pos.line++
+		l.pos.col = 1
+	} else {
+		l.pos.col++
+	}
+	l.offset++
+	l.pos.offset++
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func (l *lexer) next() (token, error) {
+	// Skip whitespace and comments:
+	for {
+		c := l.peek()
+		if c == '#' {
+			for l.offset < len(l.src) && l.peek() != '\n' {
+				l.advance()
+			}
+		} else if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			l.advance()
+		} else {
+			break
+		}
+	}
+
+	start := l.offset
+	tok := token{pos: l.pos}
+	c := l.peek()
+	switch {
+	case l.offset >= len(l.src):
+		tok.kind = tokEOF
+	case c == '0' && strings.HasPrefix(l.src[l.offset:], "0x\""):
+		l.advance()
+		l.advance()
+		data, err := l.lexDataLiteral()
+		if err != nil {
+			return tok, err
+		}
+		tok.kind = tokData
+		tok.text = data
+	case isIdentStart(c):
+		for isIdentStart(l.peek()) || isDigit(l.peek()) {
+			l.advance()
+		}
+		tok.kind = tokIdent
+		tok.text = l.src[start:l.offset]
+	case isDigit(c):
+		for {
+			c := l.peek()
+			if isDigit(c) || isIdentStart(c) || c == '.' {
+				l.advance()
+			} else if (c == '-' || c == '+') && strings.ContainsAny(l.src[l.offset-1:l.offset], "eE") &&
+				!strings.HasPrefix(l.src[start:], "0x") {
+				// Exponent sign, e.g. 1e-5
+				l.advance()
+			} else {
+				break
+			}
+		}
+		tok.kind = tokNumber
+		tok.text = l.src[start:l.offset]
+	case c == '"':
+		s, err := l.lexString()
+		if err != nil {
+			return tok, err
+		}
+		tok.kind = tokString
+		tok.text = s
+	case c > ' ' && c < 0x7f:
+		// Punctuation. Besides the symbols the parser uses, we
+		// accept any others here, so that we can skip over
+		// declarations using syntax we don't otherwise support
+		// (e.g. the -> in method declarations).
+		l.advance()
+		tok.kind = tokPunct
+		tok.text = l.src[start:l.offset]
+	default:
+		return tok, errorAt(l.pos, "unexpected character %q", c)
+	}
+	tok.end = l.offset
+	return tok, nil
+}
+
+// Lex a string literal, starting at the opening quote, and return its
+// decoded value.
+func (l *lexer) lexString() (string, error) {
+	start := l.pos
+	l.advance()
+	buf := &strings.Builder{}
+	for {
+		c := l.peek()
+		switch {
+		case l.offset >= len(l.src) || c == '\n':
+			return "", errorAt(start, "unterminated string literal")
+		case c == '"':
+			l.advance()
+			return buf.String(), nil
+		case c == '\\':
+			escPos := l.pos
+			l.advance()
+			if l.offset >= len(l.src) {
+				return "", errorAt(start, "unterminated string literal")
+			}
+			c = l.peek()
+			l.advance()
+			switch c {
+			case 'a':
+				buf.WriteByte('\a')
+			case 'b':
+				buf.WriteByte('\b')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'v':
+				buf.WriteByte('\v')
+			case '\\', '\'', '"', '?':
+				buf.WriteByte(c)
+			case 'x':
+				digits := ""
+				for len(digits) < 2 && strings.IndexByte("0123456789abcdefABCDEF", l.peek()) >= 0 {
+					digits += string(l.peek())
+					l.advance()
+				}
+				if digits == "" {
+					return "", errorAt(escPos, "invalid \\x escape")
+				}
+				v, _ := strconv.ParseUint(digits, 16, 8)
+				buf.WriteByte(byte(v))
+			default:
+				if c < '0' || c > '7' {
+					return "", errorAt(escPos, "invalid escape sequence \\%c", c)
+				}
+				digits := string(c)
+				for len(digits) < 3 && '0' <= l.peek() && l.peek() <= '7' {
+					digits += string(l.peek())
+					l.advance()
+				}
+				v, err := strconv.ParseUint(digits, 8, 8)
+				if err != nil {
+					return "", errorAt(escPos, "invalid octal escape \\%s", digits)
+				}
+				buf.WriteByte(byte(v))
+			}
+		default:
+			buf.WriteByte(c)
+			l.advance()
+		}
+	}
+}
+
+// Lex a data literal of the form 0x"0a 1b ...", starting at the opening
+// quote (the 0x has already been consumed), and return its decoded value.
+func (l *lexer) lexDataLiteral() (string, error) {
+	start := l.pos
+	l.advance()
+	digits := &strings.Builder{}
+	for {
+		c := l.peek()
+		switch {
+		case l.offset >= len(l.src):
+			return "", errorAt(start, "unterminated data literal")
+		case c == '"':
+			l.advance()
+			if digits.Len()%2 != 0 {
+				return "", errorAt(start, "data literal has an odd number of hex digits")
+			}
+			hex := digits.String()
+			data := make([]byte, len(hex)/2)
+			for i := range data {
+				v, _ := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+				data[i] = byte(v)
+			}
+			return string(data), nil
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.advance()
+		case strings.IndexByte("0123456789abcdefABCDEF", c) >= 0:
+			digits.WriteByte(c)
+			l.advance()
+		default:
+			return "", errorAt(l.pos, "invalid character %q in data literal", c)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"strconv"
+)
+
+// This file contains a parser for the subset of the Cap'n Proto schema
+// language which is used in package definitions: imports, `using`
+// declarations and constants, whose values may be struct and list
+// literals, references to other constants and `embed` expressions.
+//
+// Declarations of new types (struct, enum, interface, annotation) are
+// skipped over; their names can't be referred to. Package definitions
+// only ever use the types defined by Sandstorm, which we get from the
+// schema compiled into the Go bindings instead (see capnpschema.go).
+
+// A parsed schema file.
+type capnpFile struct {
+	filename string
+
+	// The contents of the file.
+	src string
+
+	// The file's top-level declarations, by name.
+	decls map[string]*capnpDecl
+}
+
+type declKind int
+
+const (
+	declConst declKind = iota
+	declUsing
+)
+
+// A top-level declaration in a schema file.
+type capnpDecl struct {
+	kind declKind
+	pos  srcPos
+	name string
+
+	// The file in which the declaration appears.
+	file *capnpFile
+
+	// For constants, the type and value. For using declarations, typ is
+	// the name to which the declaration refers, and value is nil.
+	typ   *nameExpr
+	value *valueExpr
+}
+
+// A (possibly qualified) name, such as `Foo`, `.foo`, `Spk.Manifest` or
+// `import "foo.capnp".Bar`, or a parameterized type such as `List(Text)`.
+type nameExpr struct {
+	pos srcPos
+
+	// If non-empty, the name is relative to the file at this path.
+	importPath string
+
+	// If true, the name starts with a '.', meaning it is relative to the
+	// top-level scope of the file it appears in.
+	absolute bool
+
+	parts []string
+
+	// Type parameters, e.g. the Text in List(Text).
+	params []*nameExpr
+}
+
+func (n *nameExpr) String() string {
+	s := ""
+	if n.importPath != "" {
+		s = "import " + strconv.Quote(n.importPath)
+	}
+	for i, part := range n.parts {
+		if i > 0 || n.absolute || n.importPath != "" {
+			s += "."
+		}
+		s += part
+	}
+	if len(n.params) > 0 {
+		s += "("
+		for i, p := range n.params {
+			if i > 0 {
+				s += ", "
+			}
+			s += p.String()
+		}
+		s += ")"
+	}
+	return s
+}
+
+type valueKind int
+
+const (
+	valNumber valueKind = iota // 12, -1.5
+	valString                  // "foo"
+	valData                    // 0x"0a 1b"
+	valEmbed                   // embed "file"
+	valStruct                  // (a = 1, b = 2)
+	valList                    // [1, 2, 3]
+	valName                    // foo, .foo, Foo.bar, true, void, ...
+)
+
+// A value expression.
+type valueExpr struct {
+	kind valueKind
+	pos  srcPos
+
+	// For numbers, the literal text, without the sign. For strings and
+	// data, the decoded value. For embeds, the path of the embedded file.
+	text string
+
+	// For numbers (and the names inf and nan), whether the value is
+	// negated.
+	negative bool
+
+	// For structs:
+	fields []*fieldExpr
+
+	// For lists:
+	elems []*valueExpr
+
+	// For names:
+	name *nameExpr
+
+	// The offset just past the end of the value in the source.
+	end int
+}
+
+// A field assignment in a struct literal.
+type fieldExpr struct {
+	pos   srcPos
+	name  string
+	value *valueExpr
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+// Parse a schema file.
+func parseCapnp(filename, src string) (*capnpFile, error) {
+	toks, err := lexCapnp(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	file := &capnpFile{
+		filename: filename,
+		src:      src,
+		decls:    map[string]*capnpDecl{},
+	}
+	for p.peek().kind != tokEOF {
+		decl, err := p.parseDecl()
+		if err != nil {
+			return nil, err
+		}
+		if decl == nil {
+			continue
+		}
+		if old, ok := file.decls[decl.name]; ok {
+			return nil, errorAt(decl.pos, "%q is already declared at %v", decl.name, old.pos)
+		}
+		decl.file = file
+		file.decls[decl.name] = decl
+	}
+	return file, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+// Report whether the next token is the punctuation or keyword `text`.
+func (p *parser) at(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokPunct || tok.kind == tokIdent) && tok.text == text
+}
+
+// Consume the punctuation or keyword `text`, or return an error if the
+// next token is something else.
+func (p *parser) expect(text string) error {
+	if !p.at(text) {
+		tok := p.peek()
+		return errorAt(tok.pos, "expected '%s', but got %v", text, tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectIdent() (token, error) {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return tok, errorAt(tok.pos, "expected identifier, but got %v", tok)
+	}
+	return tok, nil
+}
+
+func (p *parser) expectString() (token, error) {
+	tok := p.next()
+	if tok.kind != tokString {
+		return tok, errorAt(tok.pos, "expected string literal, but got %v", tok)
+	}
+	return tok, nil
+}
+
+// Parse a top-level declaration. Returns nil (and no error) for things
+// we skip, like the file id and type declarations.
+func (p *parser) parseDecl() (*capnpDecl, error) {
+	tok := p.peek()
+	switch {
+	case p.at("@"):
+		// The file's id.
+		p.next()
+		if num := p.next(); num.kind != tokNumber {
+			return nil, errorAt(num.pos, "expected file id, but got %v", num)
+		}
+		return nil, p.expect(";")
+	case p.at("$"):
+		// An annotation on the file.
+		return nil, p.skipDecl()
+	case p.at("using"):
+		return p.parseUsing()
+	case p.at("const"):
+		return p.parseConst()
+	case p.at("struct"), p.at("enum"), p.at("interface"), p.at("annotation"):
+		return nil, p.skipDecl()
+	default:
+		return nil, errorAt(tok.pos, "unexpected %v at top level", tok)
+	}
+}
+
+// Skip to the end of the current declaration: the next ';' which is not
+// nested inside brackets, or the '}' which closes a block.
+func (p *parser) skipDecl() error {
+	depth := 0
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == tokEOF:
+			return errorAt(tok.pos, "unexpected end of file")
+		case tok.kind != tokPunct:
+		case tok.text == "(" || tok.text == "[" || tok.text == "{":
+			depth++
+		case tok.text == ")" || tok.text == "]":
+			depth--
+		case tok.text == "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		case tok.text == ";" && depth == 0:
+			return nil
+		}
+	}
+}
+
+// using Name = <name>;
+// using <name>;
+func (p *parser) parseUsing() (*capnpDecl, error) {
+	decl := &capnpDecl{kind: declUsing, pos: p.next().pos}
+	if p.peek().kind == tokIdent && p.toks[p.i+1].kind == tokPunct && p.toks[p.i+1].text == "=" {
+		decl.name = p.next().text
+		p.next()
+	}
+	target, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	if decl.name == "" {
+		// using import "foo.capnp".Bar; binds Bar.
+		if len(target.parts) == 0 {
+			return nil, errorAt(decl.pos, "using declaration needs a name")
+		}
+		decl.name = target.parts[len(target.parts)-1]
+	}
+	decl.typ = target
+	return decl, p.expect(";")
+}
+
+// const name :Type = value;
+func (p *parser) parseConst() (*capnpDecl, error) {
+	decl := &capnpDecl{kind: declConst, pos: p.next().pos}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	decl.name = name.text
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	if decl.typ, err = p.parseName(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	if decl.value, err = p.parseValue(); err != nil {
+		return nil, err
+	}
+	if p.at("$") {
+		// Annotations on the constant; these don't affect its value.
+		return decl, p.skipDecl()
+	}
+	return decl, p.expect(";")
+}
+
+// Parse a name; see nameExpr.
+func (p *parser) parseName() (*nameExpr, error) {
+	n := &nameExpr{pos: p.peek().pos}
+	if p.at("import") {
+		p.next()
+		path, err := p.expectString()
+		if err != nil {
+			return nil, err
+		}
+		n.importPath = path.text
+		if !p.at(".") {
+			return n, nil
+		}
+		p.next()
+	} else if p.at(".") {
+		p.next()
+		n.absolute = true
+	}
+	for {
+		part, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		n.parts = append(n.parts, part.text)
+		if !p.at(".") {
+			break
+		}
+		p.next()
+	}
+	if p.at("(") {
+		p.next()
+		for !p.at(")") {
+			param, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			n.params = append(n.params, param)
+			if !p.at(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) parseValue() (*valueExpr, error) {
+	tok := p.peek()
+	v := &valueExpr{pos: tok.pos}
+	switch {
+	case p.at("-"):
+		p.next()
+		inner, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if inner.kind != valNumber && !(inner.kind == valName && isFloatKeyword(inner.name)) {
+			return nil, errorAt(tok.pos, "'-' must be followed by a number")
+		}
+		inner.pos = tok.pos
+		inner.negative = !inner.negative
+		return inner, nil
+	case tok.kind == tokNumber:
+		p.next()
+		v.kind = valNumber
+		v.text = tok.text
+	case tok.kind == tokString:
+		p.next()
+		v.kind = valString
+		v.text = tok.text
+	case tok.kind == tokData:
+		p.next()
+		v.kind = valData
+		v.text = tok.text
+	case p.at("embed"):
+		p.next()
+		path, err := p.expectString()
+		if err != nil {
+			return nil, err
+		}
+		v.kind = valEmbed
+		v.text = path.text
+	case p.at("("):
+		p.next()
+		v.kind = valStruct
+		for !p.at(")") {
+			name, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			v.fields = append(v.fields, &fieldExpr{
+				pos:   name.pos,
+				name:  name.text,
+				value: value,
+			})
+			if !p.at(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	case p.at("["):
+		p.next()
+		v.kind = valList
+		for !p.at("]") {
+			elem, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			v.elems = append(v.elems, elem)
+			if !p.at(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	case tok.kind == tokIdent || p.at(".") || p.at("import"):
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		v.kind = valName
+		v.name = name
+	default:
+		return nil, errorAt(tok.pos, "expected a value, but got %v", tok)
+	}
+	v.end = p.toks[p.i-1].end
+	return v, nil
+}
+
+// Report whether the name is one of the keywords for special floating
+// point values, which may be negated.
+func isFloatKeyword(n *nameExpr) bool {
+	return n.importPath == "" && !n.absolute && len(n.parts) == 1 &&
+		(n.parts[0] == "inf" || n.parts[0] == "nan")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCapnp(t *testing.T) {
+	src := `@0xbd8cfd59c13fc42f;
+
+using Spk = import "/sandstorm/package.capnp";
+using import "other.capnp".Shared;
+
+struct Ignored {
+  foo @0 :Text;
+  nested :group { bar @1 :UInt32; }
+}
+
+const name :Text = "a \"quoted\"\tname\x21\101"; # A comment.
+const data :Data = 0x"0a 1B
+  ff";
+const neg :Int32 = -12;
+const negInf :Float64 = -inf;
+const list :List(Text) = ["a", "b",];
+const ref :Spk.Manifest.Command = .other $Foo.annotation("x");
+const embedded :Text = embed "file.txt";
+const value :Spk.PackageDefinition = (
+  id = "x",
+  manifest = (appVersion = 0x10, actions = []),
+);
+`
+	file, err := parseCapnp("test.capnp", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		kind declKind
+		typ  string
+	}{
+		{"Spk", declUsing, `import "/sandstorm/package.capnp"`},
+		{"Shared", declUsing, `import "other.capnp".Shared`},
+		{"name", declConst, "Text"},
+		{"data", declConst, "Data"},
+		{"neg", declConst, "Int32"},
+		{"negInf", declConst, "Float64"},
+		{"list", declConst, "List(Text)"},
+		{"ref", declConst, "Spk.Manifest.Command"},
+		{"embedded", declConst, "Text"},
+		{"value", declConst, "Spk.PackageDefinition"},
+	} {
+		decl, ok := file.decls[c.name]
+		if !ok {
+			t.Errorf("no declaration named %q", c.name)
+			continue
+		}
+		if decl.kind != c.kind || decl.typ.String() != c.typ {
+			t.Errorf("%s: got kind %v, type %s; want kind %v, type %s",
+				c.name, decl.kind, decl.typ, c.kind, c.typ)
+		}
+	}
+	if len(file.decls) != 10 {
+		t.Errorf("got %d declarations, want 10 (type declarations should be skipped)", len(file.decls))
+	}
+
+	if v := file.decls["name"].value; v.kind != valString || v.text != "a \"quoted\"\tname!A" {
+		t.Errorf("name: got %q", v.text)
+	}
+	if v := file.decls["data"].value; v.kind != valData || v.text != "\x0a\x1b\xff" {
+		t.Errorf("data: got %q", v.text)
+	}
+	if v := file.decls["neg"].value; v.kind != valNumber || v.text != "12" || !v.negative {
+		t.Errorf("neg: got %+v", v)
+	}
+	if v := file.decls["negInf"].value; v.kind != valName || !isFloatKeyword(v.name) || !v.negative {
+		t.Errorf("negInf: got %+v", v)
+	}
+	if v := file.decls["list"].value; v.kind != valList || len(v.elems) != 2 {
+		t.Errorf("list: got %+v", v)
+	}
+	if v := file.decls["ref"].value; v.kind != valName || !v.name.absolute || v.name.String() != ".other" {
+		t.Errorf("ref: got %+v", v)
+	}
+	if v := file.decls["embedded"].value; v.kind != valEmbed || v.text != "file.txt" {
+		t.Errorf("embedded: got %+v", v)
+	}
+
+	v := file.decls["value"].value
+	if v.kind != valStruct || len(v.fields) != 2 || v.fields[1].name != "manifest" {
+		t.Fatalf("value: got %+v", v)
+	}
+	manifest := v.fields[1].value
+	if manifest.kind != valStruct || len(manifest.fields) != 2 ||
+		manifest.fields[0].value.text != "0x10" || manifest.fields[1].value.kind != valList {
+		t.Errorf("value.manifest: got %+v", manifest)
+	}
+	// Positions and offsets, which pkgdef set relies on:
+	if pos := manifest.fields[0].pos; pos.line != 21 || pos.col != 15 {
+		t.Errorf("appVersion is at %v, want line 21, column 15", pos)
+	}
+	if got := src[manifest.pos.offset:manifest.end]; got != "(appVersion = 0x10, actions = [])" {
+		t.Errorf("value.manifest spans %q", got)
+	}
+}
+
+func TestParseCapnpErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		// Lexer errors:
+		{"const a :Text = \"abc;\n", `test.capnp:1:17: unterminated string literal`},
+		{"const a :Text = \"abc\\", `test.capnp:1:17: unterminated string literal`},
+		{"const a :Text = \"a\\qb\";", `test.capnp:1:19: invalid escape sequence \q`},
+		{"const a :Text = \"\\x\";", `test.capnp:1:18: invalid \x escape`},
+		{"const a :Data = 0x\"0g\";", `test.capnp:1:21: invalid character 'g' in data literal`},
+		{"const a :Data = 0x\"abc\";", `test.capnp:1:19: data literal has an odd number of hex digits`},
+		{"const a :Data = 0x\"ab", `test.capnp:1:19: unterminated data literal`},
+		{"\n\n  \x01", `test.capnp:3:3: unexpected character '\x01'`},
+
+		// Parser errors:
+		{"foo", `test.capnp:1:1: unexpected 'foo' at top level`},
+		{"@;", `test.capnp:1:2: expected file id, but got ';'`},
+		{"const a Text = 1;", `test.capnp:1:9: expected ':', but got 'Text'`},
+		{"const 1 :Text = 1;", `test.capnp:1:7: expected identifier, but got '1'`},
+		{"const a :Text = ;", `test.capnp:1:17: expected a value, but got ';'`},
+		{"const a :Text = \"x\"", `test.capnp:1:20: expected ';', but got end of file`},
+		{"const a :Int32 = -\"x\";", `test.capnp:1:18: '-' must be followed by a number`},
+		{"const a :Foo = (b = 1 c = 2);", `test.capnp:1:23: expected ')', but got 'c'`},
+		{"const a :Foo = (b 1);", `test.capnp:1:19: expected '=', but got '1'`},
+		{"const a :Foo = [1, 2;", `test.capnp:1:21: expected ']', but got ';'`},
+		{"using import \"foo.capnp\";", `test.capnp:1:1: using declaration needs a name`},
+		{"using X = import foo;", `test.capnp:1:18: expected string literal, but got 'foo'`},
+		{"struct Foo {\n  bar @0 :Text;\n", `test.capnp:3:1: unexpected end of file`},
+		{"const a :Text = \"x\";\n\n  const a :Text = \"y\";",
+			`test.capnp:3:3: "a" is already declared at test.capnp:1:1`},
+	} {
+		_, err := parseCapnp("test.capnp", c.src)
+		if err == nil {
+			t.Errorf("parsing %q: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("parsing %q:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"sync"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/schemas"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// The Go bindings for Sandstorm's schema register the compiled schema
+// nodes with the schemas package. This file provides an index over those,
+// which lets us evaluate package definitions without the capnp compiler:
+// the nodes tell us the layout of each struct, so we can build values of
+// any type reachable from PackageDefinition.
+//
+// The information we need is copied out of the nodes when the index is
+// loaded, so the index can be shared between goroutines. The exception is
+// the default values of pointer fields, which stay in the (read-only)
+// messages the nodes came from.
+
+// An index of compiled schema nodes.
+type schemaIndex struct {
+	structs map[uint64]*structInfo
+	enums   map[uint64]*enumInfo
+
+	// The qualified names (e.g. "Manifest.Command") of the structs and
+	// enums, by id.
+	names map[uint64]string
+
+	// Node ids by the base name of the file in which they are declared
+	// (e.g. "package.capnp"), and then by their qualified name within
+	// that file.
+	byName map[string]map[string]uint64
+
+	// A hash of the registered schema data the index was loaded from;
+	// see schemaHash.
+	hash string
+}
+
+// Information about a struct type (or group).
+type structInfo struct {
+	id   uint64
+	size capnp.ObjectSize
+
+	// Offset of the union discriminant, in multiples of 16 bits. Only
+	// meaningful if the struct has a union.
+	discriminantOffset uint32
+
+	fields []*fieldInfo
+}
+
+// Information about a field of a struct.
+type fieldInfo struct {
+	name string
+
+	// The value of the union discriminant which selects this field, or
+	// schema.Field_noDiscriminant if the field is not in a union.
+	discriminant uint16
+
+	// For groups, the id of the group's structInfo. Zero otherwise.
+	group uint64
+
+	// For slots (i.e. fields other than groups), the type of the field,
+	// its offset in multiples of the type's size, and the bits of its
+	// default value, if it is stored in the data section.
+	typ         *capnpType
+	offset      uint32
+	defaultBits uint64
+
+	// For fields stored in the pointer section, the default value, if
+	// the schema gives one; otherwise a null pointer.
+	defaultPtr capnp.Ptr
+}
+
+// Information about an enum type.
+type enumInfo struct {
+	// The names of the enumerants, in order of their numeric values.
+	names []string
+}
+
+// Return the field of the struct with the given name.
+func (s *structInfo) field(name string) (*fieldInfo, bool) {
+	for _, f := range s.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Report whether the field is a member of a union.
+func (f *fieldInfo) inUnion() bool {
+	return f.discriminant != schema.Field_noDiscriminant
+}
+
+// Load the index of all nodes reachable from the node with id `root`.
+func loadSchemaIndex(root uint64) (*schemaIndex, error) {
+	idx := &schemaIndex{
+		structs: map[uint64]*structInfo{},
+		enums:   map[uint64]*enumInfo{},
+		names:   map[uint64]string{},
+		byName:  map[string]map[string]uint64{},
+	}
+	seen := map[uint64]bool{}
+	queue := []uint64{root}
+	sources := [][]byte{}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		nodes, data, err := findSchemaNodes(id)
+		if err != nil {
+			if id == root {
+				return nil, err
+			}
+			// Not every schema referenced from ours necessarily
+			// has Go bindings linked in; we only complain if we
+			// actually need one of these.
+			continue
+		}
+		sources = append(sources, data)
+		for i := 0; i < nodes.Len(); i++ {
+			node := nodes.At(i)
+			seen[node.Id()] = true
+			refs, err := idx.add(node)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, refs...)
+		}
+	}
+	idx.hash = hashParts(sources...)
+	return idx, nil
+}
+
+// Return the nodes registered along with the node `id`, and the data they
+// were read from.
+func findSchemaNodes(id uint64) (schema.Node_List, []byte, error) {
+	data, err := schemas.Find(id)
+	if err != nil {
+		return schema.Node_List{}, nil, err
+	}
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return schema.Node_List{}, nil, err
+	}
+	// The message is kept for the default values of pointer fields,
+	// which may be read any number of times.
+	msg.TraverseLimit = math.MaxUint64
+	req, err := schema.ReadRootCodeGeneratorRequest(msg)
+	if err != nil {
+		return schema.Node_List{}, nil, err
+	}
+	nodes, err := req.Nodes()
+	return nodes, data, err
+}
+
+// Add a node to the index. Returns the ids of the types its fields refer
+// to, if it is a struct.
+func (idx *schemaIndex) add(node schema.Node) ([]uint64, error) {
+	displayName, err := node.DisplayName()
+	if err != nil {
+		return nil, err
+	}
+	colon := strings.IndexByte(displayName, ':')
+	if colon >= 0 {
+		file := path.Base(displayName[:colon])
+		name := displayName[colon+1:]
+		if idx.byName[file] == nil {
+			idx.byName[file] = map[string]uint64{}
+		}
+		idx.byName[file][name] = node.Id()
+		idx.names[node.Id()] = name
+	}
+
+	switch node.Which() {
+	case schema.Node_Which_enum:
+		enumerants, err := node.Enum().Enumerants()
+		if err != nil {
+			return nil, err
+		}
+		info := &enumInfo{names: make([]string, enumerants.Len())}
+		for i := range info.names {
+			if info.names[i], err = enumerants.At(i).Name(); err != nil {
+				return nil, err
+			}
+		}
+		idx.enums[node.Id()] = info
+		return nil, nil
+	case schema.Node_Which_structNode:
+		return idx.addStruct(node)
+	default:
+		return nil, nil
+	}
+}
+
+func (idx *schemaIndex) addStruct(node schema.Node) ([]uint64, error) {
+	sn := node.StructNode()
+	info := &structInfo{
+		id: node.Id(),
+		size: capnp.ObjectSize{
+			DataSize:     capnp.Size(sn.DataWordCount()) * 8,
+			PointerCount: sn.PointerCount(),
+		},
+		discriminantOffset: sn.DiscriminantOffset(),
+	}
+	fields, err := sn.Fields()
+	if err != nil {
+		return nil, err
+	}
+	refs := []uint64{}
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.At(i)
+		fi := &fieldInfo{discriminant: field.DiscriminantValue()}
+		if fi.name, err = field.Name(); err != nil {
+			return nil, err
+		}
+		if field.Which() == schema.Field_Which_group {
+			fi.group = field.Group().TypeId()
+			refs = append(refs, fi.group)
+			info.fields = append(info.fields, fi)
+			continue
+		}
+		slot := field.Slot()
+		fi.offset = slot.Offset()
+		typ, err := slot.Type()
+		if err != nil {
+			return nil, err
+		}
+		if fi.typ, err = typeFromSchema(typ); err != nil {
+			return nil, err
+		}
+		def, err := slot.DefaultValue()
+		if err != nil {
+			return nil, err
+		}
+		if fi.typ.isData() {
+			fi.defaultBits = defaultBits(fi.typ, def)
+		} else if def.IsValid() {
+			// All of Value's pointer members share its first
+			// pointer.
+			if fi.defaultPtr, err = def.Struct.Ptr(0); err != nil {
+				return nil, err
+			}
+		}
+		for t := fi.typ; t != nil; t = t.elem {
+			if t.which == schema.Type_Which_structType || t.which == schema.Type_Which_enum {
+				refs = append(refs, t.id)
+			}
+		}
+		info.fields = append(info.fields, fi)
+	}
+	idx.structs[info.id] = info
+	return refs, nil
+}
+
+// Return the bits of a default value for a field of type `t`, which must
+// be stored in the data section.
+func defaultBits(t *capnpType, v schema.Value) uint64 {
+	if !v.IsValid() {
+		return 0
+	}
+	switch t.which {
+	case schema.Type_Which_bool:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case schema.Type_Which_int8:
+		return uint64(uint8(v.Int8()))
+	case schema.Type_Which_int16:
+		return uint64(uint16(v.Int16()))
+	case schema.Type_Which_int32:
+		return uint64(uint32(v.Int32()))
+	case schema.Type_Which_int64:
+		return uint64(v.Int64())
+	case schema.Type_Which_uint8:
+		return uint64(v.Uint8())
+	case schema.Type_Which_uint16:
+		return uint64(v.Uint16())
+	case schema.Type_Which_uint32:
+		return uint64(v.Uint32())
+	case schema.Type_Which_uint64:
+		return v.Uint64()
+	case schema.Type_Which_float32:
+		return uint64(math.Float32bits(v.Float32()))
+	case schema.Type_Which_float64:
+		return math.Float64bits(v.Float64())
+	case schema.Type_Which_enum:
+		return uint64(v.Enum())
+	}
+	return 0
+}
+
+// Return the struct with the given id.
+func (idx *schemaIndex) structInfo(id uint64) (*structInfo, error) {
+	info, ok := idx.structs[id]
+	if !ok {
+		return nil, fmt.Errorf("schema for struct %s not found", idx.nodeName(id))
+	}
+	return info, nil
+}
+
+// Return the enum with the given id.
+func (idx *schemaIndex) enumInfo(id uint64) (*enumInfo, error) {
+	info, ok := idx.enums[id]
+	if !ok {
+		return nil, fmt.Errorf("schema for enum %s not found", idx.nodeName(id))
+	}
+	return info, nil
+}
+
+// Look up a node by the base name of its file and its qualified name.
+func (idx *schemaIndex) lookup(file, name string) (uint64, bool) {
+	id, ok := idx.byName[file][name]
+	return id, ok
+}
+
+// Report whether `name` is the qualified name of some node in `file`, or
+// a prefix of one. An empty name refers to the file itself.
+func (idx *schemaIndex) hasScope(file, name string) bool {
+	if name == "" {
+		return idx.byName[file] != nil
+	}
+	if _, ok := idx.lookup(file, name); ok {
+		return true
+	}
+	for k := range idx.byName[file] {
+		if strings.HasPrefix(k, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the qualified name of the node with the given id, for use in
+// error messages.
+func (idx *schemaIndex) nodeName(id uint64) string {
+	if name, ok := idx.names[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("@0x%x", id)
+}
+
+// A Cap'n Proto type.
+type capnpType struct {
+	which schema.Type_Which
+
+	// For structs and enums, the id of the type's node.
+	id uint64
+
+	// For lists, the element type.
+	elem *capnpType
+}
+
+// The built in types, by name. List is handled separately, since it
+// takes a parameter.
+var builtinTypes = map[string]*capnpType{
+	"Void":    {which: schema.Type_Which_void},
+	"Bool":    {which: schema.Type_Which_bool},
+	"Int8":    {which: schema.Type_Which_int8},
+	"Int16":   {which: schema.Type_Which_int16},
+	"Int32":   {which: schema.Type_Which_int32},
+	"Int64":   {which: schema.Type_Which_int64},
+	"UInt8":   {which: schema.Type_Which_uint8},
+	"UInt16":  {which: schema.Type_Which_uint16},
+	"UInt32":  {which: schema.Type_Which_uint32},
+	"UInt64":  {which: schema.Type_Which_uint64},
+	"Float32": {which: schema.Type_Which_float32},
+	"Float64": {which: schema.Type_Which_float64},
+	"Text":    {which: schema.Type_Which_text},
+	"Data":    {which: schema.Type_Which_data},
+}
+
+// Convert a type from the schema into a capnpType.
+func typeFromSchema(t schema.Type) (*capnpType, error) {
+	ret := &capnpType{which: t.Which()}
+	switch ret.which {
+	case schema.Type_Which_structType:
+		ret.id = t.StructType().TypeId()
+	case schema.Type_Which_enum:
+		ret.id = t.Enum().TypeId()
+	case schema.Type_Which_list:
+		elem, err := t.List().ElementType()
+		if err != nil {
+			return nil, err
+		}
+		if ret.elem, err = typeFromSchema(elem); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (t *capnpType) equal(other *capnpType) bool {
+	if t.which != other.which || t.id != other.id {
+		return false
+	}
+	if t.elem == nil || other.elem == nil {
+		return t.elem == other.elem
+	}
+	return t.elem.equal(other.elem)
+}
+
+// Report whether values of the type are stored in a struct's data
+// section (as opposed to its pointer section).
+func (t *capnpType) isData() bool {
+	switch t.which {
+	case schema.Type_Which_text,
+		schema.Type_Which_data,
+		schema.Type_Which_list,
+		schema.Type_Which_structType,
+		schema.Type_Which_interface,
+		schema.Type_Which_anyPointer:
+		return false
+	}
+	return true
+}
+
+// Return the size in bits of values of the type, if it is stored in the
+// data section.
+func (t *capnpType) bitSize() uint32 {
+	switch t.which {
+	case schema.Type_Which_void:
+		return 0
+	case schema.Type_Which_bool:
+		return 1
+	case schema.Type_Which_int8, schema.Type_Which_uint8:
+		return 8
+	case schema.Type_Which_int16, schema.Type_Which_uint16, schema.Type_Which_enum:
+		return 16
+	case schema.Type_Which_int32, schema.Type_Which_uint32, schema.Type_Which_float32:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// Report whether the type is a signed integer type.
+func (t *capnpType) isSigned() bool {
+	switch t.which {
+	case schema.Type_Which_int8,
+		schema.Type_Which_int16,
+		schema.Type_Which_int32,
+		schema.Type_Which_int64:
+		return true
+	}
+	return false
+}
+
+// Report whether the type is a floating point type.
+func (t *capnpType) isFloat() bool {
+	return t.which == schema.Type_Which_float32 || t.which == schema.Type_Which_float64
+}
+
+// Return a human readable name for the type, for error messages.
+func (idx *schemaIndex) typeName(t *capnpType) string {
+	switch t.which {
+	case schema.Type_Which_structType, schema.Type_Which_enum:
+		return idx.nodeName(t.id)
+	case schema.Type_Which_list:
+		return "List(" + idx.typeName(t.elem) + ")"
+	case schema.Type_Which_interface:
+		return "interface"
+	case schema.Type_Which_anyPointer:
+		return "AnyPointer"
+	}
+	for name, bt := range builtinTypes {
+		if bt.which == t.which {
+			return name
+		}
+	}
+	return "unknown type"
+}
+
+var (
+	sandstormSchemaOnce  sync.Once
+	sandstormSchemaIndex *schemaIndex
+	sandstormSchemaErr   error
+)
+
+// Return the schema index for the types reachable from PackageDefinition.
+// The index is loaded on first use.
+func sandstormSchema() (*schemaIndex, error) {
+	sandstormSchemaOnce.Do(func() {
+		sandstormSchemaIndex, sandstormSchemaErr = loadSchemaIndex(
+			capnp_spk.PackageDefinition_TypeID,
+		)
+		sandstormSchemaErr = wrapErr("Loading the sandstorm schema", sandstormSchemaErr)
+	})
+	return sandstormSchemaIndex, sandstormSchemaErr
+}
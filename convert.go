@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+func convertCmd() {
+	force := flag.Bool("force", false, "Overwrite the output file if it already exists.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s convert [-force] <input> <output>\n\n"+
+				"Convert a package definition between the capnp, YAML and JSON\n"+
+				"formats, based on the files' extensions. A capnp file may be\n"+
+				"given as <file>:<name>, where <name> is the name of the\n"+
+				"constant defining the package definition (default pkgdef).\n\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usageErr("convert takes exactly two arguments: <input> <output>")
+	}
+	inFile, inName := splitPkgDefSpec(flag.Arg(0))
+	outFile, outName := splitPkgDefSpec(flag.Arg(1))
+	if !isIdentifier(outName) {
+		usageErr(fmt.Sprintf("%q is not a valid constant name", outName))
+	}
+	if !*force {
+		if _, err := os.Stat(outFile); err == nil {
+			chkfatal("Converting the package definition",
+				fmt.Errorf("%s already exists (use -force to overwrite it)", outFile))
+		}
+	}
+	data, err := convertPkgDef(inFile, inName, outFile, outName)
+	chkfatal("Converting the package definition", err)
+	chkfatal("Writing "+outFile, ioutil.WriteFile(outFile, data, 0644))
+}
+
+// Split a package definition argument of the form <file>[:<name>] into
+// its parts. The name defaults to pkgdef, and is only recognized for
+// schema files.
+func splitPkgDefSpec(spec string) (file, name string) {
+	if i := strings.LastIndex(spec, ":"); i >= 0 && pkgDefFormat(spec[:i]) == "capnp" {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, "pkgdef"
+}
+
+// Convert the package definition in inFile (in the constant inName, if
+// it is a schema file) to the format indicated by the extension of
+// outFile, and return the result. If outFile is a schema file, the
+// package definition is stored in the constant outName.
+//
+// Embedded files are not copied; the paths are adjusted so that they
+// refer to the same files from outFile's directory.
+func convertPkgDef(inFile, inName, outFile, outName string) ([]byte, error) {
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the input is valid, so we don't write out something
+	// broken:
+	if _, err := e.evalPackageDefinition(inFile, inName); err != nil {
+		return nil, err
+	}
+
+	outDir := filepath.Dir(outFile)
+	rebase := func(fromDir, path string) string {
+		return rebasePath(path, fromDir, outDir)
+	}
+	t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	var n *dataNode
+	if pkgDefFormat(inFile) == "capnp" {
+		file, err := e.loadFile(inFile)
+		if err != nil {
+			return nil, err
+		}
+		n, err = e.valueToData(t, file.decls[inName].value, file, rebase)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		src, err := e.readFile(inFile)
+		if err != nil {
+			return nil, err
+		}
+		if n, err = parseDataFile(inFile, src); err != nil {
+			return nil, err
+		}
+		rebaseDataEmbeds(n, func(path string) string {
+			return rebase(filepath.Dir(inFile), path)
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	err = writePkgDefData(buf, e.schema, n, pkgDefFormat(outFile), outName)
+	return buf.Bytes(), err
+}
+
+// Write the package definition `n`, in the form read from JSON and YAML
+// files, to `w` in the given format. If the format is capnp, it is
+// stored in the constant `name`.
+func writePkgDefData(w io.Writer, idx *schemaIndex, n *dataNode, format, name string) error {
+	switch format {
+	case "json":
+		return writeJSON(w, n)
+	case "yaml":
+		return writeYAML(w, n)
+	default:
+		t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+		v, err := dataToValue(idx, t, n)
+		if err != nil {
+			return err
+		}
+		return writeCapnpPkgDef(w, v, name)
+	}
+}
+
+// Return `path`, which is relative to `fromDir`, relative to `toDir`
+// instead. Absolute paths are returned unchanged.
+func rebasePath(path, fromDir, toDir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	target, err := filepath.Abs(filepath.Join(fromDir, path))
+	if err != nil {
+		return path
+	}
+	base, err := filepath.Abs(toDir)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Replace the path of each {"$embed": path} in `n` with rebase(path).
+func rebaseDataEmbeds(n *dataNode, rebase func(string) string) {
+	if n.kind == dataMap && len(n.fields) == 1 && n.fields[0].key == "$embed" &&
+		n.fields[0].value.kind == dataScalar {
+		n.fields[0].value.text = rebase(n.fields[0].value.text)
+		return
+	}
+	for _, elem := range n.elems {
+		rebaseDataEmbeds(elem, rebase)
+	}
+	for _, f := range n.fields {
+		rebaseDataEmbeds(f.value, rebase)
+	}
+}
+
+// Convert `v`, a value of type `t` which appears in `file`, into the
+// form used in JSON and YAML package definitions; see pkgdefdata.go.
+// References to other constants are replaced by their values. The paths
+// of embedded files are passed to rebase, along with the directory they
+// are relative to, and replaced with the result.
+func (e *capnpEvaluator) valueToData(t *capnpType, v *valueExpr, file *capnpFile, rebase func(dir, path string) string) (*dataNode, error) {
+	v, file, decls, err := e.deref(t, v, file)
+	defer e.done(decls)
+	if err != nil {
+		return nil, err
+	}
+	mismatch := func() (*dataNode, error) {
+		return nil, errorAt(v.pos, "expected a value of type %s", e.schema.typeName(t))
+	}
+	n := &dataNode{pos: v.pos}
+	switch t.which {
+	case schema.Type_Which_void:
+		if err := e.evalVoid(v, file); err != nil {
+			return nil, err
+		}
+		n.kind = dataNull
+	case schema.Type_Which_text, schema.Type_Which_data:
+		switch {
+		case v.kind == valString:
+			n = stringNode(v.text)
+		case v.kind == valData && t.which == schema.Type_Which_data:
+			n = singletonMap("$base64", stringNode(base64.StdEncoding.EncodeToString([]byte(v.text))))
+		case v.kind == valEmbed:
+			n = singletonMap("$embed", stringNode(rebase(filepath.Dir(file.filename), v.text)))
+		default:
+			return mismatch()
+		}
+	case schema.Type_Which_structType:
+		info, err := e.schema.structInfo(t.id)
+		if err != nil {
+			return nil, err
+		}
+		if v.kind != valStruct {
+			return mismatch()
+		}
+		n.kind = dataMap
+		for _, fe := range v.fields {
+			field, ok := info.field(fe.name)
+			if !ok {
+				return nil, errorAt(fe.pos, "%s has no field named %q", e.schema.typeName(t), fe.name)
+			}
+			fieldType := field.typ
+			if field.group != 0 {
+				fieldType = &capnpType{which: schema.Type_Which_structType, id: field.group}
+			}
+			value, err := e.valueToData(fieldType, fe.value, file, rebase)
+			if err != nil {
+				return nil, err
+			}
+			n.fields = append(n.fields, &dataField{pos: fe.pos, key: fe.name, value: value})
+		}
+		if isLocalizedText(e.schema, t) && len(n.fields) == 1 && n.fields[0].key == "defaultText" &&
+			n.fields[0].value.kind == dataScalar {
+			// Just the text will do.
+			return n.fields[0].value, nil
+		}
+	case schema.Type_Which_list:
+		if v.kind != valList {
+			return mismatch()
+		}
+		n.kind = dataList
+		for _, elem := range v.elems {
+			value, err := e.valueToData(t.elem, elem, file, rebase)
+			if err != nil {
+				return nil, err
+			}
+			n.elems = append(n.elems, value)
+		}
+	case schema.Type_Which_interface, schema.Type_Which_anyPointer:
+		return nil, errorAt(v.pos, "values of type %s are not supported", e.schema.typeName(t))
+	default:
+		if _, err := e.evalScalar(t, v, file); err != nil {
+			return nil, err
+		}
+		n.kind = dataScalar
+		if v.kind == valName {
+			n.text = v.name.parts[0]
+		} else {
+			n.text = v.text
+		}
+		if v.negative {
+			n.text = "-" + n.text
+		}
+	}
+	return n, nil
+}
+
+// Write a schema file defining the package definition `v` as the
+// constant `name`.
+func writeCapnpPkgDef(w io.Writer, v *valueExpr, name string) error {
+	id, err := newCapnpFileId()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "@0x%x;\n\n", id)
+	fmt.Fprintf(buf, "using Spk = import \"/sandstorm/package.capnp\";\n\n")
+	fmt.Fprintf(buf, "const %s :Spk.PackageDefinition = ", name)
+	writeCapnpValue(buf, v, "")
+	buf.WriteString(";\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Return a new random id for a schema file.
+func newCapnpFileId() (uint64, error) {
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return 0, err
+	}
+	// File ids must have the high bit set:
+	return binary.BigEndian.Uint64(idBytes[:]) | 1<<63, nil
+}
+
+// Write the value `v` in the syntax of the schema language. Lines after
+// the first are indented by `indent`.
+func writeCapnpValue(buf *bytes.Buffer, v *valueExpr, indent string) {
+	if v.negative {
+		buf.WriteString("-")
+	}
+	switch v.kind {
+	case valNumber:
+		buf.WriteString(v.text)
+	case valString:
+		buf.WriteString(capnpQuote(v.text))
+	case valData:
+		buf.WriteString("0x\"" + hex.EncodeToString([]byte(v.text)) + "\"")
+	case valEmbed:
+		buf.WriteString("embed " + capnpQuote(v.text))
+	case valName:
+		buf.WriteString(v.name.String())
+	case valStruct:
+		if len(v.fields) == 0 {
+			buf.WriteString("()")
+			return
+		}
+		buf.WriteString("(")
+		for i, f := range v.fields {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n" + indent + "  " + f.name + " = ")
+			writeCapnpValue(buf, f.value, indent+"  ")
+		}
+		buf.WriteString("\n" + indent + ")")
+	case valList:
+		inline := true
+		for _, elem := range v.elems {
+			if elem.kind == valStruct || elem.kind == valList {
+				inline = false
+			}
+		}
+		if inline {
+			buf.WriteString("[")
+			for i, elem := range v.elems {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				writeCapnpValue(buf, elem, indent)
+			}
+			buf.WriteString("]")
+			return
+		}
+		buf.WriteString("[")
+		for i, elem := range v.elems {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n" + indent + "  ")
+			writeCapnpValue(buf, elem, indent+"  ")
+		}
+		buf.WriteString("\n" + indent + "]")
+	}
+}
+
+// Return `s` as a string literal in the schema language.
+func capnpQuote(s string) string {
+	buf := &strings.Builder{}
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\r':
+			buf.WriteString("\\r")
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(buf, "\\x%02x", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// A package definition which uses most of the features the converters
+// need to handle.
+const convertTestPkgDef = `@0xbd8cfd59c13fc42f;
+
+using Spk = import "/sandstorm/package.capnp";
+
+const pkgdef :Spk.PackageDefinition = (
+  id = "8anwd8gxasmhav7uu869eamag7rqhxczd86a6fcz5nktuk02mkth",
+  manifest = (
+    appTitle = (defaultText = "true", localizations = [(locale = "de", text = "Wahr")]),
+    appVersion = 12,
+    minUpgradableAppVersion = 0x3,
+    appMarketingVersion = (defaultText = "1.0"),
+    actions = [
+      ( input = (none = void),
+        nounPhrase = (defaultText = "yes: no # not a comment"),
+        command = .cmd
+      )
+    ],
+    continueCommand = .cmd,
+    metadata = (
+      icons = (appGrid = (svg = embed "icon.svg")),
+      license = (openSource = apache2),
+      description = (defaultText = embed "description.md"),
+      shortDescription = (defaultText = ""),
+      screenshots = [(width = 640, height = 480, png = 0x"89504e47 00ff")],
+      changeLog = (defaultText = "line one\n  line two\n\ttabbed \"quoted\"\n"),
+    ),
+  ),
+  sourceMap = (searchPath = [(sourcePath = "/", hidePaths = ["home", "proc"])]),
+  alwaysInclude = ["opt/app"],
+  bridgeConfig = (
+    apiPath = "/api/",
+    saveIdentityCaps = true,
+    viewInfo = (permissions = [(name = "editor", title = (defaultText = "editor"))]),
+  ),
+);
+
+const cmd :Spk.Manifest.Command = (
+  argv = ["/sandstorm-http-bridge", "8000", "--", "/app/run"],
+  environ = [(key = "PATH", value = "/usr/bin:/bin"), (key = "EMPTY", value = "")],
+);
+`
+
+// Evaluate the package definition in `filename`, and return it as JSON.
+func pkgDefJSON(t *testing.T, filename string) string {
+	pkgDef, err := readPackageDefinition(filename, "pkgdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := sandstormSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := structToData(idx, capnp_spk.PackageDefinition_TypeID, pkgDef.Struct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeJSON(buf, n); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-spk-convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"sandstorm-pkgdef.capnp": convertTestPkgDef,
+		"icon.svg":               "<svg></svg>\n",
+		"description.md":         "# Hello\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orig := filepath.Join(dir, "sandstorm-pkgdef.capnp")
+	want := pkgDefJSON(t, orig)
+
+	for _, format := range []string{"json", "yaml"} {
+		// capnp -> format -> capnp; each step should give the same
+		// package definition.
+		mid := filepath.Join(dir, "sandstorm-pkgdef."+format)
+		back := filepath.Join(dir, "back-from-"+format+".capnp")
+		for _, step := range [][2]string{{orig, mid}, {mid, back}} {
+			data, err := convertPkgDef(step[0], "pkgdef", step[1], "pkgdef")
+			if err != nil {
+				t.Fatalf("converting %s to %s: %v", step[0], step[1], err)
+			}
+			if err := ioutil.WriteFile(step[1], data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := pkgDefJSON(t, step[1]); got != want {
+				t.Errorf("after converting %s to %s, got:\n%s\nwant:\n%s",
+					filepath.Base(step[0]), filepath.Base(step[1]), got, want)
+			}
+		}
+	}
+}
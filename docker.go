@@ -4,7 +4,10 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	slashpath "path"
 	"regexp"
 )
@@ -16,6 +19,28 @@ type DockerManifestItem struct {
 	Layers   []string
 }
 
+// The parts of a docker image's config (the file named by
+// DockerManifestItem.Config) which we use.
+type DockerImageConfig struct {
+	Config DockerContainerConfig `json:"config"`
+}
+
+// The default settings for containers run from an image.
+type DockerContainerConfig struct {
+	User         string
+	ExposedPorts map[string]struct{}
+	Env          []string
+	Entrypoint   []string
+	Cmd          []string
+	Volumes      map[string]struct{}
+	WorkingDir   string
+	StopSignal   string
+	Healthcheck  *struct {
+		Test []string
+	}
+	Labels map[string]string
+}
+
 // Information we need about a docker image.
 type DockerImage struct {
 	// The decoded layers of the docker image. The keys are the paths to
@@ -24,11 +49,19 @@ type DockerImage struct {
 
 	// The contents of the docker image's manifest.json
 	Manifest []DockerManifestItem
+
+	// The image configs. The keys are the paths to the configs within
+	// the image.
+	Configs map[string]*DockerImageConfig
 }
 
 // regular expression matching paths to layers inside the docker image.
 var layerRegexp = regexp.MustCompile("^[0-9a-f]{64}/layer\\.tar$")
 
+// regular expression matching paths to image configs inside the docker
+// image.
+var configRegexp = regexp.MustCompile("^[0-9a-f]{64}\\.json$")
+
 // Convert a tarball into a map from (full) paths to Files. Skips any file
 // that is not a symlink, directory, or regular file.
 //
@@ -133,21 +166,32 @@ func readLayer(r *tar.Reader) (Tree, error) {
 
 // Unmarshal a docker image from a tarball.
 func readDockerImage(r *tar.Reader) (*DockerImage, error) {
+	return readDockerImageParts(r, true)
+}
+
+// Unmarshal a docker image from a tarball. If withLayers is false, the
+// layers are skipped, and only the manifest and configs are read.
+func readDockerImageParts(r *tar.Reader, withLayers bool) (*DockerImage, error) {
 	ret := &DockerImage{
 		Layers:   map[string]Tree{},
 		Manifest: []DockerManifestItem{},
+		Configs:  map[string]*DockerImageConfig{},
 	}
 	it := iterTar(r)
 	for it.Next() {
 		cur := it.Cur()
-		if cur.Name == "manifest.json" {
+		switch {
+		case cur.Name == "manifest.json":
 			if err := json.NewDecoder(r).Decode(&ret.Manifest); err != nil {
 				return nil, err
 			}
-		} else {
-			if !layerRegexp.Match([]byte(cur.Name)) {
-				continue
+		case configRegexp.MatchString(cur.Name):
+			config := &DockerImageConfig{}
+			if err := json.NewDecoder(r).Decode(config); err != nil {
+				return nil, err
 			}
+			ret.Configs[cur.Name] = config
+		case withLayers && layerRegexp.MatchString(cur.Name):
 			layer, err := readLayer(tar.NewReader(r))
 			if err != nil {
 				return nil, err
@@ -159,6 +203,21 @@ func readDockerImage(r *tar.Reader) (*DockerImage, error) {
 
 }
 
+// Return the config of the docker image. If the tarball contains more
+// than one image, this is the config of the last one, whose layers take
+// precedence in toTree.
+func (di *DockerImage) config() (*DockerImageConfig, error) {
+	if len(di.Manifest) == 0 {
+		return nil, errors.New("image has no manifest.json")
+	}
+	name := di.Manifest[len(di.Manifest)-1].Config
+	config, ok := di.Configs[name]
+	if !ok {
+		return nil, fmt.Errorf("image config %q not found", name)
+	}
+	return config, nil
+}
+
 // Convert the docker image into a tree for the entire filesystem (merging
 // the individual layers).
 func (di *DockerImage) toTree() (Tree, error) {
@@ -171,3 +230,37 @@ func (di *DockerImage) toTree() (Tree, error) {
 	}
 	return tree, nil
 }
+
+// Read the docker image stored in the file `filename` (as output by
+// "docker save"). If withLayers is false, only the manifest and configs
+// are read.
+func readDockerImageFile(filename string, withLayers bool) (*DockerImage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, wrapErr("opening image file", err)
+	}
+	defer file.Close()
+	return readDockerImageParts(tar.NewReader(file), withLayers)
+}
+
+// Read the image named `image` from the running docker daemon, via
+// "docker save". If withLayers is false, only the manifest and configs
+// are read.
+func readDockerImageFromDaemon(image string, withLayers bool) (*DockerImage, error) {
+	cmd := exec.Command("docker", "save", image)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, wrapErr("Getting standard output from docker save", err)
+	}
+	defer stdout.Close()
+	if err := cmd.Start(); err != nil {
+		return nil, wrapErr("Starting docker save", err)
+	}
+	img, err := readDockerImageParts(tar.NewReader(stdout), withLayers)
+	if err != nil {
+		stdout.Close()
+		cmd.Wait()
+		return nil, err
+	}
+	return img, wrapErr("Waiting for docker save", cmd.Wait())
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"io"
+	"os"
+	slashpath "path"
+	"regexp"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// This file fills in the app's description and change log, in the
+// manifest's metadata, from Markdown files next to the package
+// definition.
+
+const (
+	descriptionFile = "DESCRIPTION.md"
+	changeLogFile   = "CHANGELOG.md"
+)
+
+// The number of versions to keep in the change log, by default.
+const defaultChangeLogVersions = 5
+
+var (
+	mdHeadingRegexp = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?[ \t#]*$`)
+	mdFenceRegexp   = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	mdImageRegexp   = regexp.MustCompile(`!\[[^\]]*\][ \t]*[(\[]`)
+
+	// Matches HTML tags and comments, but not autolinks like
+	// <https://example.com> or <me@example.com>.
+	mdHTMLRegexp = regexp.MustCompile(`<(?:/?[A-Za-z][A-Za-z0-9-]*(?:\s[^>]*)?/?>|!--)`)
+)
+
+// Fill in metadata.description and metadata.changeLog from DESCRIPTION.md
+// and CHANGELOG.md in `dir`, where the package definition leaves them
+// empty. Files which don't exist are skipped. The change log is trimmed
+// to the current version, per the manifest's appMarketingVersion, and the
+// `versions` - 1 before it; if `versions` is 0, it is kept whole. Warnings
+// are printed to `warnings`.
+func fillFromDocs(manifest capnp_spk.Manifest, readFile func(string) ([]byte, error), dir string, versions int,
+	warnings io.Writer) error {
+	metadata, err := manifest.Metadata()
+	if err != nil {
+		return wrapErr("Reading the metadata", err)
+	}
+	read := func(name string) (string, bool, error) {
+		path := slashpath.Join(dir, name)
+		data, err := readFile(path)
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if err := checkMarkdown(path, string(data)); err != nil {
+			return "", false, err
+		}
+		return string(data), true, nil
+	}
+	set := func(field string, newText func(capnp_spk.Metadata) (textSetter, error), value string) error {
+		if !manifest.HasMetadata() {
+			if metadata, err = manifest.NewMetadata(); err != nil {
+				return wrapErr("Setting "+field, err)
+			}
+		}
+		text, err := newText(metadata)
+		if err == nil {
+			err = text.SetDefaultText(value)
+		}
+		return wrapErr("Setting "+field, err)
+	}
+
+	if isEmptyText(metadata.Description()) {
+		desc, ok, err := read(descriptionFile)
+		if err != nil {
+			return err
+		}
+		if ok {
+			err := set("metadata.description", func(m capnp_spk.Metadata) (textSetter, error) {
+				return m.NewDescription()
+			}, strings.TrimSpace(desc))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if isEmptyText(metadata.ChangeLog()) {
+		changeLog, ok, err := read(changeLogFile)
+		if err != nil {
+			return err
+		}
+		if ok {
+			version, err := manifest.AppMarketingVersion()
+			if err != nil {
+				return wrapErr("Reading appMarketingVersion", err)
+			}
+			versionText, err := version.DefaultText()
+			if err != nil {
+				return wrapErr("Reading appMarketingVersion", err)
+			}
+			changeLog = trimChangeLog(changeLog, versionText, versions, warnings)
+			err = set("metadata.changeLog", func(m capnp_spk.Metadata) (textSetter, error) {
+				return m.NewChangeLog()
+			}, strings.TrimSpace(changeLog))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The part of util.LocalizedText used by fillFromDocs.
+type textSetter interface {
+	SetDefaultText(string) error
+}
+
+// Check that the Markdown document `src`, read from `filename`, uses only
+// what the app market renders: the Markdown may not contain HTML or
+// images.
+func checkMarkdown(filename, src string) error {
+	fences := &mdFences{}
+	for i, line := range strings.Split(src, "\n") {
+		if fences.inCode(line) || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			// Code, which is shown as is.
+			continue
+		}
+		line = blankMdCode(line)
+		pos := srcPos{filename: filename, line: i + 1}
+		if loc := mdImageRegexp.FindStringIndex(line); loc != nil {
+			pos.col = loc[0] + 1
+			return errorAt(pos, "images are not allowed; use -screenshot instead")
+		}
+		if loc := mdHTMLRegexp.FindStringIndex(line); loc != nil {
+			pos.col = loc[0] + 1
+			return errorAt(pos, "HTML is not allowed: %s", line[loc[0]:loc[1]])
+		}
+	}
+	return nil
+}
+
+// Return `line` with its code spans replaced by spaces. A span starts
+// with a run of backticks, and ends with the next run of the same length;
+// a run without a match is just text.
+func blankMdCode(line string) string {
+	buf := []byte(line)
+	backticks := func(i int) int {
+		n := 0
+		for i+n < len(buf) && buf[i+n] == '`' {
+			n++
+		}
+		return n
+	}
+	for i := 0; i < len(buf); {
+		n := backticks(i)
+		if n == 0 {
+			i++
+			continue
+		}
+		end := -1
+		for j := i + n; j < len(buf); {
+			m := backticks(j)
+			if m == n {
+				end = j + m
+				break
+			}
+			if m == 0 {
+				m = 1
+			}
+			j += m
+		}
+		if end < 0 {
+			i += n
+			continue
+		}
+		for ; i < end; i++ {
+			buf[i] = ' '
+		}
+	}
+	return string(buf)
+}
+
+// Tracks the fenced code blocks in a Markdown document, line by line.
+type mdFences struct {
+	// The fence which opened the current code block, or "" if we are
+	// not in one.
+	fence string
+}
+
+// Report whether `line`, the next line of the document, is part of a
+// fenced code block, including the fences themselves.
+func (f *mdFences) inCode(line string) bool {
+	m := mdFenceRegexp.FindStringSubmatch(line)
+	switch {
+	case m == nil:
+		return f.fence != ""
+	case f.fence == "":
+		f.fence = m[1]
+	case m[1][0] == f.fence[0] && len(m[1]) >= len(f.fence):
+		f.fence = ""
+	}
+	return true
+}
+
+// A heading in a Markdown document.
+type mdHeading struct {
+	line  int // The index of the heading's line.
+	level int
+	text  string
+}
+
+// Return the headings in the Markdown document whose lines are `lines`.
+func mdHeadings(lines []string) []mdHeading {
+	headings := []mdHeading{}
+	fences := &mdFences{}
+	for i, line := range lines {
+		if fences.inCode(line) {
+			continue
+		}
+		if m := mdHeadingRegexp.FindStringSubmatch(line); m != nil {
+			headings = append(headings, mdHeading{line: i, level: len(m[1]), text: m[2]})
+		}
+	}
+	return headings
+}
+
+// Return the part of the change log `src` covering `version` and the
+// `versions` - 1 before it. Each version is taken to have a section of its
+// own, starting with a heading containing its number; the level of the
+// first such heading is used for all of them. Anything before the
+// section for `version` (e.g. the document's title, or unreleased
+// changes) is left out. If there is no such section, a warning is printed
+// to `warnings` and the most recent versions are kept.
+func trimChangeLog(src, version string, versions int, warnings io.Writer) string {
+	lines := strings.Split(src, "\n")
+	headings := mdHeadings(lines)
+	level := 0
+	for _, h := range headings {
+		if strings.ContainsAny(h.text, "0123456789") {
+			level = h.level
+			break
+		}
+	}
+	if level == 0 {
+		// No versions to trim.
+		return src
+	}
+	sections := []mdHeading{}
+	for _, h := range headings {
+		if h.level == level {
+			sections = append(sections, h)
+		}
+	}
+
+	versionRegexp := regexp.MustCompile(`(^|[^0-9A-Za-z.])[vV]?` + regexp.QuoteMeta(version) +
+		`($|[^0-9A-Za-z.]|\.($|[^0-9]))`)
+	first := -1
+	for i, h := range sections {
+		if version != "" && versionRegexp.MatchString(h.text) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		fwarnf(warnings, "%s has no section for version %q; keeping the most recent versions",
+			changeLogFile, version)
+		for i, h := range sections {
+			if strings.ContainsAny(h.text, "0123456789") {
+				first = i
+				break
+			}
+		}
+	}
+
+	start, end := sections[first].line, len(lines)
+	if versions > 0 && first+versions < len(sections) {
+		end = sections[first+versions].line
+	}
+	return strings.Join(lines[start:end], "\n")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckMarkdown(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"# Example\n\nAn *example* app. See [the site](https://example.com).\n", ""},
+		{"Say `<b>` or ``a ` <i>`` to make text bold.\n", ""},
+		{"Mail <me@example.com> or see <https://example.com/a?b=c>.\n", ""},
+		{"1 < 2 and 3 > 2, but a<b.\n", ""},
+		{"Code:\n\n    <b>bold</b>\n\t![x](y.png)\n", ""},
+		{"```html\n<b>bold</b>\n![x](y.png)\n```\n", ""},
+		{"~~~~\n```\n<b>\n~~~~\n", ""},
+		{"Text\n\n![A screenshot](shot.png)\n", "README.md:3:1: images are not allowed; use -screenshot instead"},
+		{"See ![A screenshot] [shot].\n", "README.md:1:5: images are not allowed; use -screenshot instead"},
+		{"Some <b>bold</b> text.\n", "README.md:1:6: HTML is not allowed: <b>"},
+		{"A<br/>B\n", "README.md:1:2: HTML is not allowed: <br/>"},
+		{"<div class=\"x\">\n", "README.md:1:1: HTML is not allowed: <div class=\"x\">"},
+		{"<!-- a comment -->\n", "README.md:1:1: HTML is not allowed: <!--"},
+		{"`code` <i>x</i>\n", "README.md:1:8: HTML is not allowed: <i>"},
+		{"A `` <b>`\n", "README.md:1:6: HTML is not allowed: <b>"},
+		{"```\ncode\n```\n<p>\n", "README.md:4:1: HTML is not allowed: <p>"},
+	} {
+		err := checkMarkdown("README.md", c.src)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("checking %q: %v", c.src, err)
+			}
+		} else if err == nil {
+			t.Errorf("checking %q: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("checking %q:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
+
+func TestTrimChangeLog(t *testing.T) {
+	const changeLog = `# Changelog
+
+## Unreleased
+
+- Something new.
+
+## v1.0.1 (2020-02-01)
+
+- A fix.
+
+## 1.0
+
+- The first release, which reads:
+
+` + "```" + `
+## 2.0
+` + "```" + `
+
+## 0.9
+
+- A beta.
+`
+	for _, c := range []struct {
+		src, version string
+		versions     int
+		want         string
+		warn         bool
+	}{
+		{changeLog, "1.0.1", 1, "## v1.0.1 (2020-02-01)\n\n- A fix.\n", false},
+		{changeLog, "1.0.1", 2, "## v1.0.1 (2020-02-01)\n\n- A fix.\n\n## 1.0\n\n" +
+			"- The first release, which reads:\n\n```\n## 2.0\n```\n", false},
+		// 1.0 must not match the section for 1.0.1, nor the heading in
+		// the code block for 2.0:
+		{changeLog, "1.0", 1, "## 1.0\n\n- The first release, which reads:\n\n```\n## 2.0\n```\n", false},
+		{changeLog, "1.0", 0, "## 1.0\n\n- The first release, which reads:\n\n```\n## 2.0\n```\n\n" +
+			"## 0.9\n\n- A beta.\n", false},
+		{changeLog, "0.9", 5, "## 0.9\n\n- A beta.\n", false},
+		// Without a section for the version, the most recent versions are
+		// kept, leaving out the unreleased changes:
+		{changeLog, "2.0", 1, "## v1.0.1 (2020-02-01)\n\n- A fix.\n", true},
+		{changeLog, "0.1", 0, "## v1.0.1 (2020-02-01)\n\n- A fix.\n\n## 1.0\n\n" +
+			"- The first release, which reads:\n\n```\n## 2.0\n```\n\n## 0.9\n\n- A beta.\n", true},
+		{"# 11.0\n\nA.\n\n# 1.0\n\nB.\n", "1.0", 1, "# 1.0\n\nB.\n", false},
+		{"Release 1.0-beta\n===\n\n# 1.0-beta: the first\n\nB.\n", "1.0-beta", 1,
+			"# 1.0-beta: the first\n\nB.\n", false},
+		// Without any headings for versions, nothing is trimmed:
+		{"# Changes\n\nMany.\n", "1.0", 1, "# Changes\n\nMany.\n", false},
+	} {
+		warnings := &bytes.Buffer{}
+		got := trimChangeLog(c.src, c.version, c.versions, warnings)
+		if got != c.want {
+			t.Errorf("trimming %q to %d versions from %s:\n got: %q\nwant: %q",
+				c.src, c.versions, c.version, got, c.want)
+		}
+		if warned := warnings.Len() != 0; warned != c.warn {
+			t.Errorf("trimming %q to %d versions from %s: got warnings %q, want warning: %v",
+				c.src, c.versions, c.version, warnings, c.warn)
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.14
 
 require (
 	github.com/tinylib/msgp v1.1.6 // indirect
+	github.com/ulikunitz/xz v0.5.7
+	gopkg.in/yaml.v3 v3.0.1
 	zenhack.net/go/sandstorm v0.0.0-20200807223653-d169734aeb58
 	zombiezen.com/go/capnproto2 v2.17.1-0.20180404044107-e89f9b7f0213+incompatible
 )
@@ -0,0 +1,198 @@
+package main
+
+import (
+	slashpath "path"
+	"sort"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// Return a copy of `manifestBytes` (the contents of sandstorm-manifest) in
+// which each command inherits the environment and working directory from
+// the image config `config`. Variables set in the package definition take
+// precedence over the image's. Settings in the image which have no effect
+// under Sandstorm are passed to `warn`. `tree` is the image's filesystem.
+func inheritImageConfig(manifestBytes []byte, config *DockerImageConfig, tree Tree, warn func(string, ...interface{})) ([]byte, error) {
+	msg, err := capnp.Unmarshal(manifestBytes)
+	if err != nil {
+		return nil, wrapErr("Unmarshalling sandstorm-manifest", err)
+	}
+	manifest, err := capnp_spk.ReadRootManifest(msg)
+	if err != nil {
+		return nil, wrapErr("Reading sandstorm-manifest", err)
+	}
+
+	commands, err := manifestCommands(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	c := config.Config
+	wrapper := workDirWrapper(tree, c.WorkingDir, warn)
+	bridgePorts := map[string]bool{}
+	for _, command := range commands {
+		if err := inheritEnv(command, c.Env); err != nil {
+			return nil, wrapErr("Setting the command's environment", err)
+		}
+		argv, err := commandArgv(command)
+		if err != nil {
+			return nil, wrapErr("Reading the command's argv", err)
+		}
+		if port := bridgePort(argv); port != "" {
+			bridgePorts[port] = true
+		}
+		if wrapper != nil {
+			if err := wrapCommand(command, argv, wrapper); err != nil {
+				return nil, wrapErr("Setting the command's argv", err)
+			}
+		}
+	}
+
+	specs := make([]string, 0, len(c.ExposedPorts))
+	for spec := range c.ExposedPorts {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		port := strings.TrimSuffix(spec, "/tcp")
+		if !bridgePorts[port] {
+			warn("the image exposes %s, but Sandstorm ignores EXPOSE; requests are only "+
+				"forwarded to the port given to sandstorm-http-bridge", spec)
+		}
+	}
+	warnIgnoredImageSettings(c, warn)
+	return marshalStruct(manifest.Struct)
+}
+
+// Return the commands in the manifest: those of its actions, and the
+// continueCommand.
+func manifestCommands(manifest capnp_spk.Manifest) ([]capnp_spk.Manifest_Command, error) {
+	commands := []capnp_spk.Manifest_Command{}
+	actions, err := manifest.Actions()
+	if err != nil {
+		return nil, wrapErr("Reading the manifest's actions", err)
+	}
+	for i := 0; i < actions.Len(); i++ {
+		command, err := actions.At(i).Command()
+		if err != nil {
+			return nil, wrapErr("Reading the manifest's actions", err)
+		}
+		commands = append(commands, command)
+	}
+	if manifest.HasContinueCommand() {
+		command, err := manifest.ContinueCommand()
+		if err != nil {
+			return nil, wrapErr("Reading the manifest's continueCommand", err)
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// Add the variables in `env` (of the form KEY=VALUE) to the command's
+// environment, unless it already sets them.
+func inheritEnv(command capnp_spk.Manifest_Command, env []string) error {
+	environ, err := command.Environ()
+	if err != nil {
+		return err
+	}
+	own := []keyValue{}
+	isSet := map[string]bool{}
+	for i := 0; i < environ.Len(); i++ {
+		key, err := environ.At(i).Key()
+		if err != nil {
+			return err
+		}
+		value, err := environ.At(i).Value()
+		if err != nil {
+			return err
+		}
+		own = append(own, keyValue{Key: key, Value: value})
+		isSet[key] = true
+	}
+	merged := []keyValue{}
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i < 0 || isSet[kv[:i]] {
+			continue
+		}
+		merged = append(merged, keyValue{Key: kv[:i], Value: kv[i+1:]})
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	merged = append(merged, own...)
+	environ, err = command.NewEnviron(int32(len(merged)))
+	if err != nil {
+		return err
+	}
+	for i, kv := range merged {
+		if err := environ.At(i).SetKey(kv.Key); err != nil {
+			return err
+		}
+		if err := environ.At(i).SetValue(kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the command's argv.
+func commandArgv(command capnp_spk.Manifest_Command) ([]string, error) {
+	list, err := command.Argv()
+	if err != nil {
+		return nil, err
+	}
+	argv := make([]string, list.Len())
+	for i := range argv {
+		if argv[i], err = list.At(i); err != nil {
+			return nil, err
+		}
+	}
+	return argv, nil
+}
+
+// Return the port given to sandstorm-http-bridge in `argv`, or "" if argv
+// doesn't run the bridge.
+func bridgePort(argv []string) string {
+	if len(argv) < 2 || slashpath.Clean(argv[0]) != "/sandstorm-http-bridge" {
+		return ""
+	}
+	if _, err := strconv.Atoi(argv[1]); err != nil {
+		return ""
+	}
+	return argv[1]
+}
+
+// Set the command's argv to `argv` with `wrapper` in front of the app's
+// command, i.e. after sandstorm-http-bridge's "--", if it runs the bridge.
+// Does nothing if the wrapper is already there.
+func wrapCommand(command capnp_spk.Manifest_Command, argv, wrapper []string) error {
+	start := 0
+	if bridgePort(argv) != "" {
+		for i, arg := range argv {
+			if arg == "--" {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if len(argv)-start >= len(wrapper) &&
+		strings.Join(argv[start:start+len(wrapper)], "\x00") == strings.Join(wrapper, "\x00") {
+		return nil
+	}
+	wrapped := append(append(append([]string{}, argv[:start]...), wrapper...), argv[start:]...)
+	list, err := command.NewArgv(int32(len(wrapped)))
+	if err != nil {
+		return err
+	}
+	for i, arg := range wrapped {
+		if err := list.Set(i, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
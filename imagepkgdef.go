@@ -0,0 +1,45 @@
+package main
+
+import (
+	slashpath "path"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+)
+
+// The label with which an image may give the location of its package
+// definition, in the same form as -pkg-def.
+const pkgDefLabel = "io.sandstorm.pkgdef"
+
+// Where we look for the package definition in an image without the
+// label.
+const defaultImagePkgDef = "/sandstorm-pkgdef.capnp"
+
+// Return the location of the package definition inside the image with
+// the config `config` and filesystem `tree`: the absolute path of the
+// file, and the name of the constant (for schema files).
+func imagePkgDefLocation(config *DockerImageConfig, tree Tree) (file, name string) {
+	spec, ok := config.Config.Labels[pkgDefLabel]
+	if !ok {
+		spec = defaultImagePkgDef
+	}
+	file, name = splitPkgDefSpec(spec)
+	file = slashpath.Join("/", file)
+	return findPkgDefFileIn(file, func(path string) bool {
+		return tree.lookup(path) != nil
+	}), name
+}
+
+// Read the package definition from the constant `name` in the file
+// `filename` inside the image filesystem `tree`, like
+// readPackageDefinition. Imports and embeds are also read from the image,
+// and may use absolute paths.
+func readImagePackageDefinition(tree Tree, filename, name string) (capnp_spk.PackageDefinition, error) {
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return capnp_spk.PackageDefinition{}, err
+	}
+	e.readFile = tree.readFile
+	e.allowAbsolute = true
+	s, err := e.evalPackageDefinition(filename, name)
+	return capnp_spk.PackageDefinition{Struct: s}, err
+}
@@ -1,17 +1,635 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
 	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
 )
 
-func initCmd() {
+// Flags for the init subcommand.
+type initFlags struct {
+	title, email, website, license string
+	port                           int
+	command                        string
+
+	// Use the key for this app id from the keyring, rather than
+	// generating a new one.
+	appKey string
+
+	out      string
+	force    bool
+	noPrompt bool
+
+	template, templateDir string
+
+	// Derive the command and environment from this docker image.
+	fromImage string
+}
+
+func (f *initFlags) Register() {
+	flag.StringVar(&f.title, "title", "", "The app's title.")
+	flag.StringVar(&f.email, "email", "", "Contact email address of the app's author.")
+	flag.StringVar(&f.website, "website", "", "The app's website.")
+	flag.StringVar(&f.license,
+		"license", "",
+		"The app's license: either the name of an open source license\n"+
+			"known to Sandstorm (e.g. apache2, mit, gpl3), or none.")
+	flag.IntVar(&f.port,
+		"port", 8000,
+		"The port on which the app listens for HTTP requests.")
+	flag.StringVar(&f.command,
+		"command", "/opt/app/start.sh",
+		"The command which starts the app, split on whitespace. It is run\n"+
+			"under sandstorm-http-bridge. {{.Port}} is replaced with the port.")
+	flag.StringVar(&f.appKey,
+		"appkey", "",
+		"Use the existing key for this app id from the keyring, instead\n"+
+			"of generating a new one.")
+	flag.StringVar(&f.out,
+		"out", "sandstorm-pkgdef.capnp",
+		"File to write the package definition to. If it ends in .yaml,\n"+
+			".yml or .json, it is written in that format.")
+	flag.BoolVar(&f.force,
+		"force", false,
+		"Overwrite the package definition if it already exists.")
+	flag.StringVar(&f.template,
+		"template", "",
+		"Also generate a Dockerfile and .dockerignore for a kind of app,\n"+
+			"and use the matching command in the package definition. Built\n"+
+			"in templates are python, node, go, php and static; use\n"+
+			"-template list to see all available templates.")
+	flag.StringVar(&f.templateDir,
+		"template-dir", defaultTemplateDir(),
+		"Directory containing user-defined templates, which take\n"+
+			"precedence over the built in ones.")
+	flag.StringVar(&f.fromImage,
+		"from-image", "",
+		"Derive the command, port and environment from the config of this\n"+
+			"docker image: either the name of an image in the running docker\n"+
+			"daemon, or a file containing the output of \"docker save\".")
+	flag.BoolVar(&f.noPrompt,
+		"no-prompt", false,
+		"Don't prompt for settings which were not given as flags, even if\n"+
+			"standard input is a terminal.")
+}
+
+func (f *initFlags) Parse() {
 	flag.Parse()
+	if flag.NArg() != 0 {
+		usageErr("init does not take any positional arguments")
+	}
+	if f.template != "" && f.fromImage != "" {
+		usageErr("Only one of -template or -from-image may be specified.")
+	}
+}
+
+// Information about the app, from which we generate the package
+// definition.
+type initInfo struct {
+	appId                          string
+	title, email, website, license string
+	port                           int
+
+	// The command and environment variables, before expanding any
+	// {{.Port}} etc.
+	argv    []string
+	environ []keyValue
+}
+
+func initCmd() {
+	iFlags := &initFlags{}
+	iFlags.Register()
+	iFlags.Parse()
+
+	if iFlags.template == "list" {
+		listTemplates(iFlags.templateDir)
+		return
+	}
+
+	info := &initInfo{
+		title:   iFlags.title,
+		email:   iFlags.email,
+		website: iFlags.website,
+		license: iFlags.license,
+		port:    iFlags.port,
+		argv:    strings.Fields(iFlags.command),
+		environ: defaultEnviron,
+	}
+	set := flagsSet()
+
+	var tmpl *initTemplate
+	if iFlags.template != "" {
+		var err error
+		tmpl, err = findTemplate(iFlags.template, iFlags.templateDir)
+		chkfatal("Finding the template", err)
+		if !set["port"] && tmpl.config.Port != 0 {
+			info.port = tmpl.config.Port
+		}
+		if !set["command"] && len(tmpl.config.Command) != 0 {
+			info.argv = tmpl.config.Command
+		}
+		if tmpl.config.Environ != nil {
+			info.environ = tmpl.config.Environ
+		}
+	}
+
+	if iFlags.fromImage != "" {
+		img, err := loadImage(iFlags.fromImage)
+		chkfatal("Reading the image", err)
+		settings, err := imageSettingsFor(img)
+		chkfatal("Reading the image's config", err)
+		if !set["title"] && settings.name != "" {
+			info.title = settings.name
+		}
+		if !set["port"] {
+			if settings.port != 0 {
+				info.port = settings.port
+			} else {
+				settings.warnings = append(settings.warnings, fmt.Sprintf(
+					"the image does not expose a port; assuming the app listens on %d "+
+						"(use -port to change this)", info.port))
+			}
+		}
+		if !set["command"] {
+			info.argv = settings.argv
+		}
+		info.environ = settings.environ
+		for _, warning := range settings.warnings {
+			warnf("%s", warning)
+		}
+	}
+
+	if !iFlags.force {
+		if _, err := os.Stat(iFlags.out); err == nil {
+			chkfatal("Creating the package definition",
+				fmt.Errorf("%s already exists (use -force to overwrite it)", iFlags.out))
+		}
+		if tmpl != nil {
+			chkfatal("Creating the template's files", tmpl.checkConflicts(filepath.Dir(iFlags.out)))
+		}
+	}
+	if info.title == "" {
+		cwd, err := os.Getwd()
+		chkfatal("Getting the current directory", err)
+		info.title = filepath.Base(cwd)
+	}
+	if info.license == "" {
+		info.license = "none"
+	}
+	if !iFlags.noPrompt && isTerminal(os.Stdin) {
+		chkfatal("Reading settings", promptInitInfo(info, set))
+	}
+	chkfatal("Checking settings", info.check())
+
+	if iFlags.appKey != "" {
+		chkfatal("Finding the app key", checkAppKey(iFlags.appKey))
+		info.appId = iFlags.appKey
+	} else {
+		appId, err := generateAppKey()
+		chkfatal("Generating app key", err)
+		info.appId = appId
+	}
+
+	data, err := info.pkgDef(iFlags.out)
+	chkfatal("Generating the package definition", err)
+	chkfatal("Writing "+iFlags.out, ioutil.WriteFile(iFlags.out, data, 0644))
+	fmt.Printf("Wrote %s for app id %s.\n", iFlags.out, info.appId)
+
+	if tmpl != nil {
+		written, err := tmpl.writeFiles(filepath.Dir(iFlags.out), info.templateData())
+		for _, path := range written {
+			fmt.Printf("Wrote %s.\n", path)
+		}
+		chkfatal("Creating the template's files", err)
+	}
+}
+
+// Return the data with which to expand templates.
+func (info *initInfo) templateData() initTemplateData {
+	return initTemplateData{Title: info.title, Port: info.port}
+}
+
+// Return the names of the flags which were set on the command line.
+func flagsSet() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// Report whether `file` is a terminal (or other character device).
+func isTerminal(file *os.File) bool {
+	fi, err := file.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Prompt the user for each of the settings in `info` whose flag is not in
+// `set`, showing the current value as the default.
+func promptInitInfo(info *initInfo, set map[string]bool) error {
+	in := bufio.NewReader(os.Stdin)
+	prompt := func(flagName, question string, value *string, check func(string) error) error {
+		if set[flagName] {
+			return nil
+		}
+		for {
+			if *value != "" {
+				fmt.Printf("%s [%s]: ", question, *value)
+			} else {
+				fmt.Printf("%s: ", question)
+			}
+			line, err := in.ReadString('\n')
+			if err != nil && line == "" {
+				return err
+			}
+			if line = strings.TrimSpace(line); line == "" {
+				line = *value
+			}
+			if err := check(line); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			*value = line
+			return nil
+		}
+	}
+	noCheck := func(string) error { return nil }
+
+	port := strconv.Itoa(info.port)
+	command := strings.Join(info.argv, " ")
+	if err := prompt("title", "App title", &info.title, checkTitle); err != nil {
+		return err
+	}
+	if err := prompt("email", "Author's email address (optional)", &info.email, checkEmail); err != nil {
+		return err
+	}
+	if err := prompt("website", "Website (optional)", &info.website, noCheck); err != nil {
+		return err
+	}
+	if err := prompt("license", "License", &info.license, checkLicense); err != nil {
+		return err
+	}
+	err := prompt("port", "HTTP port", &port, func(s string) error {
+		_, err := parsePort(s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := prompt("command", "Command to start the app", &command, checkCommand); err != nil {
+		return err
+	}
+	info.port, _ = parsePort(port)
+	if command != strings.Join(info.argv, " ") {
+		// Only re-split the command if it was changed, since the
+		// arguments may themselves contain spaces.
+		info.argv = strings.Fields(command)
+	}
+	return nil
+}
+
+// Check that the settings are valid.
+func (info *initInfo) check() error {
+	if err := checkTitle(info.title); err != nil {
+		return err
+	}
+	if err := checkEmail(info.email); err != nil {
+		return err
+	}
+	if err := checkLicense(info.license); err != nil {
+		return err
+	}
+	if _, err := parsePort(strconv.Itoa(info.port)); err != nil {
+		return err
+	}
+	return checkCommand(strings.Join(info.argv, " "))
+}
+
+func checkTitle(title string) error {
+	if title == "" {
+		return errors.New("the app title may not be empty")
+	}
+	return nil
+}
+
+func checkEmail(email string) error {
+	if email != "" && !strings.Contains(email, "@") {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	return nil
+}
+
+func checkLicense(license string) error {
+	if license == "none" {
+		return nil
+	}
+	names, err := openSourceLicenses()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == license {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown license %q; must be none or one of: %s",
+		license, strings.Join(names, ", "))
+}
+
+func checkCommand(command string) error {
+	if strings.TrimSpace(command) == "" {
+		return errors.New("the command may not be empty")
+	}
+	return nil
+}
+
+// Parse a port number.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a valid port number", s)
+	}
+	return port, nil
+}
+
+// Return the names of the open source licenses known to Sandstorm.
+func openSourceLicenses() ([]string, error) {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return nil, err
+	}
+	id, ok := idx.lookup("package.capnp", "OpenSourceLicense")
+	if !ok {
+		return nil, errors.New("OpenSourceLicense not found in the sandstorm schema")
+	}
+	info, err := idx.enumInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	return info.names, nil
+}
+
+// Check that the keyring contains a key for the app id `appId`.
+func checkAppKey(appId string) error {
+	keyring, err := spk.LoadKeyring(*keyringPath)
+	if err != nil {
+		return wrapErr("loading the sandstorm keyring", err)
+	}
+	var id spk.AppId
+	if err := (&id).UnmarshalText([]byte(appId)); err != nil {
+		return wrapErr("Parsing the app id", err)
+	}
+	_, err = keyring.GetKey(id)
+	return err
+}
+
+// Generate a new app key, add it to the keyring, and return its app id.
+func generateAppKey() (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	var appId spk.AppId
+	copy(appId[:], publicKey)
+
+	// The keyring is a sequence of KeyFile messages, so adding a key is
+	// just a matter of appending one.
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return "", err
+	}
+	keyFile, err := capnp_spk.NewRootKeyFile(seg)
+	if err != nil {
+		return "", err
+	}
+	if err := keyFile.SetPublicKey(publicKey); err != nil {
+		return "", err
+	}
+	// libsodium's private keys are the same as ed25519's: the seed
+	// followed by the public key.
+	if err := keyFile.SetPrivateKey(privateKey); err != nil {
+		return "", err
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(*keyringPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", wrapErr("opening the sandstorm keyring", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", wrapErr("writing the sandstorm keyring", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", wrapErr("writing the sandstorm keyring", err)
+	}
+
+	// Make sure the key reads back:
+	id := appId.String()
+	return id, checkAppKey(id)
+}
+
+// Generate the package definition, in the format indicated by the
+// extension of `filename`. The result is checked against the schema.
+func (info *initInfo) pkgDef(filename string) ([]byte, error) {
+	data := info.templateData()
+	argv := listNode(
+		stringNode("/sandstorm-http-bridge"),
+		stringNode(strconv.Itoa(info.port)),
+		stringNode("--"),
+	)
+	for _, arg := range info.argv {
+		arg, err := expandTemplate("command", arg, data)
+		if err != nil {
+			return nil, err
+		}
+		argv.elems = append(argv.elems, stringNode(arg))
+	}
+	environ := listNode()
+	for _, kv := range info.environ {
+		value, err := expandTemplate(kv.Key, kv.Value, data)
+		if err != nil {
+			return nil, err
+		}
+		environ.elems = append(environ.elems, mapNode(
+			&dataField{key: "key", value: stringNode(kv.Key)},
+			&dataField{key: "value", value: stringNode(value)},
+		))
+	}
+	command := mapNode()
+	command.set("argv", argv)
+	command.set("environ", environ)
+
+	metadata := mapNode()
+	if info.website != "" {
+		metadata.set("website", stringNode(info.website))
+	}
+	if info.license == "none" {
+		metadata.set("license", singletonMap("none", &dataNode{kind: dataNull}))
+	} else {
+		metadata.set("license", singletonMap("openSource", plainNode(info.license)))
+	}
+	if info.email != "" {
+		metadata.set("author", singletonMap("contactEmail", stringNode(info.email)))
+	}
+
+	manifest := mapNode()
+	manifest.set("appTitle", stringNode(info.title))
+	manifest.set("appVersion", plainNode("0"))
+	manifest.set("appMarketingVersion", stringNode("0.0.1"))
+	// The metadata and the actions' nounPhrase need this version:
+	manifest.set("minApiVersion", plainNode(strconv.Itoa(int(apiVersionFields["manifest.metadata"]))))
+	manifest.set("metadata", metadata)
+	manifest.set("actions", listNode(mapNode(
+		&dataField{key: "nounPhrase", value: stringNode("instance")},
+		&dataField{key: "command", value: command},
+	)))
+	manifest.set("continueCommand", command)
+
+	pkgDef := mapNode()
+	pkgDef.set("id", stringNode(info.appId))
+	pkgDef.set("manifest", manifest)
+
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.evalDataNode(pkgDef, filename, capnp_spk.PackageDefinition_TypeID); err != nil {
+		return nil, err
+	}
+	if pkgDefFormat(filename) == "capnp" {
+		return initCapnpPkgDef(e.schema, filename, pkgDef)
+	}
+	buf := &bytes.Buffer{}
+	err = writePkgDefData(buf, e.schema, pkgDef, pkgDefFormat(filename), "pkgdef")
+	return buf.Bytes(), err
+}
+
+// The package definition written by init in the schema language. Unlike
+// JSON and YAML, it has comments explaining the fields, and the command
+// is a constant shared by the action and continueCommand.
+var initCapnpTemplate = template.Must(template.New("sandstorm-pkgdef.capnp").Parse(`@0x{{.FileId}};
+
+using Spk = import "/sandstorm/package.capnp";
+# This imports Sandstorm's package.capnp, which documents every field
+# of the package definition in detail.
+
+const pkgdef :Spk.PackageDefinition = (
+  # The app's id, which is the public half of its key in your keyring
+  # (~/.sandstorm-keyring by default). Only packages signed with the key
+  # are accepted as updates to the app, so keep it safe.
+  id = {{.Id}},
+
+  manifest = (
+    # The app's name, as shown in Sandstorm's app list.
+    appTitle = (defaultText = {{.Title}}),
+
+    # Increment this for every release: Sandstorm only accepts a package
+    # as an update if its appVersion is higher than the installed one.
+    appVersion = 0,
+
+    # The version shown to users, which can be anything.
+    appMarketingVersion = (defaultText = "0.0.1"),
+
+    # The oldest version of Sandstorm (as a build number) the app works
+    # with; see "API versions" in docker-spk's README.
+    minApiVersion = {{.MinApiVersion}},
+
+    # Information for the app market, such as the license, website and
+    # author. Icons, screenshots and a description also go here.
+    metadata = {{.Metadata}},
+
+    # The ways to create a new grain (instance) of the app, each listed
+    # in Sandstorm's "new" menu.
+    actions = [
+      ( nounPhrase = (defaultText = "instance"),
+        command = .myCommand
+      )
+    ],
+
+    # The command which starts an existing grain again.
+    continueCommand = .myCommand,
+  ),
+);
+
+# The command which runs the app. sandstorm-http-bridge starts the app
+# and forwards Sandstorm's requests to the port it listens on.
+const myCommand :Spk.Manifest.Command = {{.Command}};
+`))
+
+// Return the value of the field `name` in the struct literal `v`, or nil
+// if it is not set.
+func structField(v *valueExpr, name string) *valueExpr {
+	for _, f := range v.fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// Write `pkgDef`, as built by initInfo.pkgDef, using initCapnpTemplate.
+// The result is evaluated, to check it against the schema.
+func initCapnpPkgDef(idx *schemaIndex, filename string, pkgDef *dataNode) ([]byte, error) {
+	t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	v, err := dataToValue(idx, t, pkgDef)
+	if err != nil {
+		return nil, err
+	}
+	manifest := structField(v, "manifest")
+	fileId, err := newCapnpFileId()
+	if err != nil {
+		return nil, err
+	}
+	value := func(v *valueExpr) string {
+		buf := &bytes.Buffer{}
+		writeCapnpValue(buf, v, "    ")
+		return buf.String()
+	}
+	command := &bytes.Buffer{}
+	writeCapnpValue(command, structField(manifest, "continueCommand"), "")
+	buf := &bytes.Buffer{}
+	err = initCapnpTemplate.Execute(buf, map[string]string{
+		"FileId":        fmt.Sprintf("%x", fileId),
+		"Id":            capnpQuote(scalarText(fieldNode(pkgDef, "id"))),
+		"Title":         capnpQuote(scalarText(fieldNode(fieldNode(pkgDef, "manifest"), "appTitle"))),
+		"MinApiVersion": scalarText(fieldNode(fieldNode(pkgDef, "manifest"), "minApiVersion")),
+		"Metadata":      value(structField(manifest, "metadata")),
+		"Command":       command.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	pkgdef, err := spk.NewApp()
-	chkfatal("Generating app info", err)
-	pkgdef.KeyringPath = *keyringPath
-	pkgdef.PkgDefPath = "sandstorm-pkgdef.capnp"
-	chkfatal("Emitting app scaffolding", pkgdef.Emit())
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	e.readFile = func(path string) ([]byte, error) {
+		if filepath.Clean(path) == filepath.Clean(filename) {
+			return buf.Bytes(), nil
+		}
+		return ioutil.ReadFile(path)
+	}
+	if _, err := e.evalPackageDefinition(filename, "pkgdef"); err != nil {
+		return nil, wrapErr("Checking the generated package definition", err)
+	}
+	return buf.Bytes(), nil
 }
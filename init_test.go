@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The package definition init writes in the schema language should have
+// the same contents as the one it writes in YAML, with the command
+// shared by a constant.
+func TestInitPkgDef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-spk-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &initInfo{
+		appId:   "8anwd8gxasmhav7uu869eamag7rqhxczd86a6fcz5nktuk02mkth",
+		title:   `Hello "Flask"`,
+		email:   "me@example.com",
+		license: "apache2",
+		port:    8000,
+		argv:    []string{"/app/run", "--port", "{{.Port}}"},
+		environ: defaultEnviron,
+	}
+	pkgDefs := map[string]string{}
+	for _, format := range []string{"capnp", "yaml"} {
+		filename := filepath.Join(dir, "sandstorm-pkgdef."+format)
+		data, err := info.pkgDef(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		pkgDefs[format] = pkgDefJSON(t, filename)
+
+		if format == "capnp" {
+			src := string(data)
+			if n := strings.Count(src, "command = .myCommand"); n != 1 {
+				t.Errorf("the action's command refers to myCommand %d times, want 1:\n%s", n, src)
+			}
+			if !strings.Contains(src, "continueCommand = .myCommand,") {
+				t.Errorf("continueCommand does not refer to myCommand:\n%s", src)
+			}
+			if !strings.Contains(src, "# The app's name") {
+				t.Errorf("the fields have no comments:\n%s", src)
+			}
+		}
+	}
+	if pkgDefs["capnp"] != pkgDefs["yaml"] {
+		t.Errorf("the capnp package definition is:\n%s\nbut the YAML one is:\n%s",
+			pkgDefs["capnp"], pkgDefs["yaml"])
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// Support for init -from-image, which derives the package definition's
+// command and environment from the config of an existing docker image.
+
+// Settings for the package definition derived from a docker image.
+type imageSettings struct {
+	// The name of the image, from its first tag, or "" if it has none.
+	name string
+
+	// The port to forward requests to, or 0 if the image doesn't expose
+	// one.
+	port int
+
+	// The command and environment variables, escaped so that they are
+	// unchanged by expandTemplate.
+	argv    []string
+	environ []keyValue
+
+	// Things about the image which won't work under Sandstorm.
+	warnings []string
+}
+
+// The PATH docker uses if the image doesn't set one.
+const dockerDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Load the docker image `ref`, which is either a file containing the
+// output of "docker save", or the name of an image in the running docker
+// daemon.
+func loadImage(ref string) (*DockerImage, error) {
+	if _, err := os.Stat(ref); err == nil {
+		return readDockerImageFile(ref, true)
+	}
+	return readDockerImageFromDaemon(ref, true)
+}
+
+// Derive settings for the package definition from the docker image `img`.
+func imageSettingsFor(img *DockerImage) (*imageSettings, error) {
+	config, err := img.config()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := img.toTree()
+	if err != nil {
+		return nil, err
+	}
+	c := config.Config
+	s := &imageSettings{}
+	warn := func(format string, args ...interface{}) {
+		s.warnings = append(s.warnings, fmt.Sprintf(format, args...))
+	}
+
+	if tags := img.Manifest[len(img.Manifest)-1].RepoTags; len(tags) > 0 {
+		s.name = imageBaseName(tags[0])
+	}
+	s.port = imagePort(c.ExposedPorts, warn)
+
+	path, home := "", ""
+	for _, kv := range c.Env {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := kv[:i], kv[i+1:]
+		switch key {
+		case "PATH":
+			path = value
+		case "HOME":
+			home = value
+		}
+		s.environ = append(s.environ, keyValue{Key: key, Value: escapeTemplate(value)})
+	}
+	if path == "" {
+		path = dockerDefaultPath
+		s.environ = append([]keyValue{{Key: "PATH", Value: path}}, s.environ...)
+	}
+	switch {
+	case home == "":
+		s.environ = append(s.environ, keyValue{Key: "HOME", Value: "/var"})
+	case !isUnderVar(home):
+		warn("HOME is set to %s, but only /var is writable under Sandstorm", home)
+	}
+
+	argv := append(append([]string{}, c.Entrypoint...), c.Cmd...)
+	if len(argv) == 0 {
+		return nil, errors.New("the image has no ENTRYPOINT or CMD; use -command to say how to start the app")
+	}
+	dir := c.WorkingDir
+	if dir == "" {
+		dir = "/"
+	}
+	argv[0] = resolveImageCommand(tree, argv[0], path, dir, warn)
+	if wrapper := workDirWrapper(tree, dir, warn); wrapper != nil {
+		argv = append(wrapper, argv...)
+	}
+	for _, arg := range argv {
+		s.argv = append(s.argv, escapeTemplate(arg))
+	}
+
+	if tree.lookup("/sandstorm-http-bridge") == nil {
+		warn("the image does not contain /sandstorm-http-bridge, which must run the app; "+
+			"base the image on %s, or copy the binary into it", templateBaseImage)
+	}
+	warnIgnoredImageSettings(c, warn)
+	return s, nil
+}
+
+// Pass a warning to `warn` for each of the image settings `c` which have
+// no effect under Sandstorm, other than ExposedPorts.
+func warnIgnoredImageSettings(c DockerContainerConfig, warn func(string, ...interface{})) {
+	if c.User != "" && c.User != "root" && c.User != "0" && c.User != "0:0" {
+		warn("the image runs as user %s, but Sandstorm ignores USER", c.User)
+	}
+	volumes := make([]string, 0, len(c.Volumes))
+	for volume := range c.Volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		if !isUnderVar(volume) {
+			warn("the image declares a volume at %s, but Sandstorm ignores VOLUME; "+
+				"only /var is writable and kept between runs", volume)
+		}
+	}
+	if c.Healthcheck != nil && len(c.Healthcheck.Test) > 0 && c.Healthcheck.Test[0] != "NONE" {
+		warn("Sandstorm ignores the image's HEALTHCHECK")
+	}
+	if c.StopSignal != "" {
+		warn("Sandstorm ignores the image's STOPSIGNAL")
+	}
+}
+
+// Return the arguments to put in front of a command to run it in the
+// directory `dir`, since Sandstorm always starts commands in /. Returns
+// nil if no wrapper is needed, or if `tree` has no shell with which to
+// change directories (in which case a warning is passed to `warn`).
+func workDirWrapper(tree Tree, dir string, warn func(string, ...interface{})) []string {
+	if dir == "" || slashpath.Clean(dir) == "/" {
+		return nil
+	}
+	if tree.lookup("/bin/sh") == nil {
+		warn("the image's working directory is %s, but there is no /bin/sh with which "+
+			"to change to it; the command will be run in /", dir)
+		return nil
+	}
+	return []string{"/bin/sh", "-c", "cd " + shellQuote(dir) + ` && exec "$@"`, "sh"}
+}
+
+// Return the base name of the image reference `ref`, without any
+// registry, repository path, tag or digest, e.g. "app" for
+// "example.com/org/app:1.0".
+func imageBaseName(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	ref = ref[strings.LastIndex(ref, "/")+1:]
+	if i := strings.Index(ref, ":"); i >= 0 {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// Return the port to forward requests to, chosen from the image's exposed
+// ports (keys like "8080/tcp"), or 0 if there are none.
+func imagePort(exposed map[string]struct{}, warn func(string, ...interface{})) int {
+	specs := make([]string, 0, len(exposed))
+	for spec := range exposed {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	ports := []int{}
+	for _, spec := range specs {
+		portStr, proto := spec, "tcp"
+		if i := strings.Index(spec, "/"); i >= 0 {
+			portStr, proto = spec[:i], spec[i+1:]
+		}
+		port, err := parsePort(portStr)
+		if err != nil || proto != "tcp" {
+			warn("the image exposes %s, but under Sandstorm the app can only receive "+
+				"HTTP requests on a single TCP port", spec)
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 0 {
+		return 0
+	}
+	sort.Ints(ports)
+	if len(ports) > 1 {
+		warn("the image exposes several TCP ports, but only one can receive requests "+
+			"under Sandstorm; using %d (use -port to choose another)", ports[0])
+	}
+	return ports[0]
+}
+
+// Return the absolute path of the executable `name` in `tree`. Like the
+// shell, names without a slash are looked up in the directories in
+// `path`, and other relative names are relative to `dir`. If there is no
+// such executable, `name` is returned unchanged, with a warning.
+func resolveImageCommand(tree Tree, name, path, dir string, warn func(string, ...interface{})) string {
+	candidates := []string{}
+	switch {
+	case strings.HasPrefix(name, "/"):
+		candidates = append(candidates, name)
+	case strings.Contains(name, "/"):
+		candidates = append(candidates, slashpath.Join(dir, name))
+	default:
+		for _, d := range strings.Split(path, ":") {
+			if d != "" {
+				candidates = append(candidates, slashpath.Join(d, name))
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if f := tree.lookup(candidate); f != nil && f.data != nil && f.isExe {
+			if isUnderVar(candidate) {
+				warn("the command %s is under /var, which is replaced with an empty "+
+					"directory when the app is packed", candidate)
+			}
+			return candidate
+		}
+	}
+	warn("the command %s was not found in the image, or is not executable", name)
+	return name
+}
+
+// Report whether the absolute path `p` is /var or inside it.
+func isUnderVar(p string) bool {
+	p = slashpath.Clean(p)
+	return p == "/var" || strings.HasPrefix(p, "/var/")
+}
+
+// Return `s` quoted for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Return `s` escaped so that expandTemplate leaves it unchanged.
+func escapeTemplate(s string) string {
+	return strings.ReplaceAll(s, "{{", "{{`{{`}}")
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+)
+
+// Templates for init -template. Each template provides a Dockerfile and
+// .dockerignore (and possibly other files) for a kind of app, along with
+// the command and environment with which the package definition should
+// start it.
+//
+// Besides the templates built in to docker-spk, users may add their own,
+// or override the built in ones, by creating a directory for each under
+// the template directory (see defaultTemplateDir). The directory contains
+// the template's files, plus a template.json containing its
+// templateConfig, e.g.:
+//
+//     {
+//       "description": "A Ruby app served by puma",
+//       "port": 8000,
+//       "command": ["/usr/bin/puma", "-b", "tcp://127.0.0.1:{{.Port}}"],
+//       "environ": [{"key": "HOME", "value": "/var"}]
+//     }
+//
+// The files, the command and the values of the environment variables
+// are expanded as text/templates, with initTemplateData as their data.
+
+// An init template.
+type initTemplate struct {
+	name   string
+	config templateConfig
+
+	// The template's files, by path relative to the app's directory.
+	files map[string]string
+
+	// The files (by the same paths) which should be executable.
+	executable map[string]bool
+}
+
+// The settings for a template, from its template.json.
+type templateConfig struct {
+	// A one-line description, for -template list.
+	Description string `json:"description"`
+
+	// The default port and command, if they are not given as flags.
+	Port    int      `json:"port"`
+	Command []string `json:"command"`
+
+	// Environment variables with which to run the command.
+	Environ []keyValue `json:"environ"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// The data with which a template's files are expanded.
+type initTemplateData struct {
+	Title string
+	Port  int
+}
+
+// The environment used if there is no template.
+var defaultEnviron = []keyValue{
+	{Key: "PATH", Value: "/usr/local/bin:/usr/bin:/bin"},
+	{Key: "HOME", Value: "/var"},
+}
+
+// Return defaultEnviron, followed by `extra`.
+func withDefaultEnviron(extra ...keyValue) []keyValue {
+	return append(append([]keyValue{}, defaultEnviron...), extra...)
+}
+
+// Return the default directory in which to look for user-defined
+// templates.
+func defaultTemplateDir() string {
+	if dir := os.Getenv("DOCKER_SPK_TEMPLATES"); dir != "" {
+		return dir
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "docker-spk", "templates")
+}
+
+// Return the template named `name`, looking first in `dir`, and then at
+// the built in templates.
+func findTemplate(name, dir string) (*initTemplate, error) {
+	if dir != "" {
+		tmpl, err := loadTemplate(filepath.Join(dir, name))
+		if err == nil || !os.IsNotExist(err) {
+			return tmpl, wrapErr("Loading template "+name, err)
+		}
+	}
+	if tmpl, ok := builtinTemplates[name]; ok {
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("no template named %q (see -template list)", name)
+}
+
+// Load a template from the directory `dir`.
+func loadTemplate(dir string) (*initTemplate, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "template.json"))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &initTemplate{
+		name:       filepath.Base(dir),
+		files:      map[string]string{},
+		executable: map[string]bool{},
+	}
+	if err := json.Unmarshal(data, &tmpl.config); err != nil {
+		return nil, wrapErr("Parsing template.json", err)
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "template.json" {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl.files[rel] = string(data)
+		tmpl.executable[rel] = info.Mode()&0111 != 0
+		return nil
+	})
+	return tmpl, err
+}
+
+// Print the available templates to stdout.
+func listTemplates(dir string) {
+	descriptions := map[string]string{}
+	for name, tmpl := range builtinTemplates {
+		descriptions[name] = tmpl.config.Description
+	}
+	if dir != "" {
+		fis, _ := ioutil.ReadDir(dir)
+		for _, fi := range fis {
+			tmpl, err := loadTemplate(filepath.Join(dir, fi.Name()))
+			if err == nil {
+				descriptions[tmpl.name] = tmpl.config.Description + " (from " + dir + ")"
+			}
+		}
+	}
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-10s %s\n", name, descriptions[name])
+	}
+}
+
+// Expand `text` as a template with the given data. `name` is used in
+// error messages.
+func expandTemplate(name, text string, data initTemplateData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Return the paths of the template's files, sorted.
+func (tmpl *initTemplate) paths() []string {
+	paths := make([]string, 0, len(tmpl.files))
+	for path := range tmpl.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Return an error if any of the template's files already exist in `dir`.
+func (tmpl *initTemplate) checkConflicts(dir string) error {
+	for _, path := range tmpl.paths() {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			return fmt.Errorf("%s already exists (use -force to overwrite it)",
+				filepath.Join(dir, path))
+		}
+	}
+	return nil
+}
+
+// Write the template's files to `dir`, expanded with `data`, overwriting
+// any existing files. Returns the paths of the files written.
+func (tmpl *initTemplate) writeFiles(dir string, data initTemplateData) ([]string, error) {
+	paths := tmpl.paths()
+	// Expand everything before writing anything, so an error in the
+	// template doesn't leave us with half of it.
+	contents := make([]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if contents[i], err = expandTemplate(path, tmpl.files[path], data); err != nil {
+			return nil, err
+		}
+	}
+	written := []string{}
+	for i, path := range paths {
+		dst := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return written, err
+		}
+		mode := os.FileMode(0644)
+		if tmpl.executable[path] {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(dst, []byte(contents[i]), mode); err != nil {
+			return written, err
+		}
+		written = append(written, dst)
+	}
+	return written, nil
+}
+
+// The base image for the built in templates, which contains just
+// sandstorm-http-bridge on top of alpine; see
+// base-images/sandstorm-http-bridge.
+const templateBaseImage = "zenhack/sandstorm-http-bridge:276"
+
+// Files and paths which should never be sent to docker as part of the
+// build context.
+const commonDockerignore = `.git
+*.spk
+*.build-state
+sandstorm-pkgdef.*
+Dockerfile
+.dockerignore
+`
+
+// A note at the top of each Dockerfile.
+const dockerfileHeader = `# Dockerfile for {{.Title}}.
+#
+# Only the filesystem of the resulting image is used to build the app;
+# instructions like CMD, EXPOSE and USER have no effect. The command which
+# starts the app is set in the package definition instead, and is run
+# under sandstorm-http-bridge, which forwards requests to port {{.Port}}.
+#
+# Inside Sandstorm, the whole filesystem is read-only except for /var,
+# which starts out empty for each grain.
+`
+
+var builtinTemplates = map[string]*initTemplate{
+	"python": {
+		name: "python",
+		config: templateConfig{
+			Description: "A Python WSGI app, served by gunicorn",
+			Port:        8000,
+			Command: []string{
+				"/app/.venv/bin/gunicorn",
+				"--bind", "127.0.0.1:{{.Port}}",
+				"app:app",
+			},
+			Environ: withDefaultEnviron(
+				keyValue{Key: "PYTHONUNBUFFERED", Value: "1"},
+			),
+		},
+		files: map[string]string{
+			"Dockerfile": dockerfileHeader + `
+FROM ` + templateBaseImage + ` as builder
+
+RUN apk add python3 python3-dev py3-virtualenv build-base
+
+WORKDIR /app
+RUN virtualenv .venv
+RUN .venv/bin/pip install gunicorn
+COPY . ./
+RUN if [ -f requirements.txt ]; then .venv/bin/pip install -r requirements.txt; fi
+
+FROM ` + templateBaseImage + `
+RUN apk add python3
+COPY --from=builder /app /app
+`,
+			".dockerignore": commonDockerignore + `.venv
+__pycache__
+*.pyc
+`,
+		},
+	},
+	"node": {
+		name: "node",
+		config: templateConfig{
+			Description: "A Node.js app, started with node index.js",
+			Port:        8000,
+			Command:     []string{"/usr/bin/node", "/app/index.js"},
+			Environ: withDefaultEnviron(
+				keyValue{Key: "PORT", Value: "{{.Port}}"},
+				keyValue{Key: "NODE_ENV", Value: "production"},
+			),
+		},
+		files: map[string]string{
+			"Dockerfile": dockerfileHeader + `
+FROM ` + templateBaseImage + `
+
+RUN apk add nodejs npm
+
+WORKDIR /app
+COPY package*.json ./
+RUN npm install --production
+COPY . ./
+`,
+			".dockerignore": commonDockerignore + `node_modules
+`,
+		},
+	},
+	"go": {
+		name: "go",
+		config: templateConfig{
+			Description: "A Go app, built as a static binary",
+			Port:        8000,
+			Command:     []string{"/app/server"},
+			Environ: withDefaultEnviron(
+				keyValue{Key: "PORT", Value: "{{.Port}}"},
+			),
+		},
+		files: map[string]string{
+			"Dockerfile": dockerfileHeader + `
+FROM golang:1.16-alpine as builder
+
+WORKDIR /src
+COPY go.* ./
+RUN go mod download
+COPY . ./
+RUN CGO_ENABLED=0 go build -o /app/server .
+
+FROM ` + templateBaseImage + `
+COPY --from=builder /app /app
+`,
+			".dockerignore": commonDockerignore,
+		},
+	},
+	"php": {
+		name: "php",
+		config: templateConfig{
+			Description: "A PHP app, served by PHP's built in web server",
+			Port:        8000,
+			Command: []string{
+				"/usr/bin/php7",
+				"-S", "127.0.0.1:{{.Port}}",
+				"-t", "/app",
+				"-d", "session.save_path=/var",
+			},
+			Environ: defaultEnviron,
+		},
+		files: map[string]string{
+			"Dockerfile": dockerfileHeader + `
+FROM ` + templateBaseImage + `
+
+RUN apk add php7 php7-session php7-json php7-sqlite3 php7-pdo_sqlite
+
+WORKDIR /app
+COPY . ./
+`,
+			".dockerignore": commonDockerignore,
+		},
+	},
+	"static": {
+		name: "static",
+		config: templateConfig{
+			Description: "A static website, served by busybox httpd",
+			Port:        8000,
+			Command: []string{
+				"/bin/busybox-extras", "httpd", "-f",
+				"-p", "127.0.0.1:{{.Port}}",
+				"-h", "/srv/www",
+			},
+			Environ: defaultEnviron,
+		},
+		files: map[string]string{
+			"Dockerfile": dockerfileHeader + `
+FROM ` + templateBaseImage + `
+
+RUN apk add busybox-extras
+
+COPY . /srv/www
+`,
+			".dockerignore": commonDockerignore,
+		},
+	},
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// This file implements translating the texts in the manifest and bridge
+// config (the LocalizedTexts, such as the app's title and the names of
+// its actions and permissions) with gettext PO files. `docker-spk l10n
+// extract` writes the texts to a POT file, from which translators create
+// a PO file for each locale; the -po-dir flag of build and pack then adds
+// the translations to the package.
+
+// LocalizedTexts which are not meant to be translated.
+var untranslatedTexts = map[string]bool{
+	"manifest.appMarketingVersion": true,
+}
+
+func l10nCmd() {
+	pkgDef := flag.String("pkg-def", "sandstorm-pkgdef.capnp:pkgdef",
+		"The package definition, of the form <def-file>:<name>, as for the\n"+
+			"build command.")
+	out := flag.String("out", "",
+		"For extract, the file to write the template to (default stdout).")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s l10n [-pkg-def <file>] [-out <file.pot>] extract\n"+
+				"       %s l10n [-pkg-def <file>] status <po-dir>\n\n"+
+				"extract writes the translatable texts of the manifest and bridge\n"+
+				"config to a gettext POT file. status reports which of them are\n"+
+				"missing from the PO files in <po-dir>, for each locale. Pass\n"+
+				"-po-dir <po-dir> to build or pack to add the translations to the\n"+
+				"package.\n\n",
+			os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	file, name := splitPkgDefSpec(*pkgDef)
+	switch flag.Arg(0) {
+	case "extract":
+		if flag.NArg() != 1 {
+			usageErr("l10n extract takes no arguments")
+		}
+		msgs, err := extractMessages(file, name)
+		chkfatal("Extracting the texts", err)
+		buf := &bytes.Buffer{}
+		chkfatal("Writing the template", writePOT(buf, msgs))
+		if *out == "" {
+			os.Stdout.Write(buf.Bytes())
+		} else {
+			chkfatal("Writing "+*out, ioutil.WriteFile(*out, buf.Bytes(), 0644))
+		}
+	case "status":
+		if flag.NArg() != 2 {
+			usageErr("l10n status takes the directory containing the PO files")
+		}
+		msgs, err := extractMessages(file, name)
+		chkfatal("Extracting the texts", err)
+		cats, err := loadPOFiles(flag.Arg(1))
+		chkfatal("Reading the translations", err)
+		if len(cats) == 0 {
+			fmt.Printf("There are no PO files in %s.\n", flag.Arg(1))
+		}
+		for _, cat := range cats {
+			missing := []poMessage{}
+			for _, msg := range msgs {
+				if _, ok := cat.messages[msg.id]; !ok {
+					missing = append(missing, msg)
+				}
+			}
+			fmt.Printf("%s: %d of %d texts translated\n", cat.locale, len(msgs)-len(missing), len(msgs))
+			for _, msg := range missing {
+				fmt.Printf("    %s: %s\n", msg.refs[0], strconv.Quote(msg.id))
+			}
+		}
+	default:
+		usageErr("l10n takes a command: extract or status")
+	}
+}
+
+// Return the translatable texts in the package definition, in the order
+// they first appear.
+func extractMessages(pkgDefFile, pkgDefVar string) ([]poMessage, error) {
+	metadata, err := getPkgMetadata(pkgDefFile, pkgDefVar, metadataOptions{
+		changeLogVersions: defaultChangeLogVersions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := []poMessage{}
+	index := map[string]int{}
+	err = visitMetadataTexts(metadata, func(path string, text util.LocalizedText) error {
+		s, err := text.DefaultText()
+		if err != nil || s == "" {
+			return err
+		}
+		i, ok := index[s]
+		if !ok {
+			i = len(msgs)
+			index[s] = i
+			msgs = append(msgs, poMessage{id: s})
+		}
+		msgs[i].refs = append(msgs[i].refs, path)
+		return nil
+	})
+	return msgs, err
+}
+
+// Call fn on each translatable text in the manifest and bridge config of
+// `m`, along with its path, as used by the pkgdef command.
+func visitMetadataTexts(m *pkgMetadata, fn func(path string, text util.LocalizedText) error) error {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return err
+	}
+	for _, part := range []struct {
+		field string
+		data  []byte
+	}{
+		{"manifest", m.manifest},
+		{"bridgeConfig", m.bridgeCfg},
+	} {
+		msg, err := capnp.Unmarshal(part.data)
+		if err != nil {
+			return wrapErr("Unmarshalling the "+part.field, err)
+		}
+		root, err := msg.RootPtr()
+		if err != nil {
+			return wrapErr("Reading the "+part.field, err)
+		}
+		if err := visitLocalizedTexts(idx, part.field, root.Struct(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call fn on each LocalizedText which is set in `s`, the field `field` of
+// the PackageDefinition, or any struct within it, except those in
+// untranslatedTexts.
+func visitLocalizedTexts(idx *schemaIndex, field string, s capnp.Struct, fn func(path string, text util.LocalizedText) error) error {
+	pkgDefType := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	_, t, err := fieldAndType(idx, pkgDefType, field)
+	if err != nil {
+		return err
+	}
+	return visitStructTexts(idx, t.id, s, field, fn)
+}
+
+// Like visitLocalizedTexts, but for `s` of the struct type (or group) with
+// the type id `id`, whose path is `path`.
+func visitStructTexts(idx *schemaIndex, id uint64, s capnp.Struct, path string, fn func(path string, text util.LocalizedText) error) error {
+	info, err := idx.structInfo(id)
+	if err != nil {
+		return err
+	}
+	which := s.Uint16(capnp.DataOffset(info.discriminantOffset * 2))
+	visit := func(t *capnpType, s capnp.Struct, path string) error {
+		if isLocalizedText(idx, t) {
+			if untranslatedTexts[path] {
+				return nil
+			}
+			return fn(path, util.LocalizedText{Struct: s})
+		}
+		return visitStructTexts(idx, t.id, s, path, fn)
+	}
+	for _, field := range info.fields {
+		if field.inUnion() && field.discriminant != which {
+			continue
+		}
+		fieldPath := path + "." + field.name
+		if field.group != 0 {
+			if err := visitStructTexts(idx, field.group, s, fieldPath, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		t := field.typ
+		if t.isData() || !s.HasPtr(uint16(field.offset)) {
+			continue
+		}
+		p, err := s.Ptr(uint16(field.offset))
+		if err != nil {
+			return err
+		}
+		switch {
+		case t.which == schema.Type_Which_structType:
+			err = visit(t, p.Struct(), fieldPath)
+		case t.which == schema.Type_Which_list && t.elem.which == schema.Type_Which_structType:
+			l := p.List()
+			for i := 0; i < l.Len() && err == nil; i++ {
+				err = visit(t.elem, l.Struct(i), fieldPath+"."+strconv.Itoa(i))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the translations from the PO files in `dir` to the texts in the
+// manifest and bridge config.
+func addPOTranslations(dir string, manifest capnp_spk.Manifest, bridgeCfg capnp_spk.BridgeConfig) error {
+	idx, err := sandstormSchema()
+	if err != nil {
+		return err
+	}
+	cats, err := loadPOFiles(dir)
+	if err != nil {
+		return err
+	}
+	if err := addTranslations(idx, "manifest", manifest.Struct, cats); err != nil {
+		return err
+	}
+	return addTranslations(idx, "bridgeConfig", bridgeCfg.Struct, cats)
+}
+
+// Add the translations from `cats` to each LocalizedText in `s`, the
+// field `field` of the package definition. Locales for which the package
+// definition already has a localization are left alone.
+func addTranslations(idx *schemaIndex, field string, s capnp.Struct, cats []*poCatalog) error {
+	return visitLocalizedTexts(idx, field, s, func(path string, text util.LocalizedText) error {
+		defaultText, err := text.DefaultText()
+		if err != nil || defaultText == "" {
+			return err
+		}
+		list, err := text.Localizations()
+		if err != nil {
+			return wrapErr("Reading the localizations of "+path, err)
+		}
+		type localization struct{ locale, text string }
+		all := []localization{}
+		have := map[string]bool{}
+		for i := 0; i < list.Len(); i++ {
+			locale, err := list.At(i).Locale()
+			if err != nil {
+				return err
+			}
+			s, err := list.At(i).Text()
+			if err != nil {
+				return err
+			}
+			all = append(all, localization{locale: locale, text: s})
+			have[locale] = true
+		}
+		added := false
+		for _, cat := range cats {
+			if s, ok := cat.messages[defaultText]; ok && !have[cat.locale] {
+				all = append(all, localization{locale: cat.locale, text: s})
+				added = true
+			}
+		}
+		if !added {
+			return nil
+		}
+		list, err = text.NewLocalizations(int32(len(all)))
+		if err != nil {
+			return wrapErr("Setting the localizations of "+path, err)
+		}
+		for i, l := range all {
+			if err := list.At(i).SetLocale(l.locale); err != nil {
+				return err
+			}
+			if err := list.At(i).SetText(l.text); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
+)
+
+// The OCI image labels from which the manifest may be filled in; see
+// https://github.com/opencontainers/image-spec/blob/main/annotations.md
+const (
+	labelTitle    = "org.opencontainers.image.title"
+	labelVersion  = "org.opencontainers.image.version"
+	labelSource   = "org.opencontainers.image.source"
+	labelURL      = "org.opencontainers.image.url"
+	labelLicenses = "org.opencontainers.image.licenses"
+	labelAuthors  = "org.opencontainers.image.authors"
+)
+
+// A manifest field which was filled in from an image label.
+type labelField struct {
+	field, label string
+}
+
+// The open source licenses known to Sandstorm, by their SPDX identifiers.
+// These match the osiInfo annotations on OpenSourceLicense.
+var spdxLicenses = map[string]string{
+	"MIT":          "mit",
+	"Apache-2.0":   "apache2",
+	"GPL-3.0":      "gpl3",
+	"AGPL-3.0":     "agpl3",
+	"BSD-3-Clause": "bsd3Clause",
+	"BSD-2-Clause": "bsd2Clause",
+	"GPL-2.0":      "gpl2",
+	"LGPL-2.1":     "lgpl2",
+	"LGPL-3.0":     "lgpl3",
+	"ISC":          "isc",
+	"Artistic-2.0": "artistic2",
+	"Python-2.0":   "python2",
+	"PHP-3.0":      "php3",
+	"MPL-2.0":      "mpl2",
+	"CDDL-1.0":     "cddl",
+	"EPL-1.0":      "epl",
+	"CPAL-1.0":     "cpal",
+	"Zlib":         "zlib",
+}
+
+// Matches an email address in the authors label, which is free-form.
+var labelEmailRegexp = regexp.MustCompile(`[^\s<>,;()"]+@[^\s<>,;()"]+`)
+
+// Return the labels of the docker image, which is either in the file
+// `imageFile` (if non-empty) or the image named `image` in the running
+// docker daemon.
+func imageLabels(imageFile, image string) (map[string]string, error) {
+	if imageFile != "" {
+		img, err := readDockerImageFile(imageFile, false)
+		if err != nil {
+			return nil, err
+		}
+		config, err := img.config()
+		if err != nil {
+			return nil, err
+		}
+		return config.Config.Labels, nil
+	}
+	out, err := exec.Command(
+		"docker", "image", "inspect", "--format", "{{json .Config.Labels}}", image,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	err = json.Unmarshal(out, &labels)
+	return labels, err
+}
+
+// Return the name of the OpenSourceLicense for the SPDX license
+// identifier `id`, or "" if Sandstorm doesn't know the license.
+func licenseFromSPDX(id string) string {
+	for _, suffix := range []string{"-only", "-or-later", "+"} {
+		id = strings.TrimSuffix(id, suffix)
+	}
+	return spdxLicenses[id]
+}
+
+// Fill in the fields of `manifest` which the package definition left
+// empty from the corresponding OCI labels in `labels`. Returns the fields
+// which were filled in.
+func fillFromLabels(manifest capnp_spk.Manifest, labels map[string]string, warnings io.Writer) ([]labelField, error) {
+	filled := []labelField{}
+	fill := func(field, label string, set func(value string) error) error {
+		if err := set(labels[label]); err != nil {
+			return wrapErr("Setting "+field, err)
+		}
+		filled = append(filled, labelField{field: field, label: label})
+		return nil
+	}
+
+	if labels[labelTitle] != "" && isEmptyText(manifest.AppTitle()) {
+		err := fill("appTitle", labelTitle, func(value string) error {
+			text, err := manifest.NewAppTitle()
+			if err != nil {
+				return err
+			}
+			return text.SetDefaultText(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if labels[labelVersion] != "" && isEmptyText(manifest.AppMarketingVersion()) {
+		err := fill("appMarketingVersion", labelVersion, func(value string) error {
+			text, err := manifest.NewAppMarketingVersion()
+			if err != nil {
+				return err
+			}
+			return text.SetDefaultText(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the package definition has no metadata, this is an empty
+	// struct, which we replace with a real one the first time we need
+	// to set something.
+	metadata, err := manifest.Metadata()
+	if err != nil {
+		return nil, wrapErr("Reading the metadata", err)
+	}
+	fillMetadata := func(field, label string, set func(m capnp_spk.Metadata, value string) error) error {
+		return fill(field, label, func(value string) error {
+			if !manifest.HasMetadata() {
+				var err error
+				if metadata, err = manifest.NewMetadata(); err != nil {
+					return err
+				}
+			}
+			return set(metadata, value)
+		})
+	}
+
+	if labels[labelURL] != "" && !metadata.HasWebsite() {
+		err := fillMetadata("metadata.website", labelURL, func(m capnp_spk.Metadata, value string) error {
+			return m.SetWebsite(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if labels[labelSource] != "" && !metadata.HasCodeUrl() {
+		err := fillMetadata("metadata.codeUrl", labelSource, func(m capnp_spk.Metadata, value string) error {
+			return m.SetCodeUrl(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if id := labels[labelLicenses]; id != "" && metadata.License().Which() == capnp_spk.Metadata_license_Which_none {
+		if name := licenseFromSPDX(id); name != "" {
+			err := fillMetadata("metadata.license", labelLicenses, func(m capnp_spk.Metadata, value string) error {
+				m.License().SetOpenSource(capnp_spk.OpenSourceLicenseFromString(name))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			fwarnf(warnings, "the image's license %q is not an open source license known to Sandstorm; "+
+				"leaving metadata.license unset", id)
+		}
+	}
+	if authors := labels[labelAuthors]; authors != "" && !metadata.Author().HasContactEmail() {
+		if email := labelEmailRegexp.FindString(authors); email != "" {
+			err := fillMetadata("metadata.author.contactEmail", labelAuthors, func(m capnp_spk.Metadata, value string) error {
+				return m.Author().SetContactEmail(email)
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			fwarnf(warnings, "the image's authors (%q) include no email address; "+
+				"leaving metadata.author.contactEmail unset", authors)
+		}
+	}
+	return filled, nil
+}
+
+// Report whether the text is unset or empty. The arguments are the
+// results of the LocalizedText field's accessor.
+func isEmptyText(text util.LocalizedText, err error) bool {
+	if err != nil {
+		return false
+	}
+	s, err := text.DefaultText()
+	return err == nil && s == ""
+}
+
+// Describe the manifest fields which were filled in from image labels.
+func (f labelField) String() string {
+	return fmt.Sprintf("%s (from %s)", f.field, f.label)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
@@ -19,8 +20,33 @@ var (
 		os.Getenv("HOME")+"/.sandstorm-keyring",
 		"Path to sandstorm keyring",
 	)
+
+	// Directories searched for absolute imports and embeds in the
+	// package definition; see importPathFor.
+	importDirs stringListFlag
 )
 
+func init() {
+	flag.Var(&importDirs,
+		"I",
+		"Add `dir` to the import path, which is searched for absolute imports "+
+			"and embeds in the package definition. May be given more than once.",
+	)
+}
+
+// A flag.Value which may be specified more than once; each occurrence
+// appends its argument to the list.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 // If the error is not nil, display an error message to the user based on
 // `context` and `err`, and exit the with a failing status.
 func chkfatal(context string, err error) {
@@ -30,6 +56,29 @@ func chkfatal(context string, err error) {
 	}
 }
 
+// Print a warning to the user. The message should not end with a period.
+func warnf(format string, args ...interface{}) {
+	fwarnf(os.Stderr, format, args...)
+}
+
+// Like warnf, but print the warning to `w`, or to stderr if w is nil.
+// build -all uses this to keep each app's warnings with the app.
+func fwarnf(w io.Writer, format string, args ...interface{}) {
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "Warning: "+format+".\n", args...)
+}
+
+// Return an error describing `err` in terms of `context`, in the same
+// format as chkfatal. Returns nil if err is nil.
+func wrapErr(context string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", context, err)
+}
+
 // Report a usage error to the user. Displays the string `info` and the
 // documentation for the command line arguments, and exits with a failing
 // status.
@@ -42,9 +91,13 @@ func usageErr(info string) {
 
 func main() {
 	subCommands := map[string]func(){
-		"pack":  packCmd,
-		"init":  initCmd,
-		"build": buildCmd,
+		"pack":     packCmd,
+		"init":     initCmd,
+		"build":    buildCmd,
+		"convert":  convertCmd,
+		"pkgdef":   pkgdefCmd,
+		"manifest": manifestCmd,
+		"l10n":     l10nCmd,
 	}
 	flag.Usage = func() {
 		keys := []string{}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+func manifestCmd() {
+	pkgDef := flag.String("pkg-def", "sandstorm-pkgdef.capnp:pkgdef",
+		"The package definition to evaluate, of the form <def-file>:<name>,\n"+
+			"as for the build command.")
+	format := flag.String("format", "json",
+		"The format to print in: json, yaml or capnp.")
+	poDir := flag.String("po-dir", "",
+		"Add the translations from the PO files in this directory, as for\n"+
+			"the build command.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s manifest [-pkg-def <file>] [-po-dir <dir>] [-format json|yaml|capnp]\n\n"+
+				"Print the app id, manifest and bridge config which are generated\n"+
+				"from the package definition, with all constants resolved and\n"+
+				"files embedded. Fields with their default values are left out.\n\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usageErr("manifest takes no arguments")
+	}
+	switch *format {
+	case "json", "yaml", "capnp":
+	default:
+		usageErr(fmt.Sprintf("Unknown format %q; expected json, yaml or capnp", *format))
+	}
+	file, name := splitPkgDefSpec(*pkgDef)
+	metadata, err := getPkgMetadata(file, name, metadataOptions{
+		poDir:             *poDir,
+		changeLogVersions: defaultChangeLogVersions,
+	})
+	chkfatal("Reading the package definition", err)
+	idx, err := sandstormSchema()
+	chkfatal("Loading the schema", err)
+	n, err := metadataToData(idx, metadata)
+	chkfatal("Decoding the package metadata", err)
+	chkfatal("Printing the package metadata", writeMetadataData(os.Stdout, idx, n, *format))
+}
+
+// Return the app id, manifest and bridge config from `m`, as a
+// PackageDefinition in the form used by JSON and YAML package
+// definitions.
+func metadataToData(idx *schemaIndex, m *pkgMetadata) (*dataNode, error) {
+	pkgDefType := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	n := singletonMap("id", stringNode(m.appId))
+	for _, part := range []struct {
+		field string
+		data  []byte
+	}{
+		{"manifest", m.manifest},
+		{"bridgeConfig", m.bridgeCfg},
+	} {
+		_, t, err := fieldAndType(idx, pkgDefType, part.field)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := capnp.Unmarshal(part.data)
+		if err != nil {
+			return nil, wrapErr("Unmarshalling the "+part.field, err)
+		}
+		root, err := msg.RootPtr()
+		if err != nil {
+			return nil, wrapErr("Reading the "+part.field, err)
+		}
+		value, err := structToData(idx, t.id, root.Struct())
+		if err != nil {
+			return nil, wrapErr("Reading the "+part.field, err)
+		}
+		n.set(part.field, value)
+	}
+	return n, nil
+}
+
+// Write `n`, a PackageDefinition as returned by metadataToData, to `w` in
+// the given format. For capnp, this is just the struct literal.
+func writeMetadataData(w io.Writer, idx *schemaIndex, n *dataNode, format string) error {
+	switch format {
+	case "json":
+		return writeJSON(w, n)
+	case "yaml":
+		return writeYAML(w, n)
+	default:
+		t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+		v, err := dataToValue(idx, t, n)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		writeCapnpValue(buf, v, "")
+		buf.WriteString("\n")
+		_, err = w.Write(buf.Bytes())
+		return err
+	}
+}
+
+// Convert `s`, a struct (or group) with the type id `id`, into the form
+// used by JSON and YAML package definitions. Fields which have their
+// default values are left out, except for the union member which is set.
+func structToData(idx *schemaIndex, id uint64, s capnp.Struct) (*dataNode, error) {
+	info, err := idx.structInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	which := s.Uint16(capnp.DataOffset(info.discriminantOffset * 2))
+	n := mapNode()
+	for _, field := range info.fields {
+		if field.inUnion() && field.discriminant != which {
+			continue
+		}
+		var value *dataNode
+		if field.group != 0 {
+			value, err = structToData(idx, field.group, s)
+			if err == nil && value.kind == dataMap && len(value.fields) == 0 && !field.inUnion() {
+				value = nil
+			}
+		} else {
+			value, err = fieldToData(idx, field, s, field.inUnion())
+		}
+		if err != nil {
+			return nil, wrapErr("Reading "+field.name, err)
+		}
+		if value != nil {
+			n.set(field.name, value)
+		}
+	}
+	t := &capnpType{which: schema.Type_Which_structType, id: id}
+	if isLocalizedText(idx, t) && len(n.fields) == 1 && n.fields[0].key == "defaultText" {
+		// Just the text will do.
+		return n.fields[0].value, nil
+	}
+	return n, nil
+}
+
+// Convert the field `field` of `s`, which is not a group. Returns nil if
+// the field has its default value, unless `always` is true.
+func fieldToData(idx *schemaIndex, field *fieldInfo, s capnp.Struct, always bool) (*dataNode, error) {
+	t := field.typ
+	if t.which == schema.Type_Which_void {
+		if always {
+			return &dataNode{kind: dataNull}, nil
+		}
+		return nil, nil
+	}
+	if !t.isData() {
+		if !s.HasPtr(uint16(field.offset)) {
+			if !always {
+				return nil, nil
+			}
+			if field.defaultPtr.IsValid() {
+				return ptrToData(idx, t, field.defaultPtr)
+			}
+		}
+		p, err := s.Ptr(uint16(field.offset))
+		if err != nil {
+			return nil, err
+		}
+		return ptrToData(idx, t, p)
+	}
+
+	var bits uint64
+	switch t.bitSize() {
+	case 1:
+		if s.Bit(capnp.BitOffset(field.offset)) {
+			bits = 1
+		}
+	case 8:
+		bits = uint64(s.Uint8(capnp.DataOffset(field.offset)))
+	case 16:
+		bits = uint64(s.Uint16(capnp.DataOffset(field.offset * 2)))
+	case 32:
+		bits = uint64(s.Uint32(capnp.DataOffset(field.offset * 4)))
+	case 64:
+		bits = s.Uint64(capnp.DataOffset(field.offset * 8))
+	}
+	if bits == 0 && !always {
+		return nil, nil
+	}
+	// Values in the data section are stored XORed with their defaults:
+	return scalarToData(idx, t, bits^field.defaultBits), nil
+}
+
+// Convert the value of the pointer type `t` at `p`.
+func ptrToData(idx *schemaIndex, t *capnpType, p capnp.Ptr) (*dataNode, error) {
+	switch t.which {
+	case schema.Type_Which_text:
+		return stringNode(p.Text()), nil
+	case schema.Type_Which_data:
+		return singletonMap("$base64", stringNode(base64.StdEncoding.EncodeToString(p.Data()))), nil
+	case schema.Type_Which_structType:
+		return structToData(idx, t.id, p.Struct())
+	case schema.Type_Which_list:
+		return listToData(idx, t, p.List())
+	default:
+		return nil, fmt.Errorf("values of type %s are not supported", idx.typeName(t))
+	}
+}
+
+// Convert the list `l`, of the list type `t`.
+func listToData(idx *schemaIndex, t *capnpType, l capnp.List) (*dataNode, error) {
+	n := listNode()
+	for i := 0; i < l.Len(); i++ {
+		var elem *dataNode
+		var err error
+		switch t.elem.which {
+		case schema.Type_Which_structType:
+			elem, err = structToData(idx, t.elem.id, l.Struct(i))
+		case schema.Type_Which_text:
+			var s string
+			s, err = capnp.TextList{List: l}.At(i)
+			elem = stringNode(s)
+		case schema.Type_Which_data:
+			var data []byte
+			data, err = capnp.DataList{List: l}.At(i)
+			elem = singletonMap("$base64", stringNode(base64.StdEncoding.EncodeToString(data)))
+		case schema.Type_Which_list:
+			var p capnp.Ptr
+			if p, err = (capnp.PointerList{List: l}).PtrAt(i); err == nil {
+				elem, err = listToData(idx, t.elem, p.List())
+			}
+		case schema.Type_Which_void, schema.Type_Which_interface, schema.Type_Which_anyPointer:
+			return nil, fmt.Errorf("lists of type %s are not supported", idx.typeName(t))
+		default:
+			elem = scalarToData(idx, t.elem, listElemBits(t.elem, l, i))
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.elems = append(n.elems, elem)
+	}
+	return n, nil
+}
+
+// Return the bits of the i'th element of `l`, a list of values of the
+// type `t`, which must be stored in the data section.
+func listElemBits(t *capnpType, l capnp.List, i int) uint64 {
+	switch t.bitSize() {
+	case 1:
+		if (capnp.BitList{List: l}).At(i) {
+			return 1
+		}
+		return 0
+	case 8:
+		return uint64(capnp.UInt8List{List: l}.At(i))
+	case 16:
+		return uint64(capnp.UInt16List{List: l}.At(i))
+	case 32:
+		return uint64(capnp.UInt32List{List: l}.At(i))
+	default:
+		return capnp.UInt64List{List: l}.At(i)
+	}
+}
+
+// Convert a value of the type `t`, which is stored in the data section,
+// from its bits.
+func scalarToData(idx *schemaIndex, t *capnpType, bits uint64) *dataNode {
+	switch {
+	case t.which == schema.Type_Which_bool:
+		return plainNode(strconv.FormatBool(bits != 0))
+	case t.which == schema.Type_Which_enum:
+		if info, err := idx.enumInfo(t.id); err == nil && bits < uint64(len(info.names)) {
+			return plainNode(info.names[bits])
+		}
+		return plainNode(strconv.FormatUint(bits, 10))
+	case t.which == schema.Type_Which_float32:
+		return plainNode(strconv.FormatFloat(float64(math.Float32frombits(uint32(bits))), 'g', -1, 32))
+	case t.which == schema.Type_Which_float64:
+		return plainNode(strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64))
+	case t.isSigned():
+		shift := 64 - t.bitSize()
+		return plainNode(strconv.FormatInt(int64(bits<<shift)>>shift, 10))
+	default:
+		return plainNode(strconv.FormatUint(bits, 10))
+	}
+}
@@ -1,25 +1,77 @@
 package main
 
 import (
-	"zenhack.net/go/sandstorm/exp/spk"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/capnp/util"
 	"zombiezen.com/go/capnproto2"
 )
 
 type pkgMetadata struct {
 	manifest, bridgeCfg  []byte
 	appId, name, version string
+	appVersion           uint32
+
+	// The manifest fields which were filled in from image labels.
+	fromLabels []labelField
+}
+
+// Options for getPkgMetadata.
+type metadataOptions struct {
+	// Where to print warnings; see fwarnf.
+	warnings io.Writer
+
+	// If non-nil, override the appVersion.
+	appVersion *uint32
+
+	// If non-empty, override the appMarketingVersion.
+	marketingVersion string
+
+	// If non-nil, the image's labels, from which any of the fields
+	// supported by fillFromLabels that are still empty are filled in.
+	labels map[string]string
+
+	// If non-empty, the directory containing PO files with translations
+	// of the texts in the manifest and bridge config; see l10n.go.
+	poDir string
+
+	// The number of versions to keep in the change log read from
+	// CHANGELOG.md; see fillFromDocs.
+	changeLogVersions int
+
+	// Appended to the app's title and marketing version, including
+	// their translations.
+	titleSuffix, versionSuffix string
+
+	// If non-nil, icons and screenshots which replace those in the
+	// package definition.
+	assets *appAssets
+
+	// If non-nil, the filesystem of the image, from which the package
+	// definition and the files it embeds are read, instead of from the
+	// local filesystem.
+	imageTree Tree
 }
 
-func getPkgMetadata(pkgDefFile, pkgDefVar string) *pkgMetadata {
+// Read the package metadata from the package definition, applying `opts`.
+func getPkgMetadata(pkgDefFile, pkgDefVar string, opts metadataOptions) (*pkgMetadata, error) {
 	// Read in the package definition from sandstorm-pkgdef.capnp. The
-	// file will reference some of the .capnp files from Sandstorm, so
-	// we output those to a temporary directory and add it to the include
-	// path for the capnp command.
-	tmpDir, err := saveSchemaFiles()
-	chkfatal("Saving temporary schema files", err)
-	defer deleteSchemaFiles(tmpDir)
-	pkgDef, err := spk.ReadPackageDefinition(pkgDefFile, pkgDefVar, []string{tmpDir})
-	chkfatal("Reading the package definition", err)
+	// file will reference some of the .capnp files from Sandstorm; these
+	// are resolved against the schema compiled into docker-spk, so we
+	// don't need the capnp tool.
+	var pkgDef capnp_spk.PackageDefinition
+	var err error
+	if opts.imageTree != nil {
+		pkgDef, err = readImagePackageDefinition(opts.imageTree, pkgDefFile, pkgDefVar)
+	} else {
+		pkgDef, err = readPackageDefinition(pkgDefFile, pkgDefVar)
+	}
+	if err != nil {
+		return nil, wrapErr("Reading the package definition", err)
+	}
 
 	// There are two pieces of information we want out of the package definition:
 	//
@@ -27,49 +79,180 @@ func getPkgMetadata(pkgDefFile, pkgDefVar string) *pkgMetadata {
 	// 2. The manifest, which we embed in the package's archive.
 
 	pkgManifest, err := pkgDef.Manifest()
-	chkfatal("Reading the package manifest", err)
+	if err != nil {
+		return nil, wrapErr("Reading the package manifest", err)
+	}
+
+	if opts.appVersion != nil {
+		pkgManifest.SetAppVersion(*opts.appVersion)
+	}
+	if opts.marketingVersion != "" {
+		text, err := pkgManifest.NewAppMarketingVersion()
+		if err == nil {
+			err = text.SetDefaultText(opts.marketingVersion)
+		}
+		if err != nil {
+			return nil, wrapErr("Setting appMarketingVersion", err)
+		}
+	}
+
+	var fromLabels []labelField
+	if opts.labels != nil {
+		fromLabels, err = fillFromLabels(pkgManifest, opts.labels, opts.warnings)
+		if err != nil {
+			return nil, wrapErr("Filling in the manifest from the image's labels", err)
+		}
+	}
+
+	readFile := ioutil.ReadFile
+	if opts.imageTree != nil {
+		readFile = opts.imageTree.readFile
+	}
+	err = fillFromDocs(pkgManifest, readFile, filepath.Dir(pkgDefFile), opts.changeLogVersions,
+		opts.warnings)
+	if err != nil {
+		return nil, wrapErr("Reading the description and change log", err)
+	}
 
 	appTitle, err := pkgManifest.AppTitle()
-	chkfatal("Getting app title", err)
+	if err != nil {
+		return nil, wrapErr("Getting app title", err)
+	}
 
 	nameText, err := appTitle.DefaultText()
-	chkfatal("Getting app name", err)
+	if err != nil {
+		return nil, wrapErr("Getting app name", err)
+	}
 
 	appMarketingVersion, err := pkgManifest.AppMarketingVersion()
-	chkfatal("Getting appMarketingVersion", err)
+	if err != nil {
+		return nil, wrapErr("Getting appMarketingVersion", err)
+	}
 
 	versionText, err := appMarketingVersion.DefaultText()
-	chkfatal("Getting version text", err)
+	if err != nil {
+		return nil, wrapErr("Getting version text", err)
+	}
 
 	appIdStr, err := pkgDef.Id()
-	chkfatal("Reading the package's app id", err)
+	if err != nil {
+		return nil, wrapErr("Reading the package's app id", err)
+	}
 
 	bridgeCfg, err := pkgDef.BridgeConfig()
-	chkfatal("Reading the bridge config", err)
+	if err != nil {
+		return nil, wrapErr("Reading the bridge config", err)
+	}
+
+	if opts.poDir != "" {
+		if err := addPOTranslations(opts.poDir, pkgManifest, bridgeCfg); err != nil {
+			return nil, wrapErr("Adding translations", err)
+		}
+	}
+
+	if opts.assets != nil {
+		if err := opts.assets.apply(pkgManifest); err != nil {
+			return nil, wrapErr("Adding the icons and screenshots", err)
+		}
+	}
+
+	// The translations are looked up by the original texts, so add the
+	// suffixes after them:
+	if opts.titleSuffix != "" {
+		if err := appendToText(pkgManifest.AppTitle, opts.titleSuffix); err != nil {
+			return nil, wrapErr("Changing the app title", err)
+		}
+		nameText += opts.titleSuffix
+	}
+	if opts.versionSuffix != "" {
+		if err := appendToText(pkgManifest.AppMarketingVersion, opts.versionSuffix); err != nil {
+			return nil, wrapErr("Changing appMarketingVersion", err)
+		}
+		versionText += opts.versionSuffix
+	}
+
+	// Check the package definition as it will be packed, including what
+	// the flags and PO files added to it:
+	problems, err := checkBridgeConfig(pkgManifest, bridgeCfg)
+	if err != nil {
+		return nil, wrapErr("Checking the bridge config", err)
+	}
+	apiProblems, err := checkApiVersions(pkgManifest, bridgeCfg)
+	if err != nil {
+		return nil, wrapErr("Checking the API versions", err)
+	}
+	problems = append(apiProblems, problems...)
+	if err := reportProblems(problems, pkgDefFile, pkgDefVar, opts.imageTree, opts.warnings); err != nil {
+		return nil, wrapErr("Checking the package definition", err)
+	}
 
 	// Generate the contents of the file /sandstorm-manifest
-	manifestMsg, manifestSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("Allocating a message for the manifest", err)
-	rootManifest, err := capnp.NewRootStruct(manifestSeg, pkgManifest.Struct.Size())
-	chkfatal("Allocating the root object for the manifest", err)
-	chkfatal("Copying manifest", rootManifest.CopyFrom(pkgManifest.Struct))
-	manifestBytes, err := manifestMsg.Marshal()
-	chkfatal("Marshalling sandstorm-manifest", err)
+	manifestBytes, err := marshalStruct(pkgManifest.Struct)
+	if err != nil {
+		return nil, wrapErr("Marshalling sandstorm-manifest", err)
+	}
 
 	// Generate the contents of the file /sandstorm-http-bridge-config
-	bridgeCfgMsg, bridgeCfgSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("Allocating a message for the bridge config", err)
-	rootCfg, err := capnp.NewRootStruct(bridgeCfgSeg, bridgeCfg.Struct.Size())
-	chkfatal("Allocating the root object for the bridge config", err)
-	chkfatal("Copying bridgeCfg", rootCfg.CopyFrom(bridgeCfg.Struct))
-	bridgeCfgBytes, err := bridgeCfgMsg.Marshal()
-	chkfatal("Marshalling sandstorm-bridgeCfg", err)
+	bridgeCfgBytes, err := marshalStruct(bridgeCfg.Struct)
+	if err != nil {
+		return nil, wrapErr("Marshalling sandstorm-http-bridge-config", err)
+	}
 
 	return &pkgMetadata{
-		manifest:  manifestBytes,
-		bridgeCfg: bridgeCfgBytes,
-		appId:     appIdStr,
-		name:      nameText,
-		version:   versionText,
+		manifest:   manifestBytes,
+		bridgeCfg:  bridgeCfgBytes,
+		appId:      appIdStr,
+		name:       nameText,
+		version:    versionText,
+		appVersion: pkgManifest.AppVersion(),
+
+		fromLabels: fromLabels,
+	}, nil
+}
+
+// Copy `src` into the root of a new message, and return the marshalled
+// message.
+func marshalStruct(src capnp.Struct) ([]byte, error) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
+	if err != nil {
+		return nil, wrapErr("Allocating a message", err)
+	}
+	root, err := capnp.NewRootStruct(seg, src.Size())
+	if err != nil {
+		return nil, wrapErr("Allocating the root object", err)
+	}
+	if err := root.CopyFrom(src); err != nil {
+		return nil, wrapErr("Copying", err)
+	}
+	return msg.Marshal()
+}
+
+// Append `suffix` to the LocalizedText returned by `get`, and to each of
+// its localizations.
+func appendToText(get func() (util.LocalizedText, error), suffix string) error {
+	text, err := get()
+	if err != nil {
+		return err
+	}
+	s, err := text.DefaultText()
+	if err != nil {
+		return err
+	}
+	if err := text.SetDefaultText(s + suffix); err != nil {
+		return err
+	}
+	list, err := text.Localizations()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < list.Len(); i++ {
+		s, err := list.At(i).Text()
+		if err != nil {
+			return err
+		}
+		if err := list.At(i).SetText(s + suffix); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Icons given by flags should be checked against the minApiVersion, like
+// those in the package definition.
+func TestGetPkgMetadataChecksAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-spk-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "sandstorm-pkgdef.yaml")
+	err = ioutil.WriteFile(filename, []byte(`id: 8anwd8gxasmhav7uu869eamag7rqhxczd86a6fcz5nktuk02mkth
+manifest:
+  appTitle: {defaultText: Example}
+  appVersion: 1
+  appMarketingVersion: {defaultText: "1.0"}
+  minApiVersion: 104
+  actions:
+    - input: {none: null}
+      command: {argv: [/app/run]}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	icon, err := makeIcon("marketBig", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := &bytes.Buffer{}
+	_, err = getPkgMetadata(filename, "pkgdef", metadataOptions{
+		warnings: warnings,
+		assets:   &appAssets{icons: map[string]*iconAsset{"marketBig": icon}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "manifest.metadata.icons.marketBig: needs API version 120, but the minApiVersion is 104"
+	if !strings.Contains(warnings.String(), want) {
+		t.Errorf("got warnings:\n%s\nwant one containing %q", warnings, want)
+	}
+}
@@ -3,31 +3,39 @@ package main
 import (
 	"archive/tar"
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 
 	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
 	"zenhack.net/go/sandstorm/exp/spk"
 	"zombiezen.com/go/capnproto2"
 )
 
-// Build an archive from the docker image, preferring allocation in `seg`
-// (and definitely allocating in the same message). The resulting archive
-// is an orphan inside the message; it must be attached somewhere for it
-// to be reachable.
-func buildArchive(dockerImage io.Reader, seg *capnp.Segment, manifest, bridgeCfg []byte) (capnp_spk.Archive, error) {
+// Build an archive from the docker image `img`, whose filesystem is
+// `tree`, preferring allocation in `seg` (and definitely allocating in the
+// same message). The resulting archive is an orphan inside the message;
+// it must be attached somewhere for it to be reachable. If inheritConfig
+// is true, the commands in the manifest inherit the environment and
+// working directory from the image's config; see inheritImageConfig.
+//
+// The tree is modified, and should not be used afterwards.
+func buildArchive(img *DockerImage, tree Tree, seg *capnp.Segment, manifest, bridgeCfg []byte, inheritConfig bool) (capnp_spk.Archive, error) {
 	ret, err := capnp_spk.NewArchive(seg)
 	if err != nil {
 		return ret, err
 	}
-	img, err := readDockerImage(tar.NewReader(dockerImage))
-	if err != nil {
-		return ret, err
-	}
-	tree, err := img.toTree()
-	if err != nil {
-		return ret, err
+	if inheritConfig {
+		config, err := img.config()
+		if err != nil {
+			return ret, err
+		}
+		manifest, err = inheritImageConfig(manifest, config, tree, warnf)
+		if err != nil {
+			return ret, err
+		}
 	}
 
 	// Add sandstorm metadata to the package:
@@ -50,33 +58,61 @@ func buildArchive(dockerImage io.Reader, seg *capnp.Segment, manifest, bridgeCfg
 // Read in the docker image located at filename, and return a capnproto message with an
 // equivalent Archive as its root. The second argument is the raw bytes of the file
 // "sandstorm-manifest", which will be added to the archive.
-func archiveFromFilename(filename string, manifestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
+func archiveFromFilename(filename string, manifestBytes, bridgeCfgBytes []byte, inheritConfig bool) (capnp_spk.Archive, error) {
 	file, err := os.Open(filename)
-	chkfatal("opening image file", err)
+	if err != nil {
+		return capnp_spk.Archive{}, wrapErr("opening image file", err)
+	}
 	defer file.Close()
-	return archiveFromReader(file, manifestBytes, bridgeCfgBytes)
+	return archiveFromReader(file, manifestBytes, bridgeCfgBytes, inheritConfig)
 }
 
-func archiveFromDocker(image string, mainfestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
+func archiveFromDocker(image string, mainfestBytes, bridgeCfgBytes []byte, inheritConfig bool) (capnp_spk.Archive, error) {
 	cmd := exec.Command("docker", "save", image)
 	stdout, err := cmd.StdoutPipe()
-	chkfatal("Getting standard output from docker save", err)
+	if err != nil {
+		return capnp_spk.Archive{}, wrapErr("Getting standard output from docker save", err)
+	}
 	defer stdout.Close()
-	chkfatal("Starting docker save", cmd.Start())
-	defer func() {
-		chkfatal("Waiting for docker save", cmd.Wait())
-	}()
-	return archiveFromReader(stdout, mainfestBytes, bridgeCfgBytes)
+	if err := cmd.Start(); err != nil {
+		return capnp_spk.Archive{}, wrapErr("Starting docker save", err)
+	}
+	archive, err := archiveFromReader(stdout, mainfestBytes, bridgeCfgBytes, inheritConfig)
+	if err != nil {
+		// Make sure docker save doesn't block writing to the pipe,
+		// then clean it up:
+		stdout.Close()
+		cmd.Wait()
+		return archive, err
+	}
+	return archive, wrapErr("Waiting for docker save", cmd.Wait())
 }
 
-func archiveFromReader(r io.Reader, manifestBytes, bridgeCfgBytes []byte) capnp_spk.Archive {
+func archiveFromReader(r io.Reader, manifestBytes, bridgeCfgBytes []byte, inheritConfig bool) (capnp_spk.Archive, error) {
+	img, err := readDockerImage(tar.NewReader(r))
+	if err != nil {
+		return capnp_spk.Archive{}, wrapErr("building the archive", err)
+	}
+	tree, err := img.toTree()
+	if err != nil {
+		return capnp_spk.Archive{}, wrapErr("building the archive", err)
+	}
+	return archiveFromImage(img, tree, manifestBytes, bridgeCfgBytes, inheritConfig)
+}
+
+// Like archiveFromReader, but for an image which has already been read,
+// and whose filesystem is `tree`.
+func archiveFromImage(img *DockerImage, tree Tree, manifestBytes, bridgeCfgBytes []byte, inheritConfig bool) (capnp_spk.Archive, error) {
 	archiveMsg, archiveSeg, err := capnp.NewMessage(capnp.SingleSegment([]byte{}))
-	chkfatal("allocating a message", err)
-	archive, err := buildArchive(r, archiveSeg, manifestBytes, bridgeCfgBytes)
-	chkfatal("building the archive", err)
+	if err != nil {
+		return capnp_spk.Archive{}, wrapErr("allocating a message", err)
+	}
+	archive, err := buildArchive(img, tree, archiveSeg, manifestBytes, bridgeCfgBytes, inheritConfig)
+	if err != nil {
+		return archive, wrapErr("building the archive", err)
+	}
 	err = archiveMsg.SetRoot(archive.Struct.ToPtr())
-	chkfatal("setting root pointer", err)
-	return archive
+	return archive, wrapErr("setting root pointer", err)
 }
 
 // Flags for the pack subcommand.
@@ -86,6 +122,10 @@ type packFlags struct {
 
 	// other flags:
 	imageFile, image string
+	pkgDefInImage    bool
+
+	// Where to print warnings; see fwarnf. This is not a flag.
+	warnings io.Writer
 }
 
 func (f *packFlags) Register() {
@@ -98,6 +138,13 @@ func (f *packFlags) Register() {
 		"image", "",
 		"Name of the image to convert (fetched from the running docker daemon).",
 	)
+	flag.BoolVar(&f.pkgDefInImage,
+		"pkg-def-in-image", false,
+		"Read the package definition, and any files it imports or embeds,\n"+
+			"from inside the image, rather than from -pkg-def. It is read\n"+
+			"from the location given by the image's io.sandstorm.pkgdef\n"+
+			"label (in the same form as -pkg-def), or else from\n"+
+			"/sandstorm-pkgdef.capnp (or .yaml, .yml or .json).")
 }
 
 func (f *packFlags) Parse() {
@@ -108,20 +155,134 @@ func (f *packFlags) Parse() {
 	if f.imageFile != "" && f.image != "" {
 		usageErr("Only one of -image or -imagefile may be specified.")
 	}
+	if f.pkgDefInImage && flagsSet()["pkg-def"] {
+		usageErr("Only one of -pkg-def or -pkg-def-in-image may be specified.")
+	}
+}
+
+// Read the image given by the flags, along with its filesystem.
+func (f *packFlags) readImage() (*DockerImage, Tree, error) {
+	var img *DockerImage
+	var err error
+	if f.imageFile != "" {
+		img, err = readDockerImageFile(f.imageFile, true)
+	} else {
+		img, err = readDockerImageFromDaemon(f.image, true)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := img.toTree()
+	return img, tree, err
 }
 
 func packCmd() {
 	pFlags := &packFlags{}
 	pFlags.Register()
 	pFlags.Parse()
-	doPack(pFlags)
+	res, err := doPack(pFlags)
+	chkfatal("Packing the app", err)
+	res.report()
 }
 
-func doPack(pFlags *packFlags) {
-	metadata := getPkgMetadata(pFlags.pkgDefFile, pFlags.pkgDefVar)
+// Information about an spk produced by doPack.
+type packResult struct {
+	outFilename string
+	metadata    *pkgMetadata
+
+	// True if the spk was already up to date, and so was not re-packed.
+	upToDate bool
+}
 
-	keyring, err := spk.LoadKeyring(*keyringPath)
-	chkfatal("loading the sandstorm keyring", err)
+// Tell the user about the spk, if there is anything interesting to say.
+func (res *packResult) report() {
+	for _, f := range res.metadata.fromLabels {
+		fmt.Printf("Filled in %s.\n", f)
+	}
+	if res.upToDate {
+		fmt.Printf("%s is up to date; not re-packing (use -force to rebuild anyway).\n",
+			res.outFilename)
+	}
+}
+
+func doPack(pFlags *packFlags) (*packResult, error) {
+	if err := pFlags.applyProfile(); err != nil {
+		return nil, wrapErr("Applying the profile", err)
+	}
+
+	opts := metadataOptions{}
+	var err error
+	opts.appVersion, opts.marketingVersion, err = pFlags.versionOverrides()
+	if err != nil {
+		return nil, wrapErr("Determining the version", err)
+	}
+
+	opts.warnings = pFlags.warnings
+	opts.poDir = pFlags.poDir
+	opts.changeLogVersions = pFlags.changeLogVersions
+	opts.titleSuffix = pFlags.titleSuffix
+	opts.versionSuffix = pFlags.versionSuffix
+
+	pkgDefFile, pkgDefVar := pFlags.pkgDefFile, pFlags.pkgDefVar
+	var img *DockerImage
+	var imageConfig *DockerImageConfig
+	var imageTree Tree
+	if pFlags.pkgDefInImage {
+		// We need the image's filesystem to read the package
+		// definition, so read the whole image up front, and build
+		// the archive from that below.
+		img, imageTree, err = pFlags.readImage()
+		if err != nil {
+			return nil, wrapErr("Reading the image", err)
+		}
+		if imageConfig, err = img.config(); err != nil {
+			return nil, wrapErr("Reading the image", err)
+		}
+		pkgDefFile, pkgDefVar = imagePkgDefLocation(imageConfig, imageTree)
+		opts.imageTree = imageTree
+	}
+
+	if imageTree == nil && usesImageAssets(pFlags.icons, pFlags.screenshots) {
+		// As above; the archive is built from the image we read
+		// here.
+		img, imageTree, err = pFlags.readImage()
+		if err != nil {
+			return nil, wrapErr("Reading the image", err)
+		}
+	}
+	if len(pFlags.icons) != 0 || len(pFlags.screenshots) != 0 {
+		opts.assets, err = loadAssets(pFlags.icons, pFlags.screenshots, imageTree)
+		if err != nil {
+			return nil, wrapErr("Reading the icons and screenshots", err)
+		}
+	}
+
+	if pFlags.useImageLabels {
+		if imageConfig != nil {
+			opts.labels = imageConfig.Config.Labels
+		} else {
+			opts.labels, err = imageLabels(pFlags.imageFile, pFlags.image)
+			if err != nil {
+				return nil, wrapErr("Reading the image's labels", err)
+			}
+		}
+		if opts.labels == nil {
+			opts.labels = map[string]string{}
+		}
+	}
+	metadata, err := getPkgMetadata(pkgDefFile, pkgDefVar, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keyringFile := *keyringPath
+	if pFlags.keyring != "" {
+		keyringFile = pFlags.keyring
+	}
+	keyring, err := spk.LoadKeyring(keyringFile)
+	if err != nil {
+		return nil, wrapErr("loading the sandstorm keyring", err)
+	}
 
 	if pFlags.altAppKey != "" {
 		// The user has requested we use a different key.
@@ -130,29 +291,97 @@ func doPack(pFlags *packFlags) {
 
 	var appId spk.AppId
 	err = (&appId).UnmarshalText([]byte(metadata.appId))
-	chkfatal("Parsing the app id", err)
+	if err != nil {
+		return nil, wrapErr("Parsing the app id", err)
+	}
+
+	if pFlags.previous != "" {
+		if err := checkPrevious(pFlags.previous, metadata, appId, pFlags.warnings); err != nil {
+			return nil, wrapErr("Checking against "+pFlags.previous, err)
+		}
+	}
 
 	appKey, err := keyring.GetKey(appId)
-	chkfatal("Fetching the app private key", err)
+	if err != nil {
+		return nil, wrapErr("Fetching the app private key", err)
+	}
 
-	var archive capnp_spk.Archive
+	if pFlags.outFilename == "" {
+		// infer output file from app metadata:
+		name := metadata.name + "-" + metadata.version
+		if pFlags.variant != "" {
+			name += "-" + pFlags.variant
+		}
+		pFlags.outFilename = filepath.Join(pFlags.outDir, name+".spk")
+	}
+	res := &packResult{
+		outFilename: pFlags.outFilename,
+		metadata:    metadata,
+	}
+
+	var imageId string
 	if pFlags.imageFile != "" {
-		archive = archiveFromFilename(pFlags.imageFile, metadata.manifest, metadata.bridgeCfg)
+		imageId, err = imageFileId(pFlags.imageFile)
+	} else {
+		imageId, err = dockerImageId(pFlags.image)
+	}
+	if err != nil {
+		return nil, wrapErr("Determining the image id", err)
+	}
+	schema, err := schemaHash()
+	if err != nil {
+		return nil, err
+	}
+	state := &buildState{
+		ImageId: imageId,
+		PkgDef:  hashParts(metadata.manifest, metadata.bridgeCfg),
+		Schema:  schema,
+		AppKey:  metadata.appId,
+
+		InheritImageConfig: pFlags.inheritImageConfig,
+	}
+	if !pFlags.force {
+		if oldState := loadBuildState(pFlags.outFilename); oldState != nil && *oldState == *state {
+			res.upToDate = true
+			return res, nil
+		}
+	}
+
+	var archive capnp_spk.Archive
+	if img != nil {
+		archive, err = archiveFromImage(img, imageTree, metadata.manifest, metadata.bridgeCfg,
+			pFlags.inheritImageConfig)
+	} else if pFlags.imageFile != "" {
+		archive, err = archiveFromFilename(pFlags.imageFile, metadata.manifest, metadata.bridgeCfg,
+			pFlags.inheritImageConfig)
 	} else if pFlags.image != "" {
-		archive = archiveFromDocker(pFlags.image, metadata.manifest, metadata.bridgeCfg)
+		archive, err = archiveFromDocker(pFlags.image, metadata.manifest, metadata.bridgeCfg,
+			pFlags.inheritImageConfig)
 	} else {
 		// pFlags.Parse() should have ruled this out.
 		panic("impossible")
 	}
-
-	if pFlags.outFilename == "" {
-		// infer output file from app metadata:
-		pFlags.outFilename = metadata.name + "-" + metadata.version + ".spk"
+	if err != nil {
+		return nil, err
 	}
 
+	// The old state no longer describes the file, from the moment we
+	// start overwriting it; it is only saved again once the new spk is
+	// complete.
+	if err := removeBuildState(pFlags.outFilename); err != nil {
+		return nil, wrapErr("Removing the old build state", err)
+	}
 	outFile, err := os.Create(pFlags.outFilename)
-	chkfatal("opening output file", err)
-	defer outFile.Close()
-
-	chkfatal("Writing spk", spk.PackInto(outFile, appKey, archive))
+	if err != nil {
+		return nil, wrapErr("opening output file", err)
+	}
+	err = spk.PackInto(outFile, appKey, archive)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(pFlags.outFilename)
+		return nil, wrapErr("Writing spk", err)
+	}
+	return res, wrapErr("Saving build state", state.save(pFlags.outFilename))
 }
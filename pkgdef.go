@@ -0,0 +1,622 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// This file implements the pkgdef subcommand, which reads and changes
+// individual fields of the package definition, e.g.:
+//
+//	docker-spk pkgdef get manifest.appVersion
+//	docker-spk pkgdef set manifest.appMarketingVersion.defaultText=1.4.0
+//
+// A path is a sequence of field names and list indices, starting from
+// the PackageDefinition. Schema files are edited in place, so that
+// comments and formatting are preserved; JSON and YAML files are written
+// out again in full.
+
+func pkgdefCmd() {
+	pkgDef := flag.String("pkg-def", "sandstorm-pkgdef.capnp:pkgdef",
+		"The package definition to read or edit, of the form <def-file>:<name>,\n"+
+			"as for the build command.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s pkgdef [-pkg-def <file>] get <path>\n"+
+				"       %s pkgdef [-pkg-def <file>] set <path>=<value> ...\n\n"+
+				"Print or change a field of the package definition. <path> is a\n"+
+				"sequence of field names and list indices separated by dots, e.g.\n"+
+				"manifest.actions.0.nounPhrase. Values are given in the syntax of\n"+
+				"the schema language, except that Text values (and LocalizedText,\n"+
+				"such as manifest.appTitle) are given as plain strings.\n\n",
+			os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usageErr("pkgdef takes a command (get or set) and its arguments")
+	}
+	file, name := splitPkgDefSpec(*pkgDef)
+	file = findPkgDefFile(file)
+
+	switch flag.Arg(0) {
+	case "get":
+		if flag.NArg() != 2 {
+			usageErr("pkgdef get takes exactly one path")
+		}
+		path, err := parsePkgDefPath(flag.Arg(1))
+		if err != nil {
+			usageErr(err.Error())
+		}
+		n, err := getPkgDefField(file, name, path)
+		chkfatal("Reading "+flag.Arg(1), err)
+		chkfatal("Printing "+flag.Arg(1), printDataValue(os.Stdout, n))
+	case "set":
+		assignments := []pkgDefAssignment{}
+		for _, arg := range flag.Args()[1:] {
+			i := strings.Index(arg, "=")
+			if i < 0 {
+				usageErr(fmt.Sprintf("%q is not of the form <path>=<value>", arg))
+			}
+			path, err := parsePkgDefPath(arg[:i])
+			if err != nil {
+				usageErr(err.Error())
+			}
+			assignments = append(assignments, pkgDefAssignment{path: path, value: arg[i+1:]})
+		}
+		files, err := setPkgDefFields(file, name, assignments)
+		chkfatal("Editing the package definition", err)
+		for path, data := range files {
+			chkfatal("Writing "+path, ioutil.WriteFile(path, data, 0644))
+		}
+	default:
+		usageErr(fmt.Sprintf("Unknown pkgdef command %q; expected get or set", flag.Arg(0)))
+	}
+}
+
+// A change to make to the package definition: set the field at `path`
+// to `value`.
+type pkgDefAssignment struct {
+	path  []string
+	value string
+}
+
+// An edit to a source file: replace the bytes from start to end with
+// text.
+type srcEdit struct {
+	start, end int
+	text       string
+}
+
+// Split a path of the form a.b.0.c into its components, which must be
+// field names or list indices.
+func parsePkgDefPath(s string) ([]string, error) {
+	path := strings.Split(s, ".")
+	for _, comp := range path {
+		if _, err := strconv.ParseUint(comp, 10, 31); err != nil && !isIdentifier(comp) {
+			return nil, fmt.Errorf("%q is not a valid path; expected field names and "+
+				"list indices separated by dots", s)
+		}
+	}
+	return path, nil
+}
+
+// Return the type of the value at `path` in a PackageDefinition,
+// checking that each component names a field or list index.
+func pathType(idx *schemaIndex, path []string) (*capnpType, error) {
+	t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	for i, comp := range path {
+		switch t.which {
+		case schema.Type_Which_structType:
+			info, err := idx.structInfo(t.id)
+			if err != nil {
+				return nil, err
+			}
+			field, ok := info.field(comp)
+			if !ok {
+				return nil, fmt.Errorf("%s has no field named %q", idx.typeName(t), comp)
+			}
+			t = field.typ
+			if field.group != 0 {
+				t = &capnpType{which: schema.Type_Which_structType, id: field.group}
+			}
+		case schema.Type_Which_list:
+			if _, err := strconv.Atoi(comp); err != nil {
+				return nil, fmt.Errorf("%s is a list; expected an index, but got %q",
+					strings.Join(path[:i], "."), comp)
+			}
+			t = t.elem
+		default:
+			return nil, fmt.Errorf("%s has type %s, which has no field %q",
+				strings.Join(path[:i], "."), idx.typeName(t), comp)
+		}
+	}
+	return t, nil
+}
+
+// Return the field of the struct type `t` with the given name, and its
+// type.
+func fieldAndType(idx *schemaIndex, t *capnpType, name string) (*fieldInfo, *capnpType, error) {
+	info, err := idx.structInfo(t.id)
+	if err != nil {
+		return nil, nil, err
+	}
+	field, ok := info.field(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s has no field named %q", idx.typeName(t), name)
+	}
+	if field.group != 0 {
+		return field, &capnpType{which: schema.Type_Which_structType, id: field.group}, nil
+	}
+	return field, field.typ, nil
+}
+
+// Return the value at `path` in the package definition in `filename`
+// (in the constant `name`, for schema files), in the form used by JSON
+// and YAML package definitions.
+func getPkgDefField(filename, name string, path []string) (*dataNode, error) {
+	e, err := newCapnpEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.evalPackageDefinition(filename, name); err != nil {
+		return nil, err
+	}
+	if _, err := pathType(e.schema, path); err != nil {
+		return nil, err
+	}
+	if pkgDefFormat(filename) != "capnp" {
+		src, err := e.readFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		root, err := parseDataFile(filename, src)
+		if err != nil {
+			return nil, err
+		}
+		return getDataField(e.schema, root, path)
+	}
+
+	target, err := e.findValue(filename, name, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(target.missing) > 0 {
+		return nil, fmt.Errorf("%s is not set", strings.Join(path, "."))
+	}
+	return e.valueToData(target.t, target.v, target.file, func(dir, path string) string {
+		return path
+	})
+}
+
+// Apply `assignments` to the package definition in `filename`, one after
+// another, and return the new contents of each file which changed, by
+// path. The result is checked against the schema before it is returned.
+func setPkgDefFields(filename, name string, assignments []pkgDefAssignment) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	newEvaluator := func() (*capnpEvaluator, error) {
+		e, err := newCapnpEvaluator()
+		if err != nil {
+			return nil, err
+		}
+		e.readFile = func(path string) ([]byte, error) {
+			if data, ok := files[filepath.Clean(path)]; ok {
+				return data, nil
+			}
+			return ioutil.ReadFile(path)
+		}
+		return e, nil
+	}
+
+	e, err := newEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.evalPackageDefinition(filename, name); err != nil {
+		return nil, err
+	}
+	for _, a := range assignments {
+		// Start from scratch each time, so that we see the results of
+		// the previous assignments.
+		e, err := newEvaluator()
+		if err != nil {
+			return nil, err
+		}
+		t, err := pathType(e.schema, a.path)
+		if err != nil {
+			return nil, err
+		}
+		_, v, err := setValueLiteral(e.schema, t, a.value)
+		if err != nil {
+			return nil, wrapErr("Parsing the value of "+strings.Join(a.path, "."), err)
+		}
+
+		if pkgDefFormat(filename) != "capnp" {
+			src, err := e.readFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			root, err := parseDataFile(filename, src)
+			if err != nil {
+				return nil, err
+			}
+			// Embedded paths in the value are relative to the
+			// package definition already.
+			valueFile := &capnpFile{filename: filename, decls: map[string]*capnpDecl{}}
+			value, err := e.valueToData(t, v, valueFile, func(dir, path string) string {
+				return path
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := setDataField(e.schema, root, a.path, value); err != nil {
+				return nil, err
+			}
+			buf := &strings.Builder{}
+			if err := writePkgDefData(buf, e.schema, root, pkgDefFormat(filename), name); err != nil {
+				return nil, err
+			}
+			files[filepath.Clean(filename)] = []byte(buf.String())
+			continue
+		}
+
+		file, edits, err := e.setEdits(filename, name, a.path, t, a.value)
+		if err != nil {
+			return nil, err
+		}
+		files[file.filename] = []byte(applyEdits(file.src, edits))
+	}
+
+	e, err = newEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.evalPackageDefinition(filename, name); err != nil {
+		return nil, wrapErr("Checking the changed package definition", err)
+	}
+	return files, nil
+}
+
+// Return the text of the value `raw`, given on the command line for a
+// field of type `t`, in the schema language, along with the parsed value.
+// Text (and LocalizedText) values are taken literally; anything else must
+// be in the syntax of the schema language already.
+func setValueLiteral(idx *schemaIndex, t *capnpType, raw string) (string, *valueExpr, error) {
+	text := raw
+	switch {
+	case t.which == schema.Type_Which_text:
+		text = capnpQuote(raw)
+	case isLocalizedText(idx, t) && !strings.HasPrefix(strings.TrimSpace(raw), "("):
+		text = "(defaultText = " + capnpQuote(raw) + ")"
+	}
+	toks, err := lexCapnp("<value>", text)
+	if err != nil {
+		return "", nil, err
+	}
+	p := &parser{toks: toks}
+	v, err := p.parseValue()
+	if err != nil {
+		return "", nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return "", nil, errorAt(tok.pos, "unexpected %v after the value", tok)
+	}
+	return text, v, nil
+}
+
+// The place in a schema file which a path in the package definition
+// leads to.
+type valueTarget struct {
+	// The value at the end of the path, its type and the file it
+	// appears in. References to other constants on the way are
+	// followed, but the value itself may be one.
+	//
+	// If some of the fields on the path are not set, v is instead the
+	// struct literal which lacks the first of them, and t its type.
+	t    *capnpType
+	v    *valueExpr
+	file *capnpFile
+
+	// The components of the path from the first field which is not set.
+	missing []string
+}
+
+// Follow `path` from the package definition in the constant `name` of
+// the schema file `filename`.
+func (e *capnpEvaluator) findValue(filename, name string, path []string) (valueTarget, error) {
+	if err := e.setImportPath(filename); err != nil {
+		return valueTarget{}, err
+	}
+	file, err := e.loadFile(filename)
+	if err != nil {
+		return valueTarget{}, err
+	}
+	decl, ok := file.decls[name]
+	if !ok || decl.kind != declConst {
+		return valueTarget{}, fmt.Errorf("%s has no constant named %q", filename, name)
+	}
+	target := valueTarget{
+		t:    &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID},
+		v:    decl.value,
+		file: file,
+	}
+	for i := 0; ; i++ {
+		if i == len(path) {
+			// If the value is a reference to another constant, the
+			// reference is the target: setting the field replaces
+			// it, rather than changing what it refers to.
+			return target, nil
+		}
+		v, file, decls, err := e.deref(target.t, target.v, target.file)
+		e.done(decls)
+		if err != nil {
+			return valueTarget{}, err
+		}
+		target.v, target.file = v, file
+
+		comp := path[i]
+		switch target.t.which {
+		case schema.Type_Which_structType:
+			if v.kind != valStruct {
+				return valueTarget{}, errorAt(v.pos, "expected a struct value of type %s",
+					e.schema.typeName(target.t))
+			}
+			_, fieldType, err := fieldAndType(e.schema, target.t, comp)
+			if err != nil {
+				return valueTarget{}, err
+			}
+			var fe *fieldExpr
+			for _, f := range v.fields {
+				if f.name == comp {
+					fe = f
+				}
+			}
+			if fe == nil {
+				target.missing = path[i:]
+				return target, nil
+			}
+			target.t, target.v = fieldType, fe.value
+		case schema.Type_Which_list:
+			if v.kind != valList {
+				return valueTarget{}, errorAt(v.pos, "expected a list value of type %s",
+					e.schema.typeName(target.t))
+			}
+			index, _ := strconv.Atoi(comp)
+			if index >= len(v.elems) {
+				return valueTarget{}, fmt.Errorf("%s has only %d elements",
+					strings.Join(path[:i], "."), len(v.elems))
+			}
+			target.t, target.v = target.t.elem, v.elems[index]
+		}
+	}
+}
+
+// Return the edits to the schema file which set the field at `path`, of
+// type `t`, to `raw`, and the file to which they apply. If the path
+// passes through a reference to another constant, the field is changed
+// in that constant; if the field's value is itself a reference, the
+// reference is replaced.
+func (e *capnpEvaluator) setEdits(filename, name string, path []string, t *capnpType, raw string) (*capnpFile, []srcEdit, error) {
+	literal, _, err := setValueLiteral(e.schema, t, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := e.findValue(filename, name, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := target.v
+	if len(target.missing) == 0 {
+		return target.file, []srcEdit{{start: v.pos.offset, end: v.end, text: literal}}, nil
+	}
+
+	// Add the missing fields, as nested struct literals. We can't do
+	// that for an element of a list which isn't there.
+	missing := target.missing
+	for i, comp := range missing[1:] {
+		if isDigit(comp[0]) {
+			return nil, nil, fmt.Errorf("%s is not set",
+				strings.Join(path[:len(path)-len(missing)+i+1], "."))
+		}
+	}
+	assignment := missing[len(missing)-1] + " = " + literal
+	for i := len(missing) - 2; i >= 0; i-- {
+		assignment = missing[i] + " = (" + assignment + ")"
+	}
+	field, _, err := fieldAndType(e.schema, target.t, missing[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if field.inUnion() {
+		// Setting a union member replaces whichever other member is
+		// set.
+		for _, fe := range v.fields {
+			other, _, err := fieldAndType(e.schema, target.t, fe.name)
+			if err == nil && other.inUnion() {
+				return target.file, []srcEdit{{start: fe.pos.offset, end: fe.value.end, text: assignment}}, nil
+			}
+		}
+	}
+	return target.file, insertFieldEdits(target.file.src, v, assignment), nil
+}
+
+// Return the edits which add the field assignment `assignment` to the end
+// of the struct literal `v`, whose source is in `src`. The new field
+// follows the style of the existing ones: on its own line if they are,
+// with the same indentation, and with a trailing comma if the last field
+// has one.
+func insertFieldEdits(src string, v *valueExpr, assignment string) []srcEdit {
+	closing := v.end - 1
+	if len(v.fields) == 0 {
+		return []srcEdit{{start: v.pos.offset + 1, end: closing, text: assignment}}
+	}
+	last := v.fields[len(v.fields)-1]
+	pos := last.value.end
+	comma := false
+	if j := pos + len(src[pos:closing]) - len(strings.TrimLeft(src[pos:closing], " \t\r\n")); j < closing && src[j] == ',' {
+		comma = true
+		pos = j + 1
+	}
+	if !strings.Contains(src[v.pos.offset:last.pos.offset], "\n") {
+		// All on one line.
+		if comma {
+			return []srcEdit{{start: pos, end: pos, text: " " + assignment + ","}}
+		}
+		return []srcEdit{{start: pos, end: pos, text: ", " + assignment}}
+	}
+
+	lineStart := strings.LastIndex(src[:last.pos.offset], "\n") + 1
+	line := src[lineStart:last.pos.offset]
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	eol := strings.IndexByte(src[pos:closing], '\n')
+	if comma {
+		assignment += ","
+	}
+	if eol < 0 {
+		// The closing paren is on the same line as the last field.
+		if comma {
+			return []srcEdit{{start: pos, end: pos, text: "\n" + indent + assignment}}
+		}
+		return []srcEdit{{start: pos, end: pos, text: ",\n" + indent + assignment}}
+	}
+	// Insert after the end of the last field's line, so that any comment
+	// there stays with it.
+	edits := []srcEdit{{start: pos + eol, end: pos + eol, text: "\n" + indent + assignment}}
+	if !comma {
+		edits = append(edits, srcEdit{start: pos, end: pos, text: ","})
+	}
+	return edits
+}
+
+// Apply `edits`, which must not overlap, to `src`.
+func applyEdits(src string, edits []srcEdit) string {
+	edits = append([]srcEdit{}, edits...)
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	for _, edit := range edits {
+		src = src[:edit.start] + edit.text + src[edit.end:]
+	}
+	return src
+}
+
+// Return the value at `path` in `root`, a package definition read from
+// JSON or YAML.
+func getDataField(idx *schemaIndex, root *dataNode, path []string) (*dataNode, error) {
+	t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	n := root
+	for i, comp := range path {
+		switch t.which {
+		case schema.Type_Which_structType:
+			_, fieldType, err := fieldAndType(idx, t, comp)
+			if err != nil {
+				return nil, err
+			}
+			if n.kind == dataScalar && isLocalizedText(idx, t) && comp == "defaultText" {
+				t = fieldType
+				continue
+			}
+			f, ok := n.field(comp)
+			if !ok || f.value.kind == dataNull {
+				return nil, fmt.Errorf("%s is not set", strings.Join(path[:i+1], "."))
+			}
+			n, t = f.value, fieldType
+		case schema.Type_Which_list:
+			index, _ := strconv.Atoi(comp)
+			if index >= len(n.elems) {
+				return nil, fmt.Errorf("%s has only %d elements",
+					strings.Join(path[:i], "."), len(n.elems))
+			}
+			n, t = n.elems[index], t.elem
+		}
+	}
+	return n, nil
+}
+
+// Set the field at `path` in `root`, a package definition read from JSON
+// or YAML, to `value`. Any structs on the way which are not set are
+// added.
+func setDataField(idx *schemaIndex, root *dataNode, path []string, value *dataNode) error {
+	t := &capnpType{which: schema.Type_Which_structType, id: capnp_spk.PackageDefinition_TypeID}
+	n := root
+	for i, comp := range path {
+		last := i == len(path)-1
+		switch t.which {
+		case schema.Type_Which_structType:
+			field, fieldType, err := fieldAndType(idx, t, comp)
+			if err != nil {
+				return err
+			}
+			if n.kind == dataScalar && isLocalizedText(idx, t) {
+				// Expand the shorthand, so we can set the field.
+				*n = *singletonMap("defaultText", &dataNode{kind: dataScalar, pos: n.pos, text: n.text, quoted: n.quoted})
+			}
+			if n.kind != dataMap {
+				return errorAt(n.pos, "expected a value of type %s", idx.typeName(t))
+			}
+			f, ok := n.field(comp)
+			if !ok || (f.value.kind == dataNull && !last) {
+				if !last && fieldType.which != schema.Type_Which_structType {
+					return fmt.Errorf("%s is not set", strings.Join(path[:i+1], "."))
+				}
+				if field.inUnion() {
+					// Setting a union member replaces whichever
+					// other member is set. `f` itself may be
+					// present already, with a null value.
+					fields := n.fields[:0]
+					for _, other := range n.fields {
+						if otherField, _, err := fieldAndType(idx, t, other.key); err != nil || !otherField.inUnion() || other == f {
+							fields = append(fields, other)
+						}
+					}
+					n.fields = fields
+				}
+				if !ok {
+					f = &dataField{key: comp}
+					n.fields = append(n.fields, f)
+				}
+				f.value = mapNode()
+			}
+			if last {
+				f.value = value
+				return nil
+			}
+			n, t = f.value, fieldType
+		case schema.Type_Which_list:
+			if n.kind != dataList {
+				return errorAt(n.pos, "expected a value of type %s", idx.typeName(t))
+			}
+			index, _ := strconv.Atoi(comp)
+			if index >= len(n.elems) {
+				return fmt.Errorf("%s has only %d elements",
+					strings.Join(path[:i], "."), len(n.elems))
+			}
+			if last {
+				n.elems[index] = value
+				return nil
+			}
+			n, t = n.elems[index], t.elem
+		}
+	}
+	return nil
+}
+
+// Print `n` for pkgdef get: scalars as they are, and anything else as
+// JSON.
+func printDataValue(w io.Writer, n *dataNode) error {
+	if n.kind == dataScalar {
+		_, err := fmt.Fprintln(w, n.text)
+		return err
+	}
+	return writeJSON(w, n)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Tests for pkgdef set. Each case applies some assignments to a package
+// definition in testdata/pkgdef-set, and compares the result against the
+// file of the same name with .golden appended.
+func TestSetPkgDefFields(t *testing.T) {
+	for _, c := range []struct {
+		file        string
+		assignments []string
+	}{
+		{"oneline.capnp", []string{
+			"manifest.appVersion=2",
+			"manifest.appMarketingVersion=1.0",
+			"manifest.metadata.website=https://example.com",
+			"bridgeConfig.apiPath=/api/",
+		}},
+		{"multiline.capnp", []string{
+			"manifest.appMarketingVersion=1.0",
+			"manifest.metadata.shortDescription=An example",
+			"bridgeConfig.saveIdentityCaps=true",
+		}},
+		{"reference.capnp", []string{
+			"manifest.continueCommand.environ=[(key = \"PATH\", value = \"/bin\")]",
+			"manifest.minUpgradableAppVersion=1",
+		}},
+		// Only continueCommand changes, not the action's command:
+		{"replace-reference.capnp", []string{
+			"manifest.continueCommand=(argv = [\"/app/continue\"])",
+		}},
+		{"union.capnp", []string{
+			"manifest.metadata.license.proprietary=All rights reserved",
+			"manifest.metadata.icons.appGrid.png.dpi1x=0x\"89504e47\"",
+		}},
+		{"union.json", []string{
+			"manifest.metadata.license.none=void",
+			"manifest.metadata.icons.grain.png.dpi1x=0x\"89504e47\"",
+			"manifest.appTitle.localizations=[(locale = \"de\", text = \"Beispiel\")]",
+		}},
+		{"union.yaml", []string{
+			"manifest.metadata.icons.appGrid.png.dpi1x=0x\"89504e47\"",
+			"manifest.metadata.license.publicDomain=Do what you like",
+			"manifest.appTitle.defaultText=New title",
+		}},
+	} {
+		dir, err := ioutil.TempDir("", "docker-spk-pkgdef")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		src, err := ioutil.ReadFile(filepath.Join("testdata", "pkgdef-set", c.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, "sandstorm-pkgdef"+filepath.Ext(c.file))
+		if err := ioutil.WriteFile(filename, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var assignments []pkgDefAssignment
+		for _, s := range c.assignments {
+			i := strings.Index(s, "=")
+			path, err := parsePkgDefPath(s[:i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assignments = append(assignments, pkgDefAssignment{path: path, value: s[i+1:]})
+		}
+		files, err := setPkgDefFields(filename, "pkgdef", assignments)
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		got, ok := files[filename]
+		if !ok {
+			t.Errorf("%s: the package definition was not changed", c.file)
+			continue
+		}
+
+		golden := filepath.Join("testdata", "pkgdef-set", c.file+".golden")
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", c.file, got, want)
+		}
+	}
+}
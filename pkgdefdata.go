@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/std/capnp/schema"
+)
+
+// This file adds support for writing the package definition as JSON or
+// YAML (sandstorm-pkgdef.json or sandstorm-pkgdef.yaml), rather than in
+// the Cap'n Proto schema language.
+//
+// Both formats are parsed into a tree of dataNodes. That tree is then
+// converted into a valueExpr, guided by the schema, and evaluated just
+// like a constant in a schema file would be; so the two kinds of package
+// definition are checked in the same way. The mapping is the obvious one:
+// structs and groups are objects, unions are objects with a single member
+// set, enumerants are strings, and so on. In addition:
+//
+//   - A Text or Data value may be given as {"$embed": "path"}, the
+//     equivalent of embed "path". The path is relative to the file.
+//   - A Data value may be given as {"$base64": "..."}.
+//   - A LocalizedText may be given as just a string, which sets its
+//     defaultText.
+//   - A field whose value is null is left unset.
+
+// The file extensions of package definitions in each format.
+var pkgDefFormats = map[string]string{
+	".capnp": "capnp",
+	".json":  "json",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+}
+
+// Return the format of the package definition at `path`, based on its
+// extension. Anything we don't recognize is assumed to be a schema file.
+func pkgDefFormat(path string) string {
+	if format, ok := pkgDefFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return "capnp"
+}
+
+// If there is no file at `path`, but it is the default name of the
+// package definition (sandstorm-pkgdef.capnp), look for a JSON or YAML
+// package definition in the same directory instead. Returns the path of
+// the file to use.
+func findPkgDefFile(path string) string {
+	return findPkgDefFileIn(path, func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+}
+
+// Like findPkgDefFile, but uses `exists` to check whether files exist.
+func findPkgDefFileIn(path string, exists func(path string) bool) string {
+	if exists(path) || filepath.Base(path) != "sandstorm-pkgdef.capnp" {
+		return path
+	}
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		alt := strings.TrimSuffix(path, ".capnp") + ext
+		if exists(alt) {
+			return alt
+		}
+	}
+	return path
+}
+
+// Report whether `dir` contains a package definition under one of the
+// default names.
+func hasPkgDef(dir string) bool {
+	for ext := range pkgDefFormats {
+		if _, err := os.Stat(filepath.Join(dir, "sandstorm-pkgdef"+ext)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type dataKind int
+
+const (
+	dataNull   dataKind = iota
+	dataScalar          // strings, numbers and booleans
+	dataList
+	dataMap
+)
+
+// A node in a document read from JSON or YAML.
+type dataNode struct {
+	kind dataKind
+	pos  srcPos
+
+	// For scalars, the (unescaped) text of the value, and whether it was
+	// quoted; a quoted scalar is always a string, where e.g. an
+	// unquoted true is a boolean.
+	text   string
+	quoted bool
+
+	// For lists:
+	elems []*dataNode
+
+	// For maps, in the order they appear:
+	fields []*dataField
+}
+
+// An entry in a map.
+type dataField struct {
+	pos   srcPos
+	key   string
+	value *dataNode
+}
+
+// Return the entry of the map with the given key.
+func (n *dataNode) field(key string) (*dataField, bool) {
+	for _, f := range n.fields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Return a quoted scalar node with the value `s`.
+func stringNode(s string) *dataNode {
+	return &dataNode{kind: dataScalar, text: s, quoted: true}
+}
+
+// Return an unquoted scalar node with the text `s`, e.g. a number or an
+// enumerant.
+func plainNode(s string) *dataNode {
+	return &dataNode{kind: dataScalar, text: s}
+}
+
+// Return a map node with a single entry.
+func singletonMap(key string, value *dataNode) *dataNode {
+	return mapNode(&dataField{key: key, value: value})
+}
+
+// Return a map node with the given entries.
+func mapNode(fields ...*dataField) *dataNode {
+	return &dataNode{kind: dataMap, fields: fields}
+}
+
+// Return a list node with the given elements.
+func listNode(elems ...*dataNode) *dataNode {
+	return &dataNode{kind: dataList, elems: elems}
+}
+
+// Add an entry to the map `n`.
+func (n *dataNode) set(key string, value *dataNode) {
+	n.fields = append(n.fields, &dataField{key: key, value: value})
+}
+
+// Parse a JSON or YAML document, according to the extension of filename.
+func parseDataFile(filename string, src []byte) (*dataNode, error) {
+	if pkgDefFormat(filename) == "json" {
+		return parseJSON(filename, src)
+	}
+	return parseYAML(filename, string(src))
+}
+
+// Parse a JSON document.
+func parseJSON(filename string, src []byte) (*dataNode, error) {
+	p := &jsonParser{
+		dec:       json.NewDecoder(bytes.NewReader(src)),
+		src:       src,
+		filename:  filename,
+		lineStart: []int{0},
+	}
+	p.dec.UseNumber()
+	for i, c := range src {
+		if c == '\n' {
+			p.lineStart = append(p.lineStart, i+1)
+		}
+	}
+	n, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, errorAt(p.pos(), "unexpected data after the end of the document")
+	}
+	return n, nil
+}
+
+type jsonParser struct {
+	dec      *json.Decoder
+	src      []byte
+	filename string
+
+	// Offsets of the start of each line in src.
+	lineStart []int
+}
+
+// Return the position of the next token in the input.
+func (p *jsonParser) pos() srcPos {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.src) && strings.IndexByte(" \t\r\n,:", p.src[offset]) >= 0 {
+		offset++
+	}
+	line := sort.Search(len(p.lineStart), func(i int) bool {
+		return p.lineStart[i] > offset
+	})
+	return srcPos{
+		filename: p.filename,
+		line:     line,
+		col:      offset - p.lineStart[line-1] + 1,
+	}
+}
+
+func (p *jsonParser) parseValue() (*dataNode, error) {
+	pos := p.pos()
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, errorAt(pos, "%v", err)
+	}
+	n := &dataNode{pos: pos}
+	switch tok := tok.(type) {
+	case nil:
+		n.kind = dataNull
+	case bool:
+		n.kind = dataScalar
+		n.text = "false"
+		if tok {
+			n.text = "true"
+		}
+	case json.Number:
+		n.kind = dataScalar
+		n.text = tok.String()
+	case string:
+		n.kind = dataScalar
+		n.text = tok
+		n.quoted = true
+	case json.Delim:
+		switch tok {
+		case '[':
+			n.kind = dataList
+			for p.dec.More() {
+				elem, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				n.elems = append(n.elems, elem)
+			}
+		case '{':
+			n.kind = dataMap
+			for p.dec.More() {
+				keyPos := p.pos()
+				key, err := p.dec.Token()
+				if err != nil {
+					return nil, errorAt(keyPos, "%v", err)
+				}
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				n.fields = append(n.fields, &dataField{
+					pos:   keyPos,
+					key:   key.(string),
+					value: value,
+				})
+			}
+		}
+		// The closing delimiter:
+		if _, err := p.dec.Token(); err != nil {
+			return nil, errorAt(p.pos(), "%v", err)
+		}
+	}
+	return n, nil
+}
+
+// Write `n` to `w` as JSON.
+func writeJSON(w io.Writer, n *dataNode) error {
+	buf := &bytes.Buffer{}
+	writeJSONValue(buf, n, "")
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeJSONValue(buf *bytes.Buffer, n *dataNode, indent string) {
+	switch n.kind {
+	case dataNull:
+		buf.WriteString("null")
+	case dataScalar:
+		if !n.quoted && (n.text == "true" || n.text == "false" || isJSONNumber(n.text)) {
+			buf.WriteString(n.text)
+		} else {
+			buf.WriteString(jsonString(n.text))
+		}
+	case dataList:
+		if len(n.elems) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteString("[")
+		for i, elem := range n.elems {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n" + indent + "  ")
+			writeJSONValue(buf, elem, indent+"  ")
+		}
+		buf.WriteString("\n" + indent + "]")
+	case dataMap:
+		if len(n.fields) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteString("{")
+		for i, f := range n.fields {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n" + indent + "  " + jsonString(f.key) + ": ")
+			writeJSONValue(buf, f.value, indent+"  ")
+		}
+		buf.WriteString("\n" + indent + "}")
+	}
+}
+
+// Report whether `s` is a number in JSON syntax.
+func isJSONNumber(s string) bool {
+	var num json.Number
+	return s != "" && json.Unmarshal([]byte(s), &num) == nil
+}
+
+// Return `s` as a JSON string literal.
+func jsonString(s string) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Read a package definition in JSON or YAML format from `filename`, and
+// evaluate it as a struct of type `typeId`. The result is stored as the
+// root of a new message.
+func (e *capnpEvaluator) evalDataFile(filename string, typeId uint64) (capnp.Struct, error) {
+	src, err := e.readFile(filename)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	n, err := parseDataFile(filename, src)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	return e.evalDataNode(n, filename, typeId)
+}
+
+// Evaluate `n`, which was read from (or will be written to) `filename`,
+// as a struct of type `typeId`. The result is stored as the root of a new
+// message.
+func (e *capnpEvaluator) evalDataNode(n *dataNode, filename string, typeId uint64) (capnp.Struct, error) {
+	t := &capnpType{which: schema.Type_Which_structType, id: typeId}
+	v, err := dataToValue(e.schema, t, n)
+	if err != nil {
+		return capnp.Struct{}, err
+	}
+	// The file is only used to resolve embedded paths:
+	file := &capnpFile{filename: filename, decls: map[string]*capnpDecl{}}
+	return e.evalRootValue(v, file, typeId)
+}
+
+// Convert `n` into a value of type `t`, as described at the top of this
+// file. The result is not fully checked; that happens when it is
+// evaluated.
+func dataToValue(idx *schemaIndex, t *capnpType, n *dataNode) (*valueExpr, error) {
+	v := &valueExpr{pos: n.pos}
+	mismatch := func() (*valueExpr, error) {
+		return nil, errorAt(n.pos, "expected a value of type %s", idx.typeName(t))
+	}
+	nameValue := func(name string) (*valueExpr, error) {
+		v.kind = valName
+		v.name = &nameExpr{pos: n.pos, parts: []string{name}}
+		return v, nil
+	}
+	switch t.which {
+	case schema.Type_Which_void:
+		if n.kind == dataNull || (n.kind == dataScalar && !n.quoted && n.text == "void") {
+			return nameValue("void")
+		}
+		return mismatch()
+	case schema.Type_Which_bool:
+		if n.kind == dataScalar && !n.quoted && (n.text == "true" || n.text == "false") {
+			return nameValue(n.text)
+		}
+		return mismatch()
+	case schema.Type_Which_enum:
+		if n.kind != dataScalar || !isIdentifier(n.text) {
+			return mismatch()
+		}
+		return nameValue(n.text)
+	case schema.Type_Which_text, schema.Type_Which_data:
+		if n.kind == dataScalar {
+			v.kind = valString
+			v.text = n.text
+			return v, nil
+		}
+		if n.kind != dataMap || len(n.fields) != 1 || n.fields[0].value.kind != dataScalar {
+			return mismatch()
+		}
+		f := n.fields[0]
+		switch {
+		case f.key == "$embed":
+			v.kind = valEmbed
+			v.text = f.value.text
+			return v, nil
+		case f.key == "$base64" && t.which == schema.Type_Which_data:
+			data, err := base64.StdEncoding.DecodeString(f.value.text)
+			if err != nil {
+				return nil, errorAt(f.value.pos, "invalid base64: %v", err)
+			}
+			v.kind = valData
+			v.text = string(data)
+			return v, nil
+		}
+		return mismatch()
+	case schema.Type_Which_structType:
+		info, err := idx.structInfo(t.id)
+		if err != nil {
+			return nil, err
+		}
+		if n.kind == dataScalar && isLocalizedText(idx, t) {
+			v.kind = valStruct
+			text, _ := dataToValue(idx, builtinTypes["Text"], n)
+			v.fields = []*fieldExpr{{pos: n.pos, name: "defaultText", value: text}}
+			return v, nil
+		}
+		if n.kind != dataMap {
+			return mismatch()
+		}
+		v.kind = valStruct
+		for _, f := range n.fields {
+			field, ok := info.field(f.key)
+			if !ok {
+				return nil, errorAt(f.pos, "%s has no field named %q", idx.typeName(t), f.key)
+			}
+			if f.value.kind == dataNull && (field.typ == nil || field.typ.which != schema.Type_Which_void) {
+				continue
+			}
+			fieldType := field.typ
+			if field.group != 0 {
+				fieldType = &capnpType{which: schema.Type_Which_structType, id: field.group}
+			}
+			value, err := dataToValue(idx, fieldType, f.value)
+			if err != nil {
+				return nil, err
+			}
+			v.fields = append(v.fields, &fieldExpr{pos: f.pos, name: f.key, value: value})
+		}
+		return v, nil
+	case schema.Type_Which_list:
+		if n.kind != dataList {
+			return mismatch()
+		}
+		v.kind = valList
+		for _, elem := range n.elems {
+			value, err := dataToValue(idx, t.elem, elem)
+			if err != nil {
+				return nil, err
+			}
+			v.elems = append(v.elems, value)
+		}
+		return v, nil
+	case schema.Type_Which_interface, schema.Type_Which_anyPointer:
+		return nil, errorAt(n.pos, "values of type %s are not supported", idx.typeName(t))
+	}
+
+	// A number.
+	if n.kind != dataScalar {
+		return mismatch()
+	}
+	text := n.text
+	if strings.HasPrefix(text, "-") {
+		v.negative = true
+		text = text[1:]
+	} else {
+		text = strings.TrimPrefix(text, "+")
+	}
+	switch strings.ToLower(strings.TrimPrefix(text, ".")) {
+	case "inf", "nan":
+		if t.isFloat() {
+			v.kind = valName
+			v.name = &nameExpr{pos: n.pos, parts: []string{strings.ToLower(strings.TrimPrefix(text, "."))}}
+			return v, nil
+		}
+	}
+	v.kind = valNumber
+	v.text = text
+	return v, nil
+}
+
+// Report whether `t` is Sandstorm's LocalizedText.
+func isLocalizedText(idx *schemaIndex, t *capnpType) bool {
+	id, ok := idx.lookup("util.capnp", "LocalizedText")
+	return ok && t.which == schema.Type_Which_structType && t.id == id
+}
+
+// Report whether `s` is a valid identifier in the schema language.
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
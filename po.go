@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file reads and writes gettext PO and POT files, which hold the
+// translations of the texts in the manifest; see l10n.go. We support the
+// parts of the format which translation tools produce for simple
+// catalogs: comments, flags, msgctxt, msgid and msgstr. Plural forms are
+// not used by the manifest; for those, only the singular is read.
+
+// A message to translate: the default text, and the paths of the fields
+// it appears in.
+type poMessage struct {
+	id   string
+	refs []string
+}
+
+// The translations for one locale, read from a PO file.
+type poCatalog struct {
+	filename string
+	locale   string
+
+	// The translations, by msgid. Untranslated and fuzzy entries are
+	// left out, as are those with a msgctxt, which we never generate.
+	messages map[string]string
+}
+
+// Write a POT file (a PO file template) containing `msgs` to `w`.
+func writePOT(w io.Writer, msgs []poMessage) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("# Translatable texts of the package. Generated by docker-spk l10n extract.\n")
+	buf.WriteString("msgid \"\"\n")
+	buf.WriteString("msgstr \"\"\n")
+	buf.WriteString("\"Content-Type: text/plain; charset=UTF-8\\n\"\n")
+	for _, msg := range msgs {
+		buf.WriteString("\n")
+		for _, ref := range msg.refs {
+			buf.WriteString("#: " + ref + "\n")
+		}
+		writePOString(buf, "msgid", msg.id)
+		buf.WriteString("msgstr \"\"\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write the keyword `keyword` followed by `s`, quoted. Text containing
+// newlines is split into one quoted string per line, as gettext does.
+func writePOString(buf *bytes.Buffer, keyword, s string) {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= 1 {
+		buf.WriteString(keyword + " " + poQuote(s) + "\n")
+		return
+	}
+	buf.WriteString(keyword + " \"\"\n")
+	for _, line := range lines {
+		buf.WriteString(poQuote(line) + "\n")
+	}
+}
+
+// Return `s` as a quoted string in a PO file.
+func poQuote(s string) string {
+	r := strings.NewReplacer(
+		"\\", "\\\\",
+		"\"", "\\\"",
+		"\n", "\\n",
+		"\t", "\\t",
+		"\r", "\\r",
+	)
+	return "\"" + r.Replace(s) + "\""
+}
+
+// Decode a quoted string in a PO file, which appears at `pos`.
+func poUnquote(s string, pos srcPos) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", errorAt(pos, "expected a quoted string")
+	}
+	s = s[1 : len(s)-1]
+	buf := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			return "", errorAt(pos, "unescaped '\"' in string")
+		}
+		if c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errorAt(pos, "string ends with a backslash")
+		}
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'v':
+			buf.WriteByte('\v')
+		case '\\', '"', '\'', '?':
+			buf.WriteByte(s[i])
+		default:
+			return "", errorAt(pos, "invalid escape sequence \\%c", s[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+// Parse the PO file `filename`, with the contents `src`. The locale is
+// taken from the Language header, or failing that from the name of the
+// file (e.g. de.po or pt_BR.po). Underscores are replaced with hyphens,
+// as Sandstorm expects locales like pt-BR.
+func parsePO(filename string, src []byte) (*poCatalog, error) {
+	cat := &poCatalog{filename: filename, messages: map[string]string{}}
+	language := ""
+
+	type entry struct {
+		ctxt, id, str *string
+		fuzzy         bool
+
+		// Whether we have seen the msgstr, i.e. the entry is complete.
+		seen bool
+	}
+	cur := entry{}
+	var last *string
+	flush := func() {
+		if cur.id != nil && cur.str != nil {
+			switch {
+			case *cur.id == "" && cur.ctxt == nil:
+				// The header.
+				for _, line := range strings.Split(*cur.str, "\n") {
+					if strings.HasPrefix(line, "Language:") {
+						language = strings.TrimSpace(strings.TrimPrefix(line, "Language:"))
+					}
+				}
+			case cur.ctxt == nil && !cur.fuzzy && *cur.str != "":
+				cat.messages[*cur.id] = *cur.str
+			}
+		}
+		cur = entry{}
+		last = nil
+	}
+
+	for i, line := range strings.Split(string(src), "\n") {
+		pos := srcPos{filename: filename, line: i + 1, col: 1}
+		line = strings.TrimSpace(line)
+		keyword, rest := line, ""
+		if j := strings.IndexAny(line, " \t"); j >= 0 {
+			keyword, rest = line[:j], strings.TrimSpace(line[j:])
+		}
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "#~"):
+			// An obsolete entry.
+		case strings.HasPrefix(line, "#,"):
+			if cur.seen {
+				flush()
+			}
+			for _, flag := range strings.Split(line[2:], ",") {
+				if strings.TrimSpace(flag) == "fuzzy" {
+					cur.fuzzy = true
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "\""):
+			if last == nil {
+				return nil, errorAt(pos, "string without a keyword")
+			}
+			s, err := poUnquote(line, pos)
+			if err != nil {
+				return nil, err
+			}
+			*last += s
+		case keyword == "msgctxt" || keyword == "msgid" || keyword == "msgid_plural" ||
+			keyword == "msgstr" || strings.HasPrefix(keyword, "msgstr["):
+			s, err := poUnquote(rest, pos)
+			if err != nil {
+				return nil, err
+			}
+			if cur.seen && (keyword == "msgctxt" || keyword == "msgid") {
+				// The previous entry wasn't followed by a blank line.
+				flush()
+			}
+			switch keyword {
+			case "msgctxt":
+				cur.ctxt = &s
+				last = cur.ctxt
+			case "msgid":
+				cur.id = &s
+				last = cur.id
+			case "msgstr", "msgstr[0]":
+				cur.str = &s
+				last = cur.str
+				cur.seen = true
+			default:
+				// msgid_plural and the other plural forms.
+				last = new(string)
+			}
+		default:
+			return nil, errorAt(pos, "unexpected %q", keyword)
+		}
+	}
+	flush()
+
+	cat.locale = language
+	if cat.locale == "" {
+		cat.locale = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	cat.locale = strings.Replace(cat.locale, "_", "-", -1)
+	return cat, nil
+}
+
+// Read all of the PO files (*.po) in `dir`, sorted by locale.
+func loadPOFiles(dir string) ([]*poCatalog, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.po"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+	cats := []*poCatalog{}
+	locales := map[string]string{}
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cat, err := parsePO(path, src)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := locales[cat.locale]; ok {
+			return nil, fmt.Errorf("%s and %s both contain translations for %s",
+				other, path, cat.locale)
+		}
+		locales[cat.locale] = path
+		cats = append(cats, cat)
+	}
+	sort.Slice(cats, func(i, j int) bool {
+		return cats[i].locale < cats[j].locale
+	})
+	return cats, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePO(t *testing.T) {
+	for _, c := range []struct {
+		filename, src string
+		locale        string
+		messages      map[string]string
+	}{
+		{"de.po", `# A comment.
+msgid ""
+msgstr ""
+"Content-Type: text/plain; charset=UTF-8\n"
+
+#: manifest.appTitle
+msgid "Example"
+msgstr "Beispiel"
+
+#: manifest.metadata.shortDescription
+msgid "Untranslated"
+msgstr ""
+`, "de", map[string]string{"Example": "Beispiel"}},
+		// The Language header takes precedence over the file name, and
+		// underscores become hyphens either way:
+		{"po/de.po", "msgid \"\"\nmsgstr \"Language: pt_BR\\n\"\n\nmsgid \"a\"\nmsgstr \"b\"\n",
+			"pt-BR", map[string]string{"a": "b"}},
+		{"po/pt_BR.po", "msgid \"a\"\nmsgstr \"b\"\n", "pt-BR", map[string]string{"a": "b"}},
+		{"de.po", "msgid \"\"\nmsgstr \"\"\n\"Project-Id-Version: 1\\n\"\n\"Language: fr\\n\"\n",
+			"fr", map[string]string{}},
+		// Fuzzy entries and those with a msgctxt are left out:
+		{"de.po", `#, fuzzy
+msgid "a"
+msgstr "A"
+
+#, c-format, fuzzy
+msgid "b"
+msgstr "B"
+
+#, c-format
+msgid "c"
+msgstr "C"
+
+msgctxt "menu"
+msgid "d"
+msgstr "D"
+`, "de", map[string]string{"c": "C"}},
+		// Strings continued on the following lines:
+		{"de.po", `msgid ""
+"Line one\n"
+"line two"
+msgstr ""
+"Zeile eins\n"
+"Zeile zwei"
+`, "de", map[string]string{"Line one\nline two": "Zeile eins\nZeile zwei"}},
+		// Obsolete entries:
+		{"de.po", `msgid "a"
+msgstr "A"
+
+#~ msgid "b"
+#~ msgstr "B"
+`, "de", map[string]string{"a": "A"}},
+		// Only the singular of plural forms is used:
+		{"de.po", `msgid "file"
+msgid_plural "files"
+msgstr[0] "Datei"
+msgstr[1] ""
+"Dateien"
+
+msgid "a"
+msgstr "A"
+`, "de", map[string]string{"file": "Datei", "a": "A"}},
+		// Entries which aren't separated by blank lines:
+		{"de.po", `msgid "a"
+msgstr "A"
+#, fuzzy
+msgid "b"
+msgstr "B"
+#: manifest.appTitle
+msgid "c"
+msgstr "C"
+msgctxt "menu"
+msgid "d"
+msgstr "D"
+msgid "e"
+msgstr "E"
+`, "de", map[string]string{"a": "A", "c": "C", "e": "E"}},
+		{"de.po", `msgid "Say \"hi\"\tnow\\"
+msgstr "Sag \"Hallo\"\tjetzt\\"
+`, "de", map[string]string{"Say \"hi\"\tnow\\": "Sag \"Hallo\"\tjetzt\\"}},
+	} {
+		cat, err := parsePO(c.filename, []byte(c.src))
+		if err != nil {
+			t.Errorf("parsing %s:\n%s\n%v", c.filename, c.src, err)
+			continue
+		}
+		if cat.locale != c.locale {
+			t.Errorf("parsing %s:\n%s\ngot locale %q, want %q", c.filename, c.src, cat.locale, c.locale)
+		}
+		if !reflect.DeepEqual(cat.messages, c.messages) {
+			t.Errorf("parsing %s:\n%s\n got: %q\nwant: %q", c.filename, c.src, cat.messages, c.messages)
+		}
+	}
+}
+
+func TestParsePOErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"\"a\"\n", `de.po:1:1: string without a keyword`},
+		{"msgid \"a\"\nmsgstr \"b\"\n\n\"c\"\n", `de.po:4:1: string without a keyword`},
+		{"msgid a\n", `de.po:1:1: expected a quoted string`},
+		{"msgid \"a\nmsgstr \"b\"\n", `de.po:1:1: expected a quoted string`},
+		{"msgid \"a\"b\"\n", `de.po:1:1: unescaped '"' in string`},
+		{"msgid \"a\\x41\"\n", `de.po:1:1: invalid escape sequence \x`},
+		{"msgid \"a\"\nmsgstr \"b\\\"\n", `de.po:2:1: string ends with a backslash`},
+		{"msgid \"a\"\nmsgtxt \"b\"\n", `de.po:2:1: unexpected "msgtxt"`},
+	} {
+		_, err := parsePO("de.po", []byte(c.src))
+		if err == nil {
+			t.Errorf("parsing %q: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("parsing %q:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
+
+// Translations from PO files should be added to the texts in the
+// manifest, but not replace localizations the package definition has.
+func TestAddTranslations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-spk-po")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "sandstorm-pkgdef.yaml")
+	err = ioutil.WriteFile(filename, []byte(`id: 8anwd8gxasmhav7uu869eamag7rqhxczd86a6fcz5nktuk02mkth
+manifest:
+  appTitle:
+    defaultText: Example
+    localizations:
+      - {locale: de, text: Ein Beispiel}
+  appVersion: 1
+  appMarketingVersion: {defaultText: "1.0"}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDef, err := readPackageDefinition(filename, "pkgdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := pkgDef.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cats := []*poCatalog{}
+	for _, src := range []string{
+		"msgid \"\"\nmsgstr \"Language: de\\n\"\n\nmsgid \"Example\"\nmsgstr \"Beispiel\"\n",
+		"msgid \"\"\nmsgstr \"Language: fr\\n\"\n\nmsgid \"Example\"\nmsgstr \"Exemple\"\n",
+	} {
+		cat, err := parsePO("test.po", []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cats = append(cats, cat)
+	}
+	idx, err := sandstormSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addTranslations(idx, "manifest", manifest.Struct, cats); err != nil {
+		t.Fatal(err)
+	}
+
+	title, err := manifest.AppTitle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := title.Localizations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for i := 0; i < list.Len(); i++ {
+		locale, _ := list.At(i).Locale()
+		text, _ := list.At(i).Text()
+		got[locale] = text
+	}
+	want := map[string]string{"de": "Ein Beispiel", "fr": "Exemple"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got localizations %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/ulikunitz/xz"
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// This file implements the -previous flag, which checks a new package
+// against the previous release of the app, so that Sandstorm will accept
+// it as an update.
+
+// The magic number at the start of every spk; see magicNumber in
+// package.capnp.
+var spkMagic = []byte("\x8f\xc6\xcd\xef\x45\x1a\xea\x96")
+
+// Return the app id and the manifest of the spk in the file `filename`.
+// The signature is not verified; we only use this on packages we built.
+func readSpkManifest(filename string) (appId spk.AppId, manifest capnp_spk.Manifest, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(spkMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, spkMagic) {
+		return spk.AppId{}, capnp_spk.Manifest{}, fmt.Errorf("%s is not an spk", filename)
+	}
+	xzReader, err := xz.NewReader(r)
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Decompressing the spk", err)
+	}
+
+	// The spk consists of a Signature and then an Archive. The archive
+	// contains the whole app, which may well be bigger than the
+	// decoder's and the message's default limits.
+	dec := capnp.NewDecoder(xzReader)
+	dec.MaxMessageSize = math.MaxUint64
+	sigMsg, err := dec.Decode()
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the signature", err)
+	}
+	sig, err := capnp_spk.ReadRootSignature(sigMsg)
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the signature", err)
+	}
+	publicKey, err := sig.PublicKey()
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the signature", err)
+	}
+	if len(publicKey) != len(appId) {
+		return spk.AppId{}, capnp_spk.Manifest{}, fmt.Errorf("the signature's public key is %d bytes, not %d",
+			len(publicKey), len(appId))
+	}
+	copy(appId[:], publicKey)
+
+	archiveMsg, err := dec.Decode()
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the archive", err)
+	}
+	archiveMsg.TraverseLimit = math.MaxUint64
+	archive, err := capnp_spk.ReadRootArchive(archiveMsg)
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the archive", err)
+	}
+	files, err := archive.Files()
+	if err != nil {
+		return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the archive", err)
+	}
+	for i := 0; i < files.Len(); i++ {
+		f := files.At(i)
+		name, err := f.Name()
+		if err != nil {
+			return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading the archive", err)
+		}
+		if name != "sandstorm-manifest" || f.Which() != capnp_spk.Archive_File_Which_regular {
+			continue
+		}
+		data, err := f.Regular()
+		if err != nil {
+			return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Reading sandstorm-manifest", err)
+		}
+		msg, err := capnp.Unmarshal(data)
+		if err != nil {
+			return spk.AppId{}, capnp_spk.Manifest{}, wrapErr("Unmarshalling sandstorm-manifest", err)
+		}
+		manifest, err := capnp_spk.ReadRootManifest(msg)
+		return appId, manifest, wrapErr("Reading sandstorm-manifest", err)
+	}
+	return spk.AppId{}, capnp_spk.Manifest{}, fmt.Errorf("%s has no sandstorm-manifest", filename)
+}
+
+// Check that the package described by `metadata`, signed with the key for
+// `appId`, may be installed as an update to the spk `previous`: it must be
+// for the same app, and have a higher appVersion. Warns if the marketing
+// version goes down, to `warnings`.
+func checkPrevious(previous string, metadata *pkgMetadata, appId spk.AppId, warnings io.Writer) error {
+	oldAppId, oldManifest, err := readSpkManifest(previous)
+	if err != nil {
+		return err
+	}
+	if oldAppId != appId {
+		return fmt.Errorf("the app id is %s, but %s is for the app %s; Sandstorm would "+
+			"install the package as a different app", appId, previous, oldAppId)
+	}
+	oldVersion := oldManifest.AppVersion()
+	if metadata.appVersion <= oldVersion {
+		return fmt.Errorf("the appVersion is %d, but %s has appVersion %d; it must be higher "+
+			"for Sandstorm to accept the package as an update", metadata.appVersion, previous, oldVersion)
+	}
+	text, err := oldManifest.AppMarketingVersion()
+	if err != nil {
+		return wrapErr("Reading the previous appMarketingVersion", err)
+	}
+	oldMarketingVersion, err := text.DefaultText()
+	if err != nil {
+		return wrapErr("Reading the previous appMarketingVersion", err)
+	}
+	if compareMarketingVersions(metadata.version, oldMarketingVersion) < 0 {
+		fwarnf(warnings, "the appMarketingVersion %q is lower than %q, the version of %s",
+			metadata.version, oldMarketingVersion, previous)
+	}
+	return nil
+}
+
+// Compare the marketing versions a and b, returning -1, 0 or 1 as a is
+// lower than, the same as or higher than b. Runs of digits are compared
+// as numbers, and everything else as text, so that e.g. 1.10 > 1.9.
+func compareMarketingVersions(a, b string) int {
+	for a != "" && b != "" {
+		var partA, partB string
+		partA, a = versionPart(a)
+		partB, b = versionPart(b)
+		numA, errA := strconv.ParseUint(partA, 10, 64)
+		numB, errB := strconv.ParseUint(partB, 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if numA != numB {
+				if numA < numB {
+					return -1
+				}
+				return 1
+			}
+		case partA != partB:
+			if partA < partB {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Split `s` into its first part, a run of digits or of other characters,
+// and the rest.
+func versionPart(s string) (part, rest string) {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
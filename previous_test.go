@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	capnp_spk "zenhack.net/go/sandstorm/capnp/spk"
+	"zenhack.net/go/sandstorm/exp/spk"
+	"zombiezen.com/go/capnproto2"
+)
+
+// Pack a package whose archive is bigger than the capnp decoder's
+// default limit on the size of messages, and check that the app id and
+// manifest can be read back from it.
+func TestReadSpkManifest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("packing a large spk is slow")
+	}
+	dir, err := ioutil.TempDir("", "docker-spk-previous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKeyringPath := *keyringPath
+	defer func() { *keyringPath = oldKeyringPath }()
+	*keyringPath = filepath.Join(dir, "keyring")
+	id, err := generateAppKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appId spk.AppId
+	if err := (&appId).UnmarshalText([]byte(id)); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := spk.LoadKeyring(*keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appKey, err := keyring.GetKey(appId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := capnp_spk.NewRootManifest(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.SetAppVersion(3)
+	marketingVersion, err := manifest.NewAppMarketingVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := marketingVersion.SetDefaultText("1.0"); err != nil {
+		t.Fatal(err)
+	}
+	manifestBytes, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := Tree{"big": &File{data: make([]byte, 65<<20)}}
+	archive, err := archiveFromImage(nil, tree, manifestBytes, []byte{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "app.spk")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = spk.PackInto(f, appKey, archive)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotAppId, gotManifest, err := readSpkManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotAppId != appId {
+		t.Errorf("got app id %s, want %s", gotAppId, appId)
+	}
+	if v := gotManifest.AppVersion(); v != 3 {
+		t.Errorf("got appVersion %d, want 3", v)
+	}
+	text, err := gotManifest.AppMarketingVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := text.DefaultText(); err != nil || v != "1.0" {
+		t.Errorf("got appMarketingVersion %q (%v), want \"1.0\"", v, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file reads the project config: settings for building the app
+// which don't belong in the package definition. It lives next to the
+// package definition, in docker-spk.yaml (or .yml or .json), e.g.:
+//
+//	importPath:
+//	  - ../schema
+//	profiles:
+//	  beta:
+//	    appId: vjpyv8x5tdq2zp4ws6r9x7dpdsyypdhx7c7vy34y0c9n1v4pun8h
+//	    titleSuffix: " (Beta)"
+//	    versionSuffix: "-beta"
+//	    keyring: ~/.sandstorm-beta-keyring
+
+// The names the project config may have, in order of preference.
+var projectConfigNames = []string{"docker-spk.yaml", "docker-spk.yml", "docker-spk.json"}
+
+type projectConfig struct {
+	filename string
+
+	// Directories added to the import path after those given with -I.
+	// Relative paths are relative to the project config.
+	importPath []string
+
+	// Named sets of overrides, selected with -profile.
+	profiles map[string]*profile
+}
+
+// A build profile, e.g. for a beta release of the app, which is
+// installed alongside the stable one. Empty strings mean "leave the
+// setting alone".
+type profile struct {
+	name string
+
+	// Sign the package with this app id's key, as with -appkey.
+	appId string
+
+	// Appended to the app's title and marketing version.
+	titleSuffix, versionSuffix string
+
+	// The file name of the spk, as with -out, and the keyring, as with
+	// -keyring. Relative paths are relative to the project config.
+	out, keyring string
+}
+
+// Read the project config in `dir`. Returns nil if there is none.
+func loadProjectConfig(dir string) (*projectConfig, error) {
+	for _, name := range projectConfigNames {
+		filename := filepath.Join(dir, name)
+		src, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseProjectConfig(filename, src)
+	}
+	return nil, nil
+}
+
+// Parse the project config `filename`, whose contents are `src`.
+func parseProjectConfig(filename string, src []byte) (*projectConfig, error) {
+	root, err := parseDataFile(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &projectConfig{filename: filename, profiles: map[string]*profile{}}
+	if root.kind == dataNull {
+		// An empty file.
+		return cfg, nil
+	}
+	if root.kind != dataMap {
+		return nil, errorAt(root.pos, "expected a map")
+	}
+	for _, f := range root.fields {
+		switch f.key {
+		case "importPath":
+			if f.value.kind != dataList {
+				return nil, errorAt(f.value.pos, "expected a list of directories")
+			}
+			for _, dir := range f.value.elems {
+				if dir.kind != dataScalar {
+					return nil, errorAt(dir.pos, "expected a string")
+				}
+				cfg.importPath = append(cfg.importPath, projectPath(filepath.Dir(filename), dir.text))
+			}
+		case "profiles":
+			if f.value.kind != dataMap {
+				return nil, errorAt(f.value.pos, "expected a map from profile names to profiles")
+			}
+			for _, pf := range f.value.fields {
+				p, err := parseProfile(filepath.Dir(filename), pf.key, pf.value)
+				if err != nil {
+					return nil, err
+				}
+				cfg.profiles[p.name] = p
+			}
+		default:
+			return nil, errorAt(f.pos, "unknown setting %q", f.key)
+		}
+	}
+	return cfg, nil
+}
+
+// Parse the profile named `name`, from the project config in `dir`.
+func parseProfile(dir, name string, n *dataNode) (*profile, error) {
+	if n.kind != dataMap {
+		return nil, errorAt(n.pos, "expected a map")
+	}
+	p := &profile{name: name}
+	for _, f := range n.fields {
+		if f.value.kind != dataScalar {
+			return nil, errorAt(f.value.pos, "expected a string")
+		}
+		value := f.value.text
+		switch f.key {
+		case "appId":
+			p.appId = value
+		case "titleSuffix":
+			p.titleSuffix = value
+		case "versionSuffix":
+			p.versionSuffix = value
+		case "out":
+			p.out = projectPath(dir, value)
+		case "keyring":
+			p.keyring = projectPath(dir, value)
+		default:
+			return nil, errorAt(f.pos, "profile %q: unknown setting %q", name, f.key)
+		}
+	}
+	return p, nil
+}
+
+// Return `path`, from the project config in `dir`, relative to the
+// working directory. A leading ~/ stands for the home directory.
+func projectPath(dir, path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Return the import path for the package definition in `dir`: the
+// directories given with -I, followed by those in the project config.
+func importPathFor(dir string) ([]string, error) {
+	importPath := append([]string{}, importDirs...)
+	cfg, err := loadProjectConfig(dir)
+	if err != nil {
+		return importPath, wrapErr("Reading the project config", err)
+	}
+	if cfg != nil {
+		importPath = append(importPath, cfg.importPath...)
+	}
+	return importPath, nil
+}
+
+// Return the profile named `name`.
+func (cfg *projectConfig) profile(name string) (*profile, error) {
+	p, ok := cfg.profiles[name]
+	if !ok {
+		names := make([]string, 0, len(cfg.profiles))
+		for name := range cfg.profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%s has no profile named %q (it has: %s)",
+			cfg.filename, name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// Apply the profile given by -profile, if any, from the project config
+// next to the package definition. Flags given explicitly take precedence
+// over the profile.
+func (f *buildFlags) applyProfile() error {
+	if f.profile == "" {
+		return nil
+	}
+	cfg, err := loadProjectConfig(filepath.Dir(f.pkgDefFile))
+	if err != nil {
+		return wrapErr("Reading the project config", err)
+	}
+	if cfg == nil {
+		return fmt.Errorf("-profile was given, but there is no %s in %s",
+			projectConfigNames[0], filepath.Dir(f.pkgDefFile))
+	}
+	p, err := cfg.profile(f.profile)
+	if err != nil {
+		return err
+	}
+	f.useProfile(p, flagsSet())
+	return nil
+}
+
+// Apply the profile `p`. `explicit` holds the names of the flags given
+// explicitly, as returned by flagsSet.
+func (f *buildFlags) useProfile(p *profile, explicit map[string]bool) {
+	if f.altAppKey == "" {
+		f.altAppKey = p.appId
+	}
+	if f.outFilename == "" {
+		f.outFilename = p.out
+	}
+	if !explicit["keyring"] && p.keyring != "" {
+		f.keyring = p.keyring
+	}
+	f.titleSuffix = p.titleSuffix
+	f.versionSuffix = p.versionSuffix
+}
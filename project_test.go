@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProjectProfile(t *testing.T) {
+	const config = `importPath: [../schema, /usr/include, ~/capnp]
+profiles:
+  beta:
+    appId: vjpyv8x5tdq2zp4ws6r9x7dpdsyypdhx7c7vy34y0c9n1v4pun8h
+    titleSuffix: " (Beta)"
+    versionSuffix: -beta
+    out: dist/beta.spk
+    keyring: ~/.sandstorm-beta-keyring
+  local:
+    keyring: keys/keyring
+    out: /tmp/local.spk
+`
+	dir := filepath.Join("project", "app")
+	home := os.Getenv("HOME")
+	cfg, err := parseProjectConfig(filepath.Join(dir, "docker-spk.yaml"), []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantImportPath := []string{filepath.Join("project", "schema"), "/usr/include", filepath.Join(home, "capnp")}
+	if !reflect.DeepEqual(cfg.importPath, wantImportPath) {
+		t.Errorf("got importPath %q, want %q", cfg.importPath, wantImportPath)
+	}
+
+	for _, c := range []struct {
+		profile  string
+		flags    buildFlags
+		explicit map[string]bool
+		want     buildFlags
+	}{
+		{"beta", buildFlags{}, nil, buildFlags{
+			altAppKey:     "vjpyv8x5tdq2zp4ws6r9x7dpdsyypdhx7c7vy34y0c9n1v4pun8h",
+			outFilename:   filepath.Join(dir, "dist", "beta.spk"),
+			keyring:       filepath.Join(home, ".sandstorm-beta-keyring"),
+			titleSuffix:   " (Beta)",
+			versionSuffix: "-beta",
+		}},
+		// Flags given explicitly win over the profile:
+		{"beta",
+			buildFlags{altAppKey: "other", outFilename: "mine.spk"},
+			map[string]bool{"appkey": true, "out": true, "keyring": true},
+			buildFlags{
+				altAppKey:     "other",
+				outFilename:   "mine.spk",
+				titleSuffix:   " (Beta)",
+				versionSuffix: "-beta",
+			}},
+		{"local", buildFlags{altAppKey: "other"}, map[string]bool{"appkey": true}, buildFlags{
+			altAppKey:   "other",
+			outFilename: "/tmp/local.spk",
+			keyring:     filepath.Join(dir, "keys", "keyring"),
+		}},
+	} {
+		p, err := cfg.profile(c.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := c.flags
+		got.useProfile(p, c.explicit)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("applying %s to %+v with %v:\n got: %+v\nwant: %+v",
+				c.profile, c.flags, c.explicit, got, c.want)
+		}
+	}
+}
+
+func TestProjectConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"- a\n", "docker-spk.yaml:1:1: expected a map"},
+		{"importPath: ../schema\n", "docker-spk.yaml:1:13: expected a list of directories"},
+		{"profiles:\n  beta:\n    out: [a]\n", "docker-spk.yaml:3:10: expected a string"},
+		{"profiles:\n  beta:\n    appid: x\n", `docker-spk.yaml:3:5: profile "beta": unknown setting "appid"`},
+		{"profile: {}\n", `docker-spk.yaml:1:1: unknown setting "profile"`},
+	} {
+		_, err := parseProjectConfig("docker-spk.yaml", []byte(c.src))
+		if err == nil {
+			t.Errorf("parsing %q: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("parsing %q:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -48,6 +49,65 @@ func (t Tree) Merge(other Tree) {
 	}
 }
 
+// Return the file at the absolute path `p` within the tree, following
+// symlinks, or nil if there is no such file.
+func (t Tree) lookup(p string) *File {
+	root := &File{kids: t}
+	parts := strings.Split(p, "/")
+	// The directories leading to cur, for resolving "..":
+	parents := []*File{}
+	cur := root
+	for links := 0; len(parts) > 0; {
+		name := parts[0]
+		parts = parts[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(parents) > 0 {
+				cur = parents[len(parents)-1]
+				parents = parents[:len(parents)-1]
+			}
+			continue
+		}
+		if !cur.isDir() {
+			return nil
+		}
+		next, ok := cur.kids[name]
+		if !ok {
+			return nil
+		}
+		if next.target != "" {
+			// A symlink; splice the target into the path.
+			if links++; links > 40 {
+				return nil
+			}
+			if strings.HasPrefix(next.target, "/") {
+				cur = root
+				parents = parents[:0]
+			}
+			parts = append(strings.Split(next.target, "/"), parts...)
+			continue
+		}
+		parents = append(parents, cur)
+		cur = next
+	}
+	return cur
+}
+
+// Return the contents of the regular file at the absolute path `path` in
+// the tree, following symlinks.
+func (t Tree) readFile(path string) ([]byte, error) {
+	f := t.lookup(path)
+	switch {
+	case f == nil:
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	case f.data == nil:
+		return nil, &os.PathError{Op: "read", Path: path, Err: errors.New("not a regular file")}
+	}
+	return f.data, nil
+}
+
 // Convert the tree into an sandstorm pacakge archive.
 func (t Tree) ToArchive(dest spk.Archive) error {
 	files, err := dest.NewFiles(int32(len(t)))
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A variant of the app, built from the same project with different
+// settings; see the -variant flag to the build command.
+type variant struct {
+	name string
+
+	// Overrides for the corresponding flags; empty strings mean "use
+	// the value of the flag".
+	target, pkgDef, appKey, out, profile string
+}
+
+// Parse a variant from its command line representation, which is of the
+// form <name>[,<key>=<value>...].
+func parseVariant(spec string) (*variant, error) {
+	parts := strings.Split(spec, ",")
+	v := &variant{name: parts[0]}
+	if v.name == "" || strings.Contains(v.name, "=") {
+		return nil, fmt.Errorf("variant %q does not start with a name", spec)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("variant %q: expected <key>=<value>, but got %q", v.name, part)
+		}
+		switch kv[0] {
+		case "target":
+			v.target = kv[1]
+		case "pkg-def":
+			if !strings.Contains(kv[1], ":") && pkgDefFormat(kv[1]) == "capnp" {
+				return nil, fmt.Errorf(
+					"variant %q: pkg-def must be of the form <def-file>:<name>",
+					v.name,
+				)
+			}
+			v.pkgDef = kv[1]
+		case "appkey":
+			v.appKey = kv[1]
+		case "out":
+			v.out = kv[1]
+		case "profile":
+			v.profile = kv[1]
+		default:
+			return nil, fmt.Errorf("variant %q: unknown key %q", v.name, kv[0])
+		}
+	}
+	return v, nil
+}
+
+// Return a copy of bFlags, with the settings overridden by the variant.
+func (v *variant) apply(bFlags *buildCmdFlags) *buildCmdFlags {
+	ret := *bFlags
+	ret.variants = nil
+	ret.variant = v.name
+	if v.target != "" {
+		ret.target = v.target
+	}
+	if v.appKey != "" {
+		ret.altAppKey = v.appKey
+	}
+	if v.out != "" {
+		ret.outFilename = v.out
+	}
+	if v.profile != "" {
+		ret.profile = v.profile
+	}
+	if v.pkgDef != "" {
+		ret.pkgDef = v.pkgDef
+		if !ret.splitPkgDef() {
+			// parseVariant() should have ruled this out.
+			panic("impossible")
+		}
+		ret.resolvePkgDefFile()
+	}
+	return &ret
+}
+
+// Return the flags for building each of the variants in `f`, as for
+// apply, with their profiles applied. Returns an error if two variants
+// would be written to the same file, since the second would overwrite
+// the first (and its build state).
+func (f variantListFlag) resolve(bFlags *buildCmdFlags) ([]*buildCmdFlags, error) {
+	ret := make([]*buildCmdFlags, len(f))
+	outputs := map[string]string{}
+	for i, v := range f {
+		ret[i] = v.apply(bFlags)
+		if err := ret[i].applyProfile(); err != nil {
+			return nil, wrapErr("variant "+v.name, err)
+		}
+		out := ret[i].outFilename
+		if out == "" {
+			// Inferred from the metadata and the variant's
+			// name, and so different from the others.
+			continue
+		}
+		out = filepath.Clean(out)
+		if other, ok := outputs[out]; ok {
+			return nil, fmt.Errorf("variants %q and %q would both be written to %s",
+				other, v.name, out)
+		}
+		outputs[out] = v.name
+	}
+	return ret, nil
+}
+
+// A flag.Value holding the variants specified by -variant.
+type variantListFlag []*variant
+
+func (f *variantListFlag) String() string {
+	names := make([]string, len(*f))
+	for i, v := range *f {
+		names[i] = v.name
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *variantListFlag) Set(value string) error {
+	v, err := parseVariant(value)
+	if err != nil {
+		return err
+	}
+	for _, other := range *f {
+		if other.name == v.name {
+			return fmt.Errorf("variant %q specified more than once", v.name)
+		}
+	}
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Return the app version and marketing version to use instead of the ones
+// in the package definition, as given by the flags: appVersion is nil and
+// marketingVersion is "" if they should not be overridden. With
+// -version-from-git, they are derived from the git repository containing
+// the package definition, unless given explicitly.
+func (f *buildFlags) versionOverrides() (appVersion *uint32, marketingVersion string, err error) {
+	if f.appVersion != "" {
+		v, err := parseAppVersion(f.appVersion)
+		if err != nil {
+			return nil, "", err
+		}
+		appVersion = &v
+	}
+	marketingVersion = f.marketingVersion
+	if f.versionFromGit && (appVersion == nil || marketingVersion == "") {
+		dir := filepath.Dir(f.pkgDefFile)
+		if appVersion == nil {
+			// In a shallow clone (the default in many CI systems),
+			// the commit count is just the depth of the clone, so
+			// it wouldn't go up from one release to the next.
+			shallow, err := gitOutput(dir, "rev-parse", "--is-shallow-repository")
+			if err != nil {
+				return nil, "", err
+			}
+			if shallow == "true" {
+				return nil, "", fmt.Errorf("%s is in a shallow clone, so the number of "+
+					"commits can't be used as the app version; fetch the full history "+
+					"(e.g. git fetch --unshallow) or pass -app-version", f.pkgDefFile)
+			}
+			count, err := gitOutput(dir, "rev-list", "--count", "HEAD")
+			if err != nil {
+				return nil, "", err
+			}
+			v, err := parseAppVersion(count)
+			if err != nil {
+				return nil, "", err
+			}
+			appVersion = &v
+		}
+		if marketingVersion == "" {
+			describe, err := gitOutput(dir, "describe", "--tags", "--always", "--dirty")
+			if err != nil {
+				return nil, "", err
+			}
+			marketingVersion = marketingVersionFromTag(describe)
+		}
+	}
+	return appVersion, marketingVersion, nil
+}
+
+// Parse an appVersion, which must fit in a UInt32.
+func parseAppVersion(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid app version; it must be a "+
+			"non-negative integer less than 2^32", s)
+	}
+	return uint32(v), nil
+}
+
+// Return the marketing version for the output of git describe, dropping
+// the "v" in front of tags like v1.2.3.
+func marketingVersionFromTag(describe string) string {
+	if len(describe) > 1 && describe[0] == 'v' && isDigit(describe[1]) {
+		return describe[1:]
+	}
+	return describe
+}
+
+// Run git with the given arguments in the directory `dir`, and return its
+// output, with surrounding whitespace removed.
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", wrapErr("Running git "+strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run git in `dir`, failing the test if it fails.
+func runGit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestVersionFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "docker-spk-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "init", "-q")
+	for i := 0; i < 3; i++ {
+		runGit(t, repo, "commit", "-q", "--allow-empty", "-m", "commit")
+	}
+	runGit(t, repo, "tag", "v1.2.0")
+
+	f := &buildFlags{
+		pkgDefFile:     filepath.Join(repo, "sandstorm-pkgdef.capnp"),
+		versionFromGit: true,
+	}
+	appVersion, marketingVersion, err := f.versionOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appVersion == nil || *appVersion != 3 || marketingVersion != "1.2.0" {
+		t.Errorf("got versions %v, %q; want 3, \"1.2.0\"", appVersion, marketingVersion)
+	}
+
+	// The commit count of a shallow clone is meaningless:
+	clone := filepath.Join(dir, "clone")
+	runGit(t, dir, "clone", "-q", "--depth", "1", "file://"+repo, clone)
+	f.pkgDefFile = filepath.Join(clone, "sandstorm-pkgdef.capnp")
+	if _, _, err := f.versionOverrides(); err == nil || !strings.Contains(err.Error(), "shallow clone") {
+		t.Errorf("got error %v for a shallow clone, want one about the clone being shallow", err)
+	}
+
+	// Unless the app version is given explicitly:
+	f.appVersion = "7"
+	appVersion, _, err = f.versionOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *appVersion != 7 {
+		t.Errorf("got app version %d, want 7", *appVersion)
+	}
+}
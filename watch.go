@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long to wait after a change before rebuilding. Editors and build
+// tools often touch several files in quick succession; we want to
+// rebuild once for the whole batch.
+const watchDebounce = 500 * time.Millisecond
+
+// Report whether a change to the file at path, under the watched
+// directory root, should be ignored by watch mode. This covers our own
+// output (otherwise every build would trigger another one) and the
+// contents of hidden directories such as .git. Only the part of the path
+// below root counts, so the project itself may live in e.g. ~/.local.
+func watchIgnored(root, path string) bool {
+	if strings.HasSuffix(path, ".spk") || strings.HasSuffix(path, ".build-state") {
+		return true
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if len(part) > 1 && part[0] == '.' && part != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the directories watch mode should monitor for the build
+// described by bFlags.
+func watchedDirs(bFlags *buildCmdFlags) []string {
+	dirs := []string{bFlags.contextDir, filepath.Dir(bFlags.pkgDefFile)}
+	if bFlags.dockerfile != "" {
+		dirs = append(dirs, filepath.Dir(bFlags.dockerfile))
+	}
+	if bFlags.poDir != "" {
+		dirs = append(dirs, bFlags.poDir)
+	}
+	// Errors in the project config are reported by the build itself.
+	importPath, _ := importPathFor(filepath.Dir(bFlags.pkgDefFile))
+	dirs = append(dirs, importPath...)
+	assets := append([]string{}, bFlags.screenshots...)
+	for _, icon := range bFlags.icons {
+		_, path, _ := splitIconFlag(icon)
+		assets = append(assets, path)
+	}
+	for _, path := range assets {
+		if !strings.HasPrefix(path, imageAssetPrefix) {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			ret = append(ret, dir)
+		}
+	}
+	return ret
+}
+
+// Build the app, print a one-line summary of the result, and show the
+// output of docker build if it failed.
+func watchBuild(bFlags *buildCmdFlags) {
+	log := &bytes.Buffer{}
+	res, err := buildAndPack(bFlags, log, log, os.Stderr)
+	now := time.Now().Format("15:04:05")
+	switch {
+	case err != nil:
+		os.Stderr.Write(log.Bytes())
+		fmt.Printf("[%s] Build failed: %v\n", now, err)
+	case res.upToDate:
+		fmt.Printf("[%s] %s is up to date.\n", now, res.outFilename)
+	default:
+		fmt.Printf("[%s] Built %s (%s %s).\n",
+			now, res.outFilename, res.metadata.name, res.metadata.version)
+	}
+}
+
+// Build the app, and then rebuild it whenever its sources change. Does
+// not return, unless watching the files fails.
+func watchAndBuild(bFlags *buildCmdFlags) {
+	changes := make(chan string)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watchDirs(watchedDirs(bFlags), changes)
+	}()
+
+	watchBuild(bFlags)
+	fmt.Println("Watching for changes...")
+	for {
+		select {
+		case path := <-changes:
+			// Wait for things to settle down before rebuilding:
+			timer := time.NewTimer(watchDebounce)
+		debounce:
+			for {
+				select {
+				case <-changes:
+					timer.Reset(watchDebounce)
+				case <-timer.C:
+					break debounce
+				}
+			}
+			fmt.Printf("%s changed; rebuilding.\n", path)
+			watchBuild(bFlags)
+		case err := <-watchErr:
+			chkfatal("Watching for changes", err)
+		}
+	}
+}
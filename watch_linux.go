@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The events we ask inotify to report.
+const inotifyMask = syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB
+
+// Watch the directory trees rooted at each of dirs, sending the path of
+// each file which changes on `changes`, unless watchIgnored says to
+// ignore it. Blocks until an error occurs.
+//
+// This implementation uses inotify.
+func watchDirs(dirs []string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	defer syscall.Close(fd)
+
+	// A directory we are watching, and the root of the tree it is in.
+	type watch struct {
+		dir, root string
+	}
+	// Map from watch descriptors to the directories they watch.
+	watches := map[int32]watch{}
+	// Watch the directory `dir`, and those under it, which is in the
+	// tree rooted at `root`.
+	addTree := func(root, dir string) error {
+		return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if watchIgnored(root, path) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(fd, path, inotifyMask)
+			if err != nil {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			watches[int32(wd)] = watch{dir: path, root: root}
+			return nil
+		})
+	}
+	for _, dir := range dirs {
+		if err := addTree(dir, dir); err != nil {
+			return err
+		}
+	}
+
+	var buf [4096 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// The watched directory went away.
+				delete(watches, event.Wd)
+				continue
+			}
+			w, ok := watches[event.Wd]
+			if !ok {
+				continue
+			}
+			path := filepath.Join(w.dir, name)
+			if watchIgnored(w.root, path) {
+				continue
+			}
+			if event.Mask&syscall.IN_ISDIR != 0 &&
+				event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// Start watching new directories too. If this
+				// fails, it is most likely because the directory
+				// has already been removed again, so we don't
+				// treat that as fatal.
+				addTree(w.root, path)
+			}
+			changes <- path
+		}
+	}
+}
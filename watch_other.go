@@ -0,0 +1,78 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often to check for changes on systems without inotify.
+const watchPollInterval = time.Second
+
+// Information about a file we use to detect changes.
+type watchStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// Return a snapshot of the files under the directory trees rooted at each
+// of dirs, other than those ignored by watchIgnored.
+func watchSnapshot(dirs []string) (map[string]watchStat, error) {
+	ret := map[string]watchStat{}
+	for _, root := range dirs {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// Removed while we were walking the tree.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if watchIgnored(root, path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ret[path] = watchStat{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Watch the directory trees rooted at each of dirs, sending the path of
+// each file which changes on `changes`, unless watchIgnored says to
+// ignore it. Blocks until an error occurs.
+//
+// This implementation periodically polls the file system.
+func watchDirs(dirs []string, changes chan<- string) error {
+	old, err := watchSnapshot(dirs)
+	if err != nil {
+		return err
+	}
+	for {
+		time.Sleep(watchPollInterval)
+		cur, err := watchSnapshot(dirs)
+		if err != nil {
+			return err
+		}
+		for path, st := range cur {
+			if oldSt, ok := old[path]; !ok || oldSt != st {
+				changes <- path
+			}
+		}
+		for path := range old {
+			if _, ok := cur[path]; !ok {
+				changes <- path
+			}
+		}
+		old = cur
+	}
+}
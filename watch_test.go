@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWatchIgnored(t *testing.T) {
+	cases := []struct {
+		root, path string
+		ignored    bool
+	}{
+		{"/home/me/app", "/home/me/app/main.go", false},
+		{"/home/me/app", "/home/me/app/src/main.go", false},
+		{"/home/me/app", "/home/me/app/.git/index", true},
+		{"/home/me/app", "/home/me/app/src/.cache/x", true},
+		{"/home/me/app", "/home/me/app/.gitignore", true},
+		{"/home/me/app", "/home/me/app/app-0.1.spk", true},
+		{"/home/me/app", "/home/me/app/app-0.1.spk.build-state", true},
+
+		// Hidden directories above the root don't count:
+		{"/home/me/.local/src/app", "/home/me/.local/src/app/main.go", false},
+		{"/home/me/.projects/app", "/home/me/.projects/app/.git/HEAD", true},
+		{".", "main.go", false},
+		{"../.app", "../.app/main.go", false},
+	}
+	for _, c := range cases {
+		if got := watchIgnored(c.root, c.path); got != c.ignored {
+			t.Errorf("watchIgnored(%q, %q) = %v, want %v", c.root, c.path, got, c.ignored)
+		}
+	}
+}
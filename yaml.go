@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// This file converts between YAML documents and trees of dataNodes. The
+// parsing and formatting is done by gopkg.in/yaml.v3; only the first
+// document in a file is read.
+
+// Matches the position prefix of errors from the yaml package, e.g.
+// "yaml: line 3: mapping values are not allowed in this context".
+var yamlErrorRegexp = regexp.MustCompile(`^yaml: line ([0-9]+): (.*)$`)
+
+// Parse a YAML document.
+func parseYAML(filename, src string) (*dataNode, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(src), &doc); err != nil {
+		pos := srcPos{filename: filename, line: 1, col: 1}
+		msg := strings.TrimPrefix(err.Error(), "yaml: ")
+		if m := yamlErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+			pos.line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+		return nil, errorAt(pos, "%s", msg)
+	}
+	if doc.Kind == 0 {
+		// An empty document.
+		return &dataNode{kind: dataNull, pos: srcPos{filename: filename, line: 1, col: 1}}, nil
+	}
+	c := &yamlConverter{filename: filename, active: map[*yaml.Node]bool{}}
+	return c.convert(doc.Content[0])
+}
+
+// State for converting a yaml.Node into a dataNode.
+type yamlConverter struct {
+	filename string
+
+	// Anchored nodes we are in the middle of converting, used to detect
+	// aliases which refer to themselves.
+	active map[*yaml.Node]bool
+}
+
+func (c *yamlConverter) pos(n *yaml.Node) srcPos {
+	return srcPos{filename: c.filename, line: n.Line, col: n.Column}
+}
+
+func (c *yamlConverter) convert(n *yaml.Node) (*dataNode, error) {
+	ret := &dataNode{pos: c.pos(n)}
+	switch n.Kind {
+	case yaml.AliasNode:
+		if c.active[n.Alias] {
+			return nil, errorAt(ret.pos, "alias *%s refers to its own anchor", n.Value)
+		}
+		c.active[n.Alias] = true
+		defer delete(c.active, n.Alias)
+		return c.convert(n.Alias)
+	case yaml.ScalarNode:
+		ret.kind = dataScalar
+		ret.text = n.Value
+		switch n.ShortTag() {
+		case "!!null":
+			ret.kind = dataNull
+			ret.text = ""
+		case "!!bool":
+			ret.text = strings.ToLower(n.Value)
+		case "!!int", "!!float":
+		case "!!str":
+			ret.quoted = true
+		case "!!binary":
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(n.Value), ""))
+			if err != nil {
+				return nil, errorAt(ret.pos, "invalid !!binary value: %v", err)
+			}
+			ret.text = string(data)
+			ret.quoted = true
+		default:
+			return nil, errorAt(ret.pos, "unsupported tag %s", n.Tag)
+		}
+	case yaml.SequenceNode:
+		if n.ShortTag() != "!!seq" {
+			return nil, errorAt(ret.pos, "unsupported tag %s", n.Tag)
+		}
+		ret.kind = dataList
+		ret.elems = []*dataNode{}
+		for _, elem := range n.Content {
+			value, err := c.convert(elem)
+			if err != nil {
+				return nil, err
+			}
+			ret.elems = append(ret.elems, value)
+		}
+	case yaml.MappingNode:
+		if n.ShortTag() != "!!map" {
+			return nil, errorAt(ret.pos, "unsupported tag %s", n.Tag)
+		}
+		ret.kind = dataMap
+		if err := c.addFields(ret, n, false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errorAt(ret.pos, "unsupported YAML node")
+	}
+	return ret, nil
+}
+
+// Add the entries of the mapping `n` to `dst`. If `merging` is true, the
+// entries come from a merge key (<<), and don't override those already
+// present.
+func (c *yamlConverter) addFields(dst *dataNode, n *yaml.Node, merging bool) error {
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Kind == yaml.ScalarNode && key.ShortTag() == "!!merge" {
+			merges = append(merges, value)
+			continue
+		}
+		if key.Kind != yaml.ScalarNode {
+			return errorAt(c.pos(key), "mapping keys must be scalars")
+		}
+		if _, ok := dst.field(key.Value); ok {
+			if merging {
+				continue
+			}
+			return errorAt(c.pos(key), "duplicate key %q", key.Value)
+		}
+		v, err := c.convert(value)
+		if err != nil {
+			return err
+		}
+		dst.fields = append(dst.fields, &dataField{pos: c.pos(key), key: key.Value, value: v})
+	}
+	// Merged entries come after the mapping's own, which take precedence:
+	for _, m := range merges {
+		if err := c.merge(dst, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge the value of a merge key, which must be a mapping, an alias of
+// one, or a sequence of those, into `dst`.
+func (c *yamlConverter) merge(dst *dataNode, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.AliasNode:
+		if c.active[n.Alias] {
+			return errorAt(c.pos(n), "alias *%s refers to its own anchor", n.Value)
+		}
+		c.active[n.Alias] = true
+		defer delete(c.active, n.Alias)
+		return c.merge(dst, n.Alias)
+	case yaml.MappingNode:
+		return c.addFields(dst, n, true)
+	case yaml.SequenceNode:
+		for _, elem := range n.Content {
+			if elem.Kind == yaml.SequenceNode {
+				return errorAt(c.pos(elem), "the value of a merge key must be a mapping or a sequence of mappings")
+			}
+			if err := c.merge(dst, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errorAt(c.pos(n), "the value of a merge key must be a mapping or a sequence of mappings")
+}
+
+// Write `n` to `w` as YAML.
+func writeYAML(w io.Writer, n *dataNode) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNode(n)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Convert `n` into a yaml.Node, for writing.
+func yamlNode(n *dataNode) *yaml.Node {
+	switch n.kind {
+	case dataScalar:
+		ret := &yaml.Node{Kind: yaml.ScalarNode, Value: n.text}
+		if n.quoted && !utf8.ValidString(n.text) {
+			ret.Tag = "!!binary"
+			ret.Value = base64.StdEncoding.EncodeToString([]byte(n.text))
+		} else if n.quoted {
+			// The encoder quotes the value if it would otherwise
+			// be read as something other than a string.
+			ret.Tag = "!!str"
+		}
+		return ret
+	case dataList:
+		ret := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, elem := range n.elems {
+			ret.Content = append(ret.Content, yamlNode(elem))
+		}
+		return ret
+	case dataMap:
+		ret := &yaml.Node{Kind: yaml.MappingNode}
+		for _, f := range n.fields {
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.key}
+			ret.Content = append(ret.Content, key, yamlNode(f.value))
+		}
+		if len(n.fields) == 1 && strings.HasPrefix(n.fields[0].key, "$") &&
+			isYAMLInline(n.fields[0].value) {
+			// e.g. {$embed: icon.svg}, which reads better on one
+			// line.
+			ret.Style = yaml.FlowStyle
+		}
+		return ret
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	}
+}
+
+// Report whether `n` can be written on a single line.
+func isYAMLInline(n *dataNode) bool {
+	return n.kind == dataNull || (n.kind == dataScalar && !strings.Contains(n.text, "\n"))
+}
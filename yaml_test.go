@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Return `n` as compact JSON-like text, which shows which scalars are
+// quoted.
+func dataString(n *dataNode) string {
+	switch n.kind {
+	case dataNull:
+		return "null"
+	case dataScalar:
+		if n.quoted {
+			return jsonString(n.text)
+		}
+		return n.text
+	case dataList:
+		parts := []string{}
+		for _, elem := range n.elems {
+			parts = append(parts, dataString(elem))
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	default:
+		parts := []string{}
+		for _, f := range n.fields {
+			parts = append(parts, jsonString(f.key)+":"+dataString(f.value))
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	for _, c := range []struct {
+		src, want string
+	}{
+		{"", `null`},
+		{"a: 1\nb: true\nc: ~\nd: hello\ne: '1'\nf: \"yes\"\ng: True\n",
+			`{"a":1,"b":true,"c":null,"d":"hello","e":"1","f":"yes","g":true}`},
+		{"- 0x10\n- -1.5\n- .inf\n- [a, 'b', {c: d}]\n",
+			`[0x10,-1.5,.inf,["a","b",{"c":"d"}]]`},
+		// Flow collections may span lines:
+		{"argv: [/bin/sh,\n  -c,\n  \"echo hi\"]\n", `{"argv":["/bin/sh","-c","echo hi"]}`},
+		{"text: |\n  line one\n  line two\nfolded: >-\n  one\n  two\n",
+			`{"text":"line one\nline two\n","folded":"one two"}`},
+		// Anchors, aliases and merge keys:
+		{"base: &cmd\n  argv: [a]\nx: *cmd\ny:\n  <<: *cmd\n  environ: []\n",
+			`{"base":{"argv":["a"]},"x":{"argv":["a"]},"y":{"environ":[],"argv":["a"]}}`},
+		{"a: &a {x: 1, y: 2}\nb:\n  <<: [*a]\n  x: 3\n",
+			`{"a":{"x":1,"y":2},"b":{"x":3,"y":2}}`},
+		// Tags:
+		{"a: !!str 8000\nb: !!binary aGk=\n", `{"a":"8000","b":"hi"}`},
+		{"# comment\n---\na: 1 # another\n...\n", `{"a":1}`},
+	} {
+		n, err := parseYAML("test.yaml", c.src)
+		if err != nil {
+			t.Errorf("parsing %q: %v", c.src, err)
+			continue
+		}
+		if got := dataString(n); got != c.want {
+			t.Errorf("parsing %q:\n got: %s\nwant: %s", c.src, got, c.want)
+		}
+	}
+}
+
+func TestParseYAMLPositions(t *testing.T) {
+	n, err := parseYAML("test.yaml", "manifest:\n  appVersion: 3\n  actions:\n    - title: x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := n.fields[0].value
+	if pos := manifest.fields[0].pos; pos.String() != "test.yaml:2:3" {
+		t.Errorf("appVersion is at %v, want test.yaml:2:3", pos)
+	}
+	if pos := manifest.fields[0].value.pos; pos.String() != "test.yaml:2:15" {
+		t.Errorf("appVersion's value is at %v, want test.yaml:2:15", pos)
+	}
+	if pos := manifest.fields[1].value.elems[0].pos; pos.String() != "test.yaml:4:7" {
+		t.Errorf("the action is at %v, want test.yaml:4:7", pos)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"a: 1\na: 2\n", `test.yaml:2:1: duplicate key "a"`},
+		{"a: 1\n b: 2\n", `test.yaml:2:1: mapping values are not allowed in this context`},
+		{"a: [1, 2\n", `test.yaml:1:1: did not find expected ',' or ']'`},
+		{"a: *nope\n", `test.yaml:1:1: unknown anchor 'nope' referenced`},
+		{"a: !!set {x}\n", `test.yaml:1:4: unsupported tag !!set`},
+		{"a:\n  <<: 1\n", `test.yaml:2:7: the value of a merge key must be a mapping or a sequence of mappings`},
+		{"? [a]\n: 1\n", `test.yaml:1:3: mapping keys must be scalars`},
+	} {
+		_, err := parseYAML("test.yaml", c.src)
+		if err == nil {
+			t.Errorf("parsing %q: no error, want %s", c.src, c.err)
+		} else if err.Error() != c.err {
+			t.Errorf("parsing %q:\n got: %v\nwant: %s", c.src, err, c.err)
+		}
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	n := mapNode(
+		&dataField{key: "id", value: stringNode("abc")},
+		&dataField{key: "manifest", value: mapNode(
+			&dataField{key: "appVersion", value: plainNode("3")},
+			&dataField{key: "appMarketingVersion", value: stringNode("1.0")},
+			&dataField{key: "appTitle", value: stringNode("true")},
+			&dataField{key: "actions", value: listNode(mapNode(
+				&dataField{key: "input", value: singletonMap("none", &dataNode{kind: dataNull})},
+				&dataField{key: "command", value: singletonMap("argv", listNode(
+					stringNode("/sandstorm-http-bridge"), stringNode("8000"), stringNode("--"),
+				))},
+			))},
+			&dataField{key: "metadata", value: mapNode(
+				&dataField{key: "icons", value: singletonMap("appGrid",
+					singletonMap("svg", singletonMap("$embed", stringNode("icon.svg"))))},
+				&dataField{key: "license", value: singletonMap("openSource", plainNode("apache2"))},
+				&dataField{key: "changeLog", value: stringNode("line one\nline two\n")},
+				&dataField{key: "categories", value: listNode()},
+			)},
+		)},
+	)
+	want := `id: abc
+manifest:
+  appVersion: 3
+  appMarketingVersion: "1.0"
+  appTitle: "true"
+  actions:
+    - input:
+        none: null
+      command:
+        argv:
+          - /sandstorm-http-bridge
+          - "8000"
+          - --
+  metadata:
+    icons:
+      appGrid:
+        svg: {$embed: icon.svg}
+    license:
+      openSource: apache2
+    changeLog: |
+      line one
+      line two
+    categories: []
+`
+	buf := &bytes.Buffer{}
+	if err := writeYAML(buf, n); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf, want)
+	}
+
+	// Reading it back and writing it again should give the same text:
+	back, err := parseYAML("test.yaml", buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := writeYAML(buf, back); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("after reading it back, got:\n%s\nwant:\n%s", buf, want)
+	}
+}
+
+func TestWriteYAMLBinary(t *testing.T) {
+	// Text which isn't valid UTF-8 can't be written as a plain string:
+	n := singletonMap("data", stringNode("\xff\x00"))
+	buf := &bytes.Buffer{}
+	if err := writeYAML(buf, n); err != nil {
+		t.Fatal(err)
+	}
+	back, err := parseYAML("test.yaml", buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dataString(back), dataString(n); got != want {
+		t.Errorf("read back %q:\n got: %s\nwant: %s", buf, got, want)
+	}
+}